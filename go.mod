@@ -1,3 +1,7 @@
 module Log_Anallyzer
 
 go 1.23.4
+
+require go.etcd.io/bbolt v1.4.3
+
+require golang.org/x/sys v0.29.0 // indirect
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// analysisJobDir holds the files of form uploads until their analysis job is finished
+const analysisJobDir = "uploads/jobs"
+
+const (
+	maxRunningAnalysisJobs = 2         // Jobs analyzed at the same time, later ones wait in the queue
+	analysisJobTTL         = time.Hour // How long a finished job can still be looked up
+)
+
+// Phases of an analysis job. A job that is done, failed or canceled is finished.
+const (
+	phaseQueued   = "queued"
+	phaseParsing  = "parsing"
+	phaseMerging  = "merging"
+	phaseSaving   = "saving"
+	phaseDone     = "done"
+	phaseFailed   = "failed"
+	phaseCanceled = "canceled"
+)
+
+// AnalysisJobStatus describes an analysis job. BytesParsed counts what was read of the uploaded
+// files so far, archives before they are decompressed.
+type AnalysisJobStatus struct {
+	JobID         string `json:"jobID"`
+	TabUUID       string `json:"tabUUID"`
+	Phase         string `json:"phase"`
+	BytesTotal    int64  `json:"bytesTotal"`
+	BytesParsed   int64  `json:"bytesParsed"`
+	LinesAccepted int64  `json:"linesAccepted"` // Log entries parsed, their continuation lines are not counted
+	LinesRejected int64  `json:"linesRejected"` // Lines that matched no log format
+	Error         string `json:"error,omitempty"`
+}
+
+// analysisProgress is how far the analysis of an upload got. The workers parsing its files update
+// it concurrently, all methods can be called on a nil progress.
+type analysisProgress struct {
+	mu            sync.Mutex
+	phase         string
+	bytesParsed   atomic.Int64
+	linesAccepted atomic.Int64
+	linesRejected atomic.Int64
+}
+
+// setPhase records the phase the analysis entered
+func (p *analysisProgress) setPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+}
+
+// currentPhase returns the phase the analysis is in
+func (p *analysisProgress) currentPhase() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.phase
+}
+
+// read counts bytes read from the uploaded files
+func (p *analysisProgress) read(n int) {
+	if p != nil {
+		p.bytesParsed.Add(int64(n))
+	}
+}
+
+// accept counts a parsed entry
+func (p *analysisProgress) accept() {
+	if p != nil {
+		p.linesAccepted.Add(1)
+	}
+}
+
+// reject counts a line that matched no log format
+func (p *analysisProgress) reject() {
+	if p != nil {
+		p.linesRejected.Add(1)
+	}
+}
+
+// progressReader counts what is read of an uploaded file and fails once ctx is canceled, which
+// stops the parsing of the file
+type progressReader struct {
+	io.ReaderAt
+	ctx      context.Context
+	progress *analysisProgress
+}
+
+func (r progressReader) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.progress.read(n)
+	return n, err
+}
+
+// analysisJob analyzes an upload in the background
+type analysisJob struct {
+	id         string
+	tabUUID    string
+	bytesTotal int64
+	progress   analysisProgress
+	cancel     context.CancelFunc
+
+	mu       sync.Mutex // Guards the outcome of the job
+	err      string
+	result   *TemplateData // Results of a job that is done, until they are shown
+	finished time.Time
+}
+
+var (
+	analysisJobsMu sync.Mutex
+	analysisJobs   = map[string]*analysisJob{}
+
+	// analysisJobSlots holds a token for every running job
+	analysisJobSlots = make(chan struct{}, maxRunningAnalysisJobs)
+)
+
+// startAnalysisJob queues the analysis of upload and answers with the status of the new job. done
+// is called with the outcome of the analysis before the job is reported as finished, e.g. to remove
+// the uploaded files, and with an error if the job could not be started.
+func startAnalysisJob(w http.ResponseWriter, upload *analysisRequest, done func(error)) {
+	removeExpiredAnalysisJobs()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		done(err)
+		log.Printf("Error creating job ID: %v\n", err)
+		http.Error(w, "Error starting the analysis", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &analysisJob{id: hex.EncodeToString(id), tabUUID: upload.tabUUID, cancel: cancel}
+	for _, file := range upload.files {
+		job.bytesTotal += file.size
+	}
+	job.progress.setPhase(phaseQueued)
+
+	analysisJobsMu.Lock()
+	analysisJobs[job.id] = job
+	analysisJobsMu.Unlock()
+
+	go job.run(ctx, upload, done)
+	log.Printf("Queued analysis job %s of %d files (%d bytes) for %s\n", job.id, len(upload.files), job.bytesTotal, job.tabUUID)
+	writeAnalysisJobStatus(w, http.StatusAccepted, job.status())
+}
+
+// run waits for a free slot, analyzes the upload and records the outcome
+func (j *analysisJob) run(ctx context.Context, upload *analysisRequest, done func(error)) {
+	defer j.cancel()
+
+	var data *TemplateData
+	var err error
+	select {
+	case analysisJobSlots <- struct{}{}:
+		data, err = upload.run(ctx, &j.progress)
+		<-analysisJobSlots
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	done(err)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	switch {
+	case err == nil:
+		j.result = data
+		j.progress.setPhase(phaseDone)
+		log.Printf("Analysis job %s finished\n", j.id)
+	case errors.Is(err, context.Canceled):
+		j.progress.setPhase(phaseCanceled)
+		log.Printf("Analysis job %s canceled\n", j.id)
+	default:
+		j.err = err.Error()
+		j.progress.setPhase(phaseFailed)
+		log.Printf("Analysis job %s failed: %v\n", j.id, err)
+	}
+}
+
+// status describes the job
+func (j *analysisJob) status() AnalysisJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return AnalysisJobStatus{
+		JobID:         j.id,
+		TabUUID:       j.tabUUID,
+		Phase:         j.progress.currentPhase(),
+		BytesTotal:    j.bytesTotal,
+		BytesParsed:   min(j.progress.bytesParsed.Load(), j.bytesTotal), // Zip archives are partly read twice
+		LinesAccepted: j.progress.linesAccepted.Load(),
+		LinesRejected: j.progress.linesRejected.Load(),
+		Error:         j.err,
+	}
+}
+
+// removeExpiredAnalysisJobs forgets jobs that finished more than analysisJobTTL ago
+func removeExpiredAnalysisJobs() {
+	analysisJobsMu.Lock()
+	defer analysisJobsMu.Unlock()
+	for id, job := range analysisJobs {
+		job.mu.Lock()
+		expired := !job.finished.IsZero() && time.Since(job.finished) > analysisJobTTL
+		job.mu.Unlock()
+		if expired {
+			delete(analysisJobs, id)
+		}
+	}
+}
+
+// spoolUploadedFiles copies the files of a form upload to a directory of their own, since the files
+// of a multipart form are removed once the request is answered. The upload reads the copies from then on.
+func spoolUploadedFiles(upload *analysisRequest) (string, error) {
+	if err := os.MkdirAll(analysisJobDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(analysisJobDir, "upload-*")
+	if err != nil {
+		return "", err
+	}
+	for i, file := range upload.files {
+		path := filepath.Join(dir, fmt.Sprintf("%d", i))
+		if err := copyUploadedFile(file, path); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("error copying %s: %w", file.name, err)
+		}
+		upload.files[i].open = func() (multipart.File, error) {
+			return os.Open(path)
+		}
+	}
+	return dir, nil
+}
+
+// copyUploadedFile writes the content of an uploaded file to path
+func copyUploadedFile(file uploadedFile, path string) error {
+	src, err := file.open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// analysisJobParam looks up the job named by the jobID parameter, writing 404 if there is none
+func analysisJobParam(w http.ResponseWriter, r *http.Request) (*analysisJob, bool) {
+	analysisJobsMu.Lock()
+	job := analysisJobs[r.FormValue("jobID")]
+	analysisJobsMu.Unlock()
+	if job == nil {
+		http.Error(w, "Unknown job ID", http.StatusNotFound)
+		return nil, false
+	}
+	return job, true
+}
+
+// AnalysisJobStatusHandler reports the phase and progress of an analysis job
+func AnalysisJobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := analysisJobParam(w, r)
+	if !ok {
+		return
+	}
+	writeAnalysisJobStatus(w, http.StatusOK, job.status())
+}
+
+// AnalysisJobCancelHandler cancels an analysis job. The session is left as it was before the
+// upload, unless the job is already saving it, in which case it finishes.
+func AnalysisJobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok := analysisJobParam(w, r)
+	if !ok {
+		return
+	}
+	job.cancel()
+	log.Printf("Canceling analysis job %s\n", job.id)
+	writeAnalysisJobStatus(w, http.StatusOK, job.status())
+}
+
+// AnalysisJobResultHandler renders the results of a job that is done. They are shown once, later
+// the statistics of the tab are on the upload page.
+func AnalysisJobResultHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := analysisJobParam(w, r)
+	if !ok {
+		return
+	}
+	job.mu.Lock()
+	data := job.result
+	job.result = nil
+	job.mu.Unlock()
+	if data == nil {
+		http.Error(w, "The analysis is not done or its results were already shown", http.StatusConflict)
+		return
+	}
+	renderUploadResults(w, data)
+}
+
+// writeAnalysisJobStatus writes the status of a job as JSON
+func writeAnalysisJobStatus(w http.ResponseWriter, code int, status AnalysisJobStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error writing analysis job status: %v\n", err)
+	}
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatedFile is an uploaded file whose reads past the first bytes wait until gate is closed
+type gatedFile struct {
+	*strings.Reader
+	gate <-chan struct{}
+	open int64 // Bytes that can be read before the gate is closed
+}
+
+func (f gatedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > f.open {
+		<-f.gate
+	}
+	return f.Reader.ReadAt(p, off)
+}
+
+func (f gatedFile) Close() error { return nil }
+
+// testAnalysisRequest returns an upload of a log whose reads past the first open bytes wait for
+// gate, and of a short second log, so the files are merged
+func testAnalysisRequest(t *testing.T, tabUUID, log string, gate <-chan struct{}, open int64) *analysisRequest {
+	t.Helper()
+	parser, err := newLineParser("pipe", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := testUploadLog(59, 5)
+	return &analysisRequest{tabUUID: tabUUID, parser: parser, files: []uploadedFile{
+		{name: "app.log", size: int64(len(log)), open: func() (multipart.File, error) {
+			return gatedFile{strings.NewReader(log), gate, open}, nil
+		}},
+		{name: "app.log.1", size: int64(len(second)), open: func() (multipart.File, error) {
+			return gatedFile{strings.NewReader(second), nil, int64(len(second))}, nil
+		}},
+	}}
+}
+
+// longTestLog returns a log of 50 uploads of testUploadLog, about 800 KB
+func longTestLog() string {
+	var log strings.Builder
+	for upload := 0; upload < 50; upload++ {
+		log.WriteString(testUploadLog(upload, 60))
+	}
+	return log.String()
+}
+
+// startTestAnalysisJob starts a job for upload and returns its ID
+func startTestAnalysisJob(t *testing.T, upload *analysisRequest) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	startAnalysisJob(w, upload, func(error) {})
+	var status AnalysisJobStatus
+	if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &status) != nil {
+		t.Fatalf("starting the job: %d %s", w.Code, w.Body.String())
+	}
+	return status.JobID
+}
+
+// analysisJobRequest calls handler for a job and decodes its status
+func analysisJobRequest(t *testing.T, handler http.HandlerFunc, method, jobID string) AnalysisJobStatus {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, "/upload/jobs?jobID="+jobID, nil))
+	var status AnalysisJobStatus
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &status) != nil {
+		t.Fatalf("status of job %s: %d %s", jobID, w.Code, w.Body.String())
+	}
+	return status
+}
+
+// waitForAnalysisJob polls the status of a job until done reports true for it
+func waitForAnalysisJob(t *testing.T, jobID string, done func(AnalysisJobStatus) bool) AnalysisJobStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := analysisJobRequest(t, AnalysisJobStatusHandler, http.MethodGet, jobID)
+		if done(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is stuck at %+v", jobID, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// inPhase returns a condition that holds once a job is in the phase
+func inPhase(phase string) func(AnalysisJobStatus) bool {
+	return func(status AnalysisJobStatus) bool { return status.Phase == phase }
+}
+
+func TestAnalysisJobProgress(t *testing.T) {
+	useTestServerDir(t)
+	tab := "6a1d9b2f-4c5e-4d3f-8a61-8293a4b5c637"
+	t.Cleanup(func() { forgetTabStats(tab) })
+	log := longTestLog()
+	gate := make(chan struct{})
+	jobID := startTestAnalysisJob(t, testAnalysisRequest(t, tab, log, gate, 256<<10))
+
+	// The job reports what it parsed so far while it waits for the rest of the file
+	status := waitForAnalysisJob(t, jobID, func(status AnalysisJobStatus) bool { return status.LinesAccepted > 0 })
+	if status.Phase != phaseParsing || status.BytesParsed == 0 || status.BytesParsed > 256<<10 || status.BytesTotal != int64(len(log)+len(testUploadLog(59, 5))) {
+		t.Errorf("status while parsing = %+v", status)
+	}
+	w := httptest.NewRecorder()
+	AnalysisJobResultHandler(w, httptest.NewRequest(http.MethodGet, "/upload/jobs/result?jobID="+jobID, nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("results while parsing: %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	close(gate)
+	status = waitForAnalysisJob(t, jobID, inPhase(phaseDone))
+	if status.BytesParsed != status.BytesTotal || status.LinesAccepted != 3*(50*60+5) || status.LinesRejected != 0 || status.Error != "" {
+		t.Errorf("status when done = %+v", status)
+	}
+
+	// The results are shown once
+	for _, want := range []int{http.StatusOK, http.StatusConflict} {
+		w := httptest.NewRecorder()
+		AnalysisJobResultHandler(w, httptest.NewRequest(http.MethodGet, "/upload/jobs/result?jobID="+jobID, nil))
+		if w.Code != want {
+			t.Errorf("results when done: %d, want %d", w.Code, want)
+		}
+	}
+	if stat, err := sessionStore.Stat(tab); err != nil || stat.Entries != 3*(50*60+5) {
+		t.Errorf("session = %+v, %v, want %d entries", stat, err, 3*(50*60+5))
+	}
+}
+
+func TestAnalysisJobCancel(t *testing.T) {
+	useTestServerDir(t)
+	tab := "7b2e0c3a-5d6f-4e4a-9b72-93a4b5c6d748"
+	t.Cleanup(func() { forgetTabStats(tab) })
+	if w := postUpload(tab, "earlier.log", testUploadLog(58, 10)); w.Code != http.StatusOK {
+		t.Fatalf("earlier upload: %d %s", w.Code, w.Body.String())
+	}
+
+	gate := make(chan struct{})
+	jobID := startTestAnalysisJob(t, testAnalysisRequest(t, tab, longTestLog(), gate, 256<<10))
+	waitForAnalysisJob(t, jobID, func(status AnalysisJobStatus) bool { return status.LinesAccepted > 0 })
+	analysisJobRequest(t, AnalysisJobCancelHandler, http.MethodPost, jobID)
+	close(gate)
+	waitForAnalysisJob(t, jobID, inPhase(phaseCanceled))
+
+	// Nothing of the canceled upload is in the session or the statistics of the tab
+	if stat, err := sessionStore.Stat(tab); err != nil || stat.Entries != 30 {
+		t.Errorf("session after the cancel = %+v, %v, want the 30 entries of the earlier upload", stat, err)
+	}
+	pathStats, _ := tabStats(tab)
+	if stats := pathStats["/api/orders"]; stats == nil || stats.Count != 10 {
+		t.Errorf("stats of /api/orders after the cancel = %+v, want the 10 responses of the earlier upload", stats)
+	}
+	if w := postUpload(tab, "later.log", testUploadLog(57, 10)); w.Code != http.StatusOK {
+		t.Fatalf("upload after the cancel: %d %s", w.Code, w.Body.String())
+	}
+	if stat, err := sessionStore.Stat(tab); err != nil || stat.Entries != 60 {
+		t.Errorf("session after the next upload = %+v, %v, want 60 entries", stat, err)
+	}
+}
+
+func TestAnalysisJobSlots(t *testing.T) {
+	useTestServerDir(t)
+	tabs := []string{"8c3f1d4b-6e7a-4f5b-8c83-a4b5c6d7e859", "9d4a2e5c-7f8b-4a6c-9d94-b5c6d7e8f96a", "0e5b3f6d-8a9c-4b7d-8ea5-c6d7e8f90a7b"}
+	t.Cleanup(func() { forgetTabStats(tabs...) })
+
+	// Jobs wait in the queue while maxRunningAnalysisJobs others are parsing
+	var gates []chan struct{}
+	var jobIDs []string
+	for i, tab := range tabs {
+		gates = append(gates, make(chan struct{}))
+		jobIDs = append(jobIDs, startTestAnalysisJob(t, testAnalysisRequest(t, tab, testUploadLog(i, 10), gates[i], 0)))
+	}
+	running := func() (parsing, queued []int) {
+		for i, jobID := range jobIDs {
+			switch analysisJobRequest(t, AnalysisJobStatusHandler, http.MethodGet, jobID).Phase {
+			case phaseParsing:
+				parsing = append(parsing, i)
+			case phaseQueued:
+				queued = append(queued, i)
+			}
+		}
+		return parsing, queued
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	parsing, queued := running()
+	for len(parsing) < maxRunningAnalysisJobs && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		parsing, queued = running()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if parsing, queued = running(); len(parsing) != maxRunningAnalysisJobs || len(queued) != 1 {
+		t.Fatalf("jobs %v parsing and %v queued, want %d parsing", parsing, queued, maxRunningAnalysisJobs)
+	}
+
+	// The queued job starts once a running one is done
+	close(gates[parsing[0]])
+	waitForAnalysisJob(t, jobIDs[parsing[0]], inPhase(phaseDone))
+	waitForAnalysisJob(t, jobIDs[queued[0]], inPhase(phaseParsing))
+	for _, i := range append(parsing[1:], queued[0]) {
+		close(gates[i])
+	}
+	for _, jobID := range jobIDs {
+		waitForAnalysisJob(t, jobID, inPhase(phaseDone))
+	}
+}
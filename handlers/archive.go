@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+)
+
+// Magic numbers used to recognise compressed uploads by their content
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+	tarMagic  = []byte("ustar")
+)
+
+// tarMagicOffset is the position of the "ustar" marker inside a tar header block
+const tarMagicOffset = 257
+
+// archiveNesting records which layers a stream has already been unpacked from. An upload may be a
+// gzip stream around a tar or zip archive whose members may each be gzip compressed once more;
+// anything nested deeper, such as a gzip quine, is refused instead of unpacked endlessly.
+type archiveNesting struct {
+	gzip    bool
+	archive bool
+}
+
+// forEachLogFile detects gzip, zip and tar.gz uploads by content and calls fn with a
+// decompressing stream for every log file they contain. Plain files are passed through as is.
+// The source passed to fn names the upload and, for archives, the member the stream came from.
+func forEachLogFile(name string, file io.ReaderAt, size int64, fn func(source string, r io.Reader) error) error {
+	header := make([]byte, len(zipMagic))
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	// Zip archives need random access to their central directory
+	if bytes.Equal(header[:n], zipMagic) {
+		archive, err := zip.NewReader(file, size)
+		if err != nil {
+			return fmt.Errorf("error reading zip archive %s: %w", name, err)
+		}
+		for _, member := range archive.File {
+			if member.FileInfo().IsDir() {
+				continue
+			}
+			memberReader, err := member.Open()
+			if err != nil {
+				return fmt.Errorf("error opening %s in %s: %w", member.Name, name, err)
+			}
+			err = forEachLogStream(name+"/"+member.Name, memberReader, archiveNesting{archive: true}, fn)
+			memberReader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return forEachLogStream(name, io.NewSectionReader(file, 0, size), archiveNesting{}, fn)
+}
+
+// forEachLogStream handles uploads that can be decompressed sequentially: gzip, tar and tar.gz
+func forEachLogStream(source string, r io.Reader, nesting archiveNesting, fn func(source string, r io.Reader) error) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	// Peek returns fewer bytes for short files, which simply means no magic number matched
+	header, _ := reader.Peek(tarMagicOffset + len(tarMagic))
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		if nesting.gzip {
+			return fmt.Errorf("gzip stream %s compressed more than once is not supported", source)
+		}
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("error reading gzip stream %s: %w", source, err)
+		}
+		defer gz.Close()
+
+		// A .tar.gz reports the tar members, a plain .gz keeps the upload's name
+		nesting.gzip = true
+		return forEachLogStream(source, gz, nesting, fn)
+
+	case isTarHeader(header):
+		if nesting.archive {
+			return fmt.Errorf("tar archive %s nested inside another archive is not supported", source)
+		}
+		archive := tar.NewReader(reader)
+		for {
+			member, err := archive.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading tar archive %s: %w", source, err)
+			}
+			if member.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := forEachLogStream(source+"/"+path.Clean(member.Name), archive, archiveNesting{archive: true}, fn); err != nil {
+				return err
+			}
+		}
+
+	case bytes.HasPrefix(header, zipMagic):
+		return fmt.Errorf("zip archive %s nested inside another archive is not supported", source)
+
+	default:
+		return fn(source, reader)
+	}
+}
+
+// isTarHeader reports whether header starts with a tar header block
+func isTarHeader(header []byte) bool {
+	return len(header) >= tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic)
+}
+
+// isSingleLogFile reports whether an upload holds a single log file, plain or gzip compressed, rather
+// than an archive of several. Its entries need no merging then. Broken archives, and streams nested
+// deeper than forEachLogStream accepts, count as single, reading them fails later on anyway.
+func isSingleLogFile(file io.ReaderAt, size int64) bool {
+	header := make([]byte, tarMagicOffset+len(tarMagic))
+	n, _ := file.ReadAt(header, 0)
+	header = header[:n]
+	if bytes.HasPrefix(header, zipMagic) {
+		return false
+	}
+
+	// Only a single gzip layer is unpacked, the same as for reading the upload
+	if bytes.HasPrefix(header, gzipMagic) {
+		gz, err := gzip.NewReader(io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return true
+		}
+		n, _ := io.ReadFull(gz, header[:cap(header)])
+		gz.Close()
+		header = header[:n]
+	}
+	return !isTarHeader(header)
+}
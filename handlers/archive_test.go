@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testFile is an archive member or a plain file of a test upload
+type testFile struct {
+	name    string
+	content []byte
+}
+
+func gzipped(content []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(content)
+	gz.Close()
+	return buf.Bytes()
+}
+
+func tarred(files ...testFile) []byte {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	archive.WriteHeader(&tar.Header{Name: "logs/", Typeflag: tar.TypeDir, Mode: 0o755})
+	for _, file := range files {
+		archive.WriteHeader(&tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(file.content))})
+		archive.Write(file.content)
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+func zipped(files ...testFile) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	archive.Create("logs/")
+	for _, file := range files {
+		w, _ := archive.Create(file.name)
+		w.Write(file.content)
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+func TestForEachLogFile(t *testing.T) {
+	a, b := []byte("line a\n"), []byte("line b\n")
+	tests := []struct {
+		name    string
+		upload  []byte
+		want    []string
+		wantErr string
+	}{
+		{"plain", a, []string{"app.log: line a\n"}, ""},
+		{"empty", nil, []string{"app.log: "}, ""},
+		{"gzip", gzipped(a), []string{"app.log: line a\n"}, ""},
+		{"tar", tarred(testFile{"logs/a.log", a}, testFile{"./logs//b.log", b}),
+			[]string{"app.log/logs/a.log: line a\n", "app.log/logs/b.log: line b\n"}, ""},
+		{"tar.gz", gzipped(tarred(testFile{"a.log", a}, testFile{"b.log.gz", gzipped(b)})),
+			[]string{"app.log/a.log: line a\n", "app.log/b.log.gz: line b\n"}, ""},
+		{"zip", zipped(testFile{"logs/a.log", a}, testFile{"logs/b.log.gz", gzipped(b)}),
+			[]string{"app.log/logs/a.log: line a\n", "app.log/logs/b.log.gz: line b\n"}, ""},
+		{"gzip in gzip", gzipped(gzipped(a)), nil, "compressed more than once"},
+		{"gzip quine depth", gzipped(gzipped(gzipped(gzipped(a)))), nil, "compressed more than once"},
+		{"tar in tar", tarred(testFile{"inner.tar", tarred(testFile{"a.log", a})}), nil, "nested inside another archive"},
+		{"tar.gz in tar.gz", gzipped(tarred(testFile{"inner.tar.gz", gzipped(tarred(testFile{"a.log", a}))})), nil, "nested inside another archive"},
+		{"zip in tar", tarred(testFile{"inner.zip", zipped(testFile{"a.log", a})}), nil, "nested inside another archive"},
+		{"tar in zip", zipped(testFile{"inner.tar", tarred(testFile{"a.log", a})}), nil, "nested inside another archive"},
+		{"gzip in gzip in tar", tarred(testFile{"a.log.gz.gz", gzipped(gzipped(a))}), nil, "compressed more than once"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			err := forEachLogFile("app.log", bytes.NewReader(test.upload), int64(len(test.upload)), func(source string, r io.Reader) error {
+				content, err := io.ReadAll(r)
+				got = append(got, fmt.Sprintf("%s: %s", source, content))
+				return err
+			})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("log files = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsSingleLogFile(t *testing.T) {
+	a := []byte("line a\n")
+	tests := []struct {
+		name   string
+		upload []byte
+		want   bool
+	}{
+		{"plain", a, true},
+		{"empty", nil, true},
+		{"gzip", gzipped(a), true},
+		{"tar", tarred(testFile{"a.log", a}), false},
+		{"tar.gz", gzipped(tarred(testFile{"a.log", a})), false},
+		{"zip", zipped(testFile{"a.log", a}), false},
+		{"broken gzip", gzipMagic, true},
+		{"gzip in gzip", gzipped(gzipped(tarred(testFile{"a.log", a}))), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isSingleLogFile(bytes.NewReader(test.upload), int64(len(test.upload))); got != test.want {
+				t.Errorf("isSingleLogFile = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
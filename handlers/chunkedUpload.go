@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkedUploadDir holds the partial files of chunked uploads until they are completed
+const chunkedUploadDir = "uploads/chunked"
+
+const (
+	maxChunkBytes         = 16 << 20 // Largest chunk accepted by a single request
+	maxChunkedUploadBytes = 10 << 30 // Largest file that can be uploaded in chunks
+	chunkedUploadTTL      = 24 * time.Hour
+)
+
+// uploadIDPattern matches the identifiers handed out by ChunkedUploadInitHandler
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// ChunkedUploadStatus describes a chunked upload. Offset is the number of bytes received so far,
+// the next chunk has to start there.
+type ChunkedUploadStatus struct {
+	UploadID string `json:"uploadID"`
+	TabUUID  string `json:"tabUUID"`
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+}
+
+// chunkedUploadLocks keeps two requests from writing to the same upload at once
+var (
+	chunkedUploadLocksMu sync.Mutex
+	chunkedUploadLocks   = map[string]*sync.Mutex{}
+)
+
+// errChunkedUploadBusy is returned for an upload another request is writing to
+var errChunkedUploadBusy = errors.New("Another request is writing to this upload")
+
+// lockChunkedUpload returns the held lock of an upload. IDs of uploads that do not exist fail with
+// os.ErrNotExist before a lock is created for them, so only started uploads have one until they
+// are removed. An upload another request holds fails with errChunkedUploadBusy.
+func lockChunkedUpload(uploadID string) (*sync.Mutex, error) {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil, os.ErrNotExist
+	}
+	metaPath, _ := chunkedUploadPaths(uploadID)
+	if _, err := os.Stat(metaPath); err != nil {
+		return nil, err
+	}
+
+	chunkedUploadLocksMu.Lock()
+	defer chunkedUploadLocksMu.Unlock()
+	lock, exists := chunkedUploadLocks[uploadID]
+	if !exists {
+		lock = &sync.Mutex{}
+		chunkedUploadLocks[uploadID] = lock
+	}
+	if !lock.TryLock() {
+		return nil, errChunkedUploadBusy
+	}
+	return lock, nil
+}
+
+// chunkedUploadPaths returns the metadata file and the partial file of an upload
+func chunkedUploadPaths(uploadID string) (meta, part string) {
+	base := filepath.Join(chunkedUploadDir, uploadID)
+	return base + ".json", base + ".part"
+}
+
+// loadChunkedUpload reads the metadata of an upload and the number of bytes received
+func loadChunkedUpload(uploadID string) (*ChunkedUploadStatus, error) {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil, os.ErrNotExist
+	}
+	metaPath, partPath := chunkedUploadPaths(uploadID)
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	var status ChunkedUploadStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("error decoding upload %s: %w", uploadID, err)
+	}
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return nil, err
+	}
+	status.Offset = info.Size()
+	return &status, nil
+}
+
+// removeChunkedUpload deletes the files and the lock of an upload
+func removeChunkedUpload(uploadID string) {
+	metaPath, partPath := chunkedUploadPaths(uploadID)
+	os.Remove(partPath)
+	os.Remove(metaPath)
+
+	chunkedUploadLocksMu.Lock()
+	delete(chunkedUploadLocks, uploadID)
+	chunkedUploadLocksMu.Unlock()
+}
+
+// removeStaleChunkedUploads deletes uploads that received no chunk for chunkedUploadTTL. Uploads
+// a request holds are left alone.
+func removeStaleChunkedUploads() {
+	parts, err := filepath.Glob(filepath.Join(chunkedUploadDir, "*.part"))
+	if err != nil {
+		return
+	}
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil || time.Since(info.ModTime()) <= chunkedUploadTTL {
+			continue
+		}
+		uploadID := strings.TrimSuffix(filepath.Base(part), ".part")
+		lock, err := lockChunkedUpload(uploadID)
+		if errors.Is(err, errChunkedUploadBusy) {
+			continue
+		}
+		log.Printf("Removing abandoned chunked upload %s\n", part)
+		removeChunkedUpload(uploadID)
+		if lock != nil {
+			lock.Unlock()
+		}
+	}
+}
+
+// ChunkedUploadInitHandler starts a chunked upload of a single file. The form holds the uniqueID of
+// the tab, the fileName and the size of the file in bytes.
+func ChunkedUploadInitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	status := ChunkedUploadStatus{TabUUID: r.FormValue("uniqueID"), FileName: filepath.Base(r.FormValue("fileName"))}
+	if err := validateSessionID(status.TabUUID); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Invalid file size", http.StatusBadRequest)
+		return
+	}
+	if size > maxChunkedUploadBytes {
+		http.Error(w, fmt.Sprintf("Files larger than %d bytes cannot be uploaded", maxChunkedUploadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	status.Size = size
+
+	removeStaleChunkedUploads()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Error creating upload ID: %v\n", err)
+		http.Error(w, "Error starting the upload", http.StatusInternalServerError)
+		return
+	}
+	status.UploadID = hex.EncodeToString(id)
+
+	metaPath, partPath := chunkedUploadPaths(status.UploadID)
+	data, _ := json.Marshal(status)
+	err = os.MkdirAll(chunkedUploadDir, os.ModePerm)
+	if err == nil {
+		err = os.WriteFile(partPath, nil, 0o644)
+	}
+	if err == nil {
+		err = os.WriteFile(metaPath, data, 0o644)
+	}
+	if err != nil {
+		removeChunkedUpload(status.UploadID)
+		log.Printf("Error creating chunked upload: %v\n", err)
+		http.Error(w, "Error starting the upload", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Started chunked upload %s of %s (%d bytes) for %s\n", status.UploadID, status.FileName, size, status.TabUUID)
+	writeChunkedUploadStatus(w, http.StatusOK, &status)
+}
+
+// ChunkedUploadHandler reports how much of an upload was received on GET, which is where an
+// interrupted upload resumes, and appends a chunk on PUT. A chunk has to start at the offset
+// query parameter, which must equal the bytes received so far, otherwise the request fails with
+// 409 Conflict and the current status.
+func ChunkedUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	uploadID := r.URL.Query().Get("uploadID")
+	lock, ok := chunkedUploadLock(w, uploadID)
+	if !ok {
+		return
+	}
+	defer lock.Unlock()
+
+	status, ok := chunkedUploadStatus(w, uploadID)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeChunkedUploadStatus(w, http.StatusOK, status)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	if offset != status.Offset {
+		writeChunkedUploadStatus(w, http.StatusConflict, status)
+		return
+	}
+
+	_, partPath := chunkedUploadPaths(uploadID)
+	part, err := os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Printf("Error opening chunked upload %s: %v\n", uploadID, err)
+		http.Error(w, "Error saving the chunk", http.StatusInternalServerError)
+		return
+	}
+
+	// Whatever arrives of an interrupted chunk is kept, the client resumes at the new offset
+	limit := min(int64(maxChunkBytes), status.Size-status.Offset)
+	written, err := io.Copy(part, http.MaxBytesReader(w, r.Body, limit))
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	status.Offset += written
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Chunk is larger than %d bytes or exceeds the file size", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Error receiving chunk of upload %s: %v\n", uploadID, err)
+		http.Error(w, "Error saving the chunk", http.StatusInternalServerError)
+		return
+	}
+	writeChunkedUploadStatus(w, http.StatusOK, status)
+}
+
+// ChunkedUploadCompleteHandler analyzes completed chunked uploads like files of the upload form and
+// renders the results. The form holds the uniqueID of the tab, one uploadID per file and the
+// upload settings. With async set the uploads are analyzed by a background job instead, whose
+// status is returned. The partial files are kept if the analysis fails, so it can be retried.
+func ChunkedUploadCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Failed to parse the form", http.StatusBadRequest)
+		return
+	}
+	tabUUID := r.FormValue("uniqueID")
+	uploadIDs := r.Form["uploadID"]
+	if len(uploadIDs) == 0 {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
+	}
+
+	// The uploads stay locked until they are analyzed
+	var locks []*sync.Mutex
+	defer func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}()
+
+	var files []uploadedFile
+	for _, uploadID := range uploadIDs {
+		lock, ok := chunkedUploadLock(w, uploadID)
+		if !ok {
+			return
+		}
+		locks = append(locks, lock)
+
+		status, ok := chunkedUploadStatus(w, uploadID)
+		if !ok {
+			return
+		}
+		if status.TabUUID != tabUUID {
+			http.Error(w, "Upload belongs to another tab", http.StatusForbidden)
+			return
+		}
+		if status.Offset != status.Size {
+			http.Error(w, fmt.Sprintf("Upload of %s is incomplete: %d of %d bytes received", status.FileName, status.Offset, status.Size), http.StatusConflict)
+			return
+		}
+
+		_, partPath := chunkedUploadPaths(uploadID)
+		files = append(files, uploadedFile{name: status.FileName, size: status.Size, open: func() (multipart.File, error) {
+			return os.Open(partPath)
+		}})
+	}
+
+	if r.FormValue("async") != "" {
+		upload, ok := uploadRequest(w, r, tabUUID, files)
+		if !ok {
+			return
+		}
+		held := locks
+		locks = nil // Released by the job
+		startAnalysisJob(w, upload, func(err error) {
+			if err == nil {
+				for _, uploadID := range uploadIDs {
+					removeChunkedUpload(uploadID)
+				}
+			}
+			for _, lock := range held {
+				lock.Unlock()
+			}
+		})
+		return
+	}
+
+	if !analyzeUpload(w, r, tabUUID, files) {
+		return
+	}
+	for _, uploadID := range uploadIDs {
+		removeChunkedUpload(uploadID)
+	}
+	log.Println("Chunked upload completed successfully")
+}
+
+// chunkedUploadLock locks an upload, writing the error response if it cannot be locked
+func chunkedUploadLock(w http.ResponseWriter, uploadID string) (*sync.Mutex, bool) {
+	lock, err := lockChunkedUpload(uploadID)
+	switch {
+	case err == nil:
+		return lock, true
+	case errors.Is(err, errChunkedUploadBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "Unknown upload ID", http.StatusNotFound)
+	default:
+		log.Printf("Error opening chunked upload %s: %v\n", uploadID, err)
+		http.Error(w, "Error opening the upload", http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+// chunkedUploadStatus loads an upload, writing the error response if it cannot be loaded
+func chunkedUploadStatus(w http.ResponseWriter, uploadID string) (*ChunkedUploadStatus, bool) {
+	status, err := loadChunkedUpload(uploadID)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Unknown upload ID", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error reading chunked upload %s: %v\n", uploadID, err)
+		http.Error(w, "Error reading the upload", http.StatusInternalServerError)
+		return nil, false
+	}
+	return status, true
+}
+
+// writeChunkedUploadStatus writes the status of an upload as JSON
+func writeChunkedUploadStatus(w http.ResponseWriter, code int, status *ChunkedUploadStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error writing chunked upload status: %v\n", err)
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// startChunkedUpload starts a chunked upload of a file of the given size and returns its ID
+func startChunkedUpload(t *testing.T, tabUUID string, size int) string {
+	t.Helper()
+	form := url.Values{"uniqueID": {tabUUID}, "fileName": {"app.log"}, "size": {strconv.Itoa(size)}}
+	r := httptest.NewRequest(http.MethodPost, "/upload/chunked/init", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ChunkedUploadInitHandler(w, r)
+	status := decodeChunkedUploadStatus(t, w, http.StatusOK)
+	if !uploadIDPattern.MatchString(status.UploadID) || status.TabUUID != tabUUID || status.Size != int64(size) || status.Offset != 0 {
+		t.Fatalf("status of the started upload = %+v", status)
+	}
+	return status.UploadID
+}
+
+// putChunk sends a chunk of an upload starting at offset
+func putChunk(uploadID string, offset int, body io.Reader) *httptest.ResponseRecorder {
+	target := "/upload/chunked?uploadID=" + uploadID + "&offset=" + strconv.Itoa(offset)
+	w := httptest.NewRecorder()
+	ChunkedUploadHandler(w, httptest.NewRequest(http.MethodPut, target, body))
+	return w
+}
+
+// getChunkedUpload requests the status of an upload
+func getChunkedUpload(uploadID string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ChunkedUploadHandler(w, httptest.NewRequest(http.MethodGet, "/upload/chunked?uploadID="+uploadID, nil))
+	return w
+}
+
+// decodeChunkedUploadStatus checks the status code of a response and decodes its upload status
+func decodeChunkedUploadStatus(t *testing.T, w *httptest.ResponseRecorder, code int) ChunkedUploadStatus {
+	t.Helper()
+	var status ChunkedUploadStatus
+	if w.Code != code {
+		t.Fatalf("response %d %s, want %d", w.Code, w.Body.String(), code)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("response is not an upload status: %v\n%s", err, w.Body.String())
+	}
+	return status
+}
+
+// completeChunkedUploads analyzes uploads of a tab
+func completeChunkedUploads(tabUUID string, uploadIDs ...string) *httptest.ResponseRecorder {
+	form := url.Values{"uniqueID": {tabUUID}, "uploadID": uploadIDs}
+	r := httptest.NewRequest(http.MethodPost, "/upload/chunked/complete", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ChunkedUploadCompleteHandler(w, r)
+	return w
+}
+
+func TestChunkedUpload(t *testing.T) {
+	useTestServerDir(t)
+	tab := "3d8a6e9c-1f2b-4a0c-9d3e-5f6071829304"
+	t.Cleanup(func() { forgetTabStats(tab) })
+	log := testUploadLog(0, 30)
+	uploadID := startChunkedUpload(t, tab, len(log))
+
+	// A chunk that does not start where the received bytes end is rejected with the status
+	status := decodeChunkedUploadStatus(t, putChunk(uploadID, 10, strings.NewReader(log[10:20])), http.StatusConflict)
+	if status.Offset != 0 {
+		t.Errorf("offset after a chunk at the wrong offset = %d, want 0", status.Offset)
+	}
+
+	first := len(log) / 3
+	status = decodeChunkedUploadStatus(t, putChunk(uploadID, 0, strings.NewReader(log[:first])), http.StatusOK)
+	if status.Offset != int64(first) {
+		t.Errorf("offset after the first chunk = %d, want %d", status.Offset, first)
+	}
+
+	// A chunk sent while another request writes to the upload is rejected
+	lock, err := lockChunkedUpload(uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := putChunk(uploadID, first, strings.NewReader(log[first:])); w.Code != http.StatusConflict {
+		t.Errorf("chunk while the upload is locked: %d %s, want %d", w.Code, w.Body.String(), http.StatusConflict)
+	}
+	lock.Unlock()
+
+	// The received part of an interrupted chunk is kept and the upload resumes after it
+	interrupted := io.MultiReader(strings.NewReader(log[first:2*first]), iotest.ErrReader(errors.New("connection reset")))
+	if w := putChunk(uploadID, first, interrupted); w.Code != http.StatusInternalServerError {
+		t.Errorf("interrupted chunk: %d %s, want %d", w.Code, w.Body.String(), http.StatusInternalServerError)
+	}
+	status = decodeChunkedUploadStatus(t, getChunkedUpload(uploadID), http.StatusOK)
+	if status.Offset != int64(2*first) {
+		t.Fatalf("offset after the interrupted chunk = %d, want %d", status.Offset, 2*first)
+	}
+	if w := completeChunkedUploads(tab, uploadID); w.Code != http.StatusConflict {
+		t.Errorf("completing an incomplete upload: %d %s, want %d", w.Code, w.Body.String(), http.StatusConflict)
+	}
+	decodeChunkedUploadStatus(t, putChunk(uploadID, 2*first, strings.NewReader(log[2*first:])), http.StatusOK)
+
+	// Only the tab that started the upload can complete it
+	if w := completeChunkedUploads("4e9b7f0d-2a3c-4b1d-8e4f-60718293a415", uploadID); w.Code != http.StatusForbidden {
+		t.Errorf("completing the upload of another tab: %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := completeChunkedUploads(tab, uploadID); w.Code != http.StatusOK {
+		t.Fatalf("completing the upload: %d %s", w.Code, w.Body.String())
+	}
+	pathStats, _ := tabStats(tab)
+	if stats := pathStats["/api/orders"]; stats == nil || stats.Count != 30 {
+		t.Errorf("stats of /api/orders = %+v, want 30 responses", stats)
+	}
+	metaPath, partPath := chunkedUploadPaths(uploadID)
+	for _, path := range []string{metaPath, partPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s after completing the upload: %v, want it removed", path, err)
+		}
+	}
+	if w := getChunkedUpload(uploadID); w.Code != http.StatusNotFound {
+		t.Errorf("status of the completed upload: %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestChunkedUploadTooLarge(t *testing.T) {
+	useTestServerDir(t)
+	tab := "5f0c8a1e-3b4d-4c2e-9f50-718293a4b526"
+
+	// Chunks may not go past the size of the file
+	uploadID := startChunkedUpload(t, tab, 10)
+	if w := putChunk(uploadID, 0, strings.NewReader(strings.Repeat("x", 11))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk past the file size: %d %s, want %d", w.Code, w.Body.String(), http.StatusRequestEntityTooLarge)
+	}
+
+	// Nor be larger than maxChunkBytes
+	uploadID = startChunkedUpload(t, tab, 2*maxChunkBytes)
+	if w := putChunk(uploadID, 0, strings.NewReader(strings.Repeat("x", maxChunkBytes+1))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk of %d bytes: %d %s, want %d", maxChunkBytes+1, w.Code, w.Body.String(), http.StatusRequestEntityTooLarge)
+	}
+	if w := putChunk(strings.Repeat("0", 32), 0, strings.NewReader("x")); w.Code != http.StatusNotFound {
+		t.Errorf("chunk of an unknown upload: %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	form := url.Values{"uniqueID": {tab}, "fileName": {"app.log"}, "size": {strconv.Itoa(maxChunkedUploadBytes + 1)}}
+	r := httptest.NewRequest(http.MethodPost, "/upload/chunked/init", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ChunkedUploadInitHandler(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("starting an upload of %d bytes: %d, want %d", maxChunkedUploadBytes+1, w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -2,13 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
 	"html/template"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strconv"
 	"time"
 )
 
@@ -27,6 +23,7 @@ type LogData struct {
 	Timestamp               time.Time
 	TotalDurationForRequest float64
 	CallType                string
+	Kind                    CallKind
 	RequestQuery            string
 }
 
@@ -40,31 +37,26 @@ type QueryTimeDifference struct {
 
 // correlationDetailsHandler serves all details for a given correlation ID
 func CorrelationDetailsHandler(w http.ResponseWriter, r *http.Request) {
-	// Get 'correlationID' and 'tabUUID' from query parameters
+	// Get 'correlationID' from the query parameters and resolve the session of 'tabUUID'
 	correlationID := r.URL.Query().Get("correlationID")
-	tabUUID := r.URL.Query().Get("tabUUID")
-
-	if correlationID == "" || tabUUID == "" {
+	if correlationID == "" {
 		http.Error(w, "Correlation ID and Tab UUID are required", http.StatusBadRequest)
 		return
 	}
-
-	// Get the relevant JSON file
-	relevantFile, err := getRelevantJSONFile1("uploads/", tabUUID)
-	if err != nil {
-		http.Error(w, "Failed to find the relevant data file", http.StatusInternalServerError)
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
 		return
 	}
 
-	// Read request data from the JSON file
-	requestData, err := readRequestDataFromFile1(relevantFile)
+	// Load the entries of the correlation ID from the session store
+	requestData, err := sessionStore.ByCorrelationIDs(tabUUID, []string{correlationID})
 	if err != nil {
-		http.Error(w, "Failed to load data from file", http.StatusInternalServerError)
+		writeSessionError(w, err)
 		return
 	}
 
 	// Filter details excluding "HTTP-In-Request" and "HTTP-In-Response"
-	var matchingCorrelationDetails []FileDetail
+	var matchingCorrelationDetails []LogEvent
 	for _, details := range requestData {
 		if details.CorrelationId == correlationID {
 			matchingCorrelationDetails = append(matchingCorrelationDetails, details)
@@ -77,42 +69,26 @@ func CorrelationDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate query statistics for the correlation ID
-	queryStats, err := CalculateQueryStatsForCorrelationID(matchingCorrelationDetails, correlationID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to calculate query stats: %v", err), http.StatusInternalServerError)
-		return
-	}
+	// Calculate query statistics for the correlation ID, requests without internal calls have none
+	queryStats := CalculateQueryStatsForCorrelationID(matchingCorrelationDetails, correlationID)
 
 	// Calculate total duration
-	totalDuration, totalExecutionTime, durationDifference, err := CalculateTotalDuration(correlationID, requestData, queryStats)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error calculating times: %v", err), http.StatusInternalServerError)
-		return
-	}
+	totalDuration, totalExecutionTime, durationDifference := CalculateTotalDuration(correlationID, requestData, queryStats)
 
-	// Create an array of LogData by parsing the Timestamp string into time.Time
+	// Create an array of LogData from the values typed at ingest
 	var logs []LogData
 	for _, detail := range matchingCorrelationDetails {
-		// Parse Timestamp string into time.Time
-		timestamp, err := time.Parse("2006-01-02 15:04:05,000", detail.Timestamp)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to parse timestamp: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		// Convert TotalDurationForRequest from string to float64
-		duration, err := strconv.ParseFloat(detail.TotalDurationForRequest, 64)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to parse duration: %v", err), http.StatusInternalServerError)
-			return
+		if detail.Time.IsZero() {
+			log.Printf("Skipping entry with invalid timestamp in timeline: %s", detail.Timestamp)
+			continue
 		}
 
 		// Append parsed LogData
 		logs = append(logs, LogData{
-			Timestamp:               timestamp,
-			TotalDurationForRequest: duration,
+			Timestamp:               detail.Time,
+			TotalDurationForRequest: detail.DurationMillis,
 			CallType:                detail.CallType,
+			Kind:                    detail.Kind,
 			RequestQuery:            detail.RequestQuery,
 		})
 	}
@@ -144,7 +120,7 @@ func CorrelationDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	// Render the template with correlation details, query stats, total duration, and time differences
 	w.Header().Set("Content-Type", "text/html")
 	tmpl.Execute(w, struct {
-		CorrelationDetails []FileDetail
+		CorrelationDetails []LogEvent
 		QueryStats         map[string]CorrelationQueryStats
 		TotalDuration      float64
 		TotalExecutionTime float64
@@ -196,7 +172,7 @@ func calculateTimeDifferencesWithDetails(logs []LogData) []QueryTimeDifference {
 			var finalDiff float64
 			var adjustedTimestamp time.Time
 
-			if logs[i+1].CallType == "HTTP-In-Response" {
+			if logs[i+1].Kind == CallHTTPResponse {
 				finalDiff = float64(timeDiff)
 				query = logs[i+1].RequestQuery // Use the actual query for "HTTP-In-Response"
 
@@ -227,56 +203,18 @@ func calculateTimeDifferencesWithDetails(logs []LogData) []QueryTimeDifference {
 	return results
 }
 
-func getRelevantJSONFile1(directory, tabUUID string) (string, error) {
-	files, err := os.ReadDir(directory)
-	if err != nil {
-		return "", err
-	}
-
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-		if filepath.Ext(file.Name()) == ".json" && filepath.Base(file.Name()) == tabUUID+".json" {
-			return filepath.Join(directory, file.Name()), nil
-		}
-	}
-
-	return "", os.ErrNotExist
-}
-
-func readRequestDataFromFile1(filename string) ([]FileDetail, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var requestData []FileDetail
-	err = json.NewDecoder(file).Decode(&requestData)
-	if err != nil {
-		return nil, err
-	}
-
-	return requestData, nil
-}
-
-// CalculateQueryStatsForCorrelationID calculates request query statistics for a given correlation ID
-func CalculateQueryStatsForCorrelationID(requestData []FileDetail, correlationID string) (map[string]CorrelationQueryStats, error) {
+// CalculateQueryStatsForCorrelationID calculates request query statistics for a given correlation ID.
+// Entries without a valid duration are skipped.
+func CalculateQueryStatsForCorrelationID(requestData []LogEvent, correlationID string) map[string]CorrelationQueryStats {
 	// Create a map to store query statistics
 	queryStats := make(map[string]CorrelationQueryStats)
 
 	// Iterate through request data to find matching correlation ID
 	for _, details := range requestData {
-		// Skip entries with CallType "HTTP-In-Request" or "HTTP-In-Response"
-		if details.CorrelationId == correlationID && details.CallType != "HTTP-In-Request" && details.CallType != "HTTP-In-Response" {
+		// Skip HTTP request and response entries by the kind typed at ingest
+		if details.CorrelationId == correlationID && !details.IsHTTP() && details.HasDuration {
 			query := details.RequestQuery
-
-			// Convert total duration to float
-			duration, err := strconv.ParseFloat(details.TotalDurationForRequest, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse duration: %w", err)
-			}
+			duration := details.DurationMillis
 
 			// Update or initialize statistics
 			stat, exists := queryStats[query]
@@ -310,25 +248,17 @@ func CalculateQueryStatsForCorrelationID(requestData []FileDetail, correlationID
 		}
 	}
 
-	if len(queryStats) == 0 {
-		return nil, fmt.Errorf("no queries found for correlation ID: %s", correlationID)
-	}
-
-	return queryStats, nil
+	return queryStats
 }
 
 // CalculateTotalDuration computes the total time based on the call type
-func CalculateTotalDuration(correlationID string, requestData []FileDetail, queryStats map[string]CorrelationQueryStats) (float64, float64, float64, error) {
+func CalculateTotalDuration(correlationID string, requestData []LogEvent, queryStats map[string]CorrelationQueryStats) (float64, float64, float64) {
 	var totalDuration float64
 	var totalExecutionTime float64
 
 	for _, details := range requestData {
-		if details.CorrelationId == correlationID && details.CallType == "HTTP-In-Response" {
-			duration, err := strconv.ParseFloat(details.TotalDurationForRequest, 64)
-			if err != nil {
-				return 0, 0, 0, fmt.Errorf("failed to parse duration for correlation ID %s: %w", details.CorrelationId, err)
-			}
-			totalDuration += duration
+		if details.CorrelationId == correlationID && details.Kind == CallHTTPResponse && details.HasDuration {
+			totalDuration += details.DurationMillis
 		}
 	}
 
@@ -341,5 +271,5 @@ func CalculateTotalDuration(correlationID string, requestData []FileDetail, quer
 	durationDifference := totalDuration - totalExecutionTime
 
 	// Return both totalDuration and totalExecutionTime
-	return totalDuration, totalExecutionTime, durationDifference, nil
+	return totalDuration, totalExecutionTime, durationDifference
 }
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalculateTimeDifferencesWithDetails(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	logs := []LogData{
+		{Timestamp: start, CallType: "HTTP-In-Request", Kind: CallHTTPRequest},
+		{Timestamp: start.Add(30 * time.Millisecond), TotalDurationForRequest: 20, CallType: "DB", Kind: CallInternal, RequestQuery: "select 1"},
+		// Call types are matched regardless of case at ingest
+		{Timestamp: start.Add(50 * time.Millisecond), TotalDurationForRequest: 50, CallType: "http-in-response", Kind: CallHTTPResponse},
+	}
+
+	got := calculateTimeDifferencesWithDetails(logs)
+	want := []QueryTimeDifference{
+		{Timestamp: start, CallType: "HTTP-In-Request"},
+		{Query: "Idle", Duration: 10, Timestamp: start.Add(10 * time.Millisecond), CallType: "DB"},
+		{Query: "select 1", Duration: 20, Timestamp: start.Add(30 * time.Millisecond), CallType: "DB"},
+		{Duration: 20, Timestamp: start.Add(50 * time.Millisecond), CallType: "http-in-response"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("time differences = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("time difference %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Reasons recorded for rejected or partially parsed lines
+const (
+	reasonNoFormat              = "line matches no log format"
+	reasonInvalidTimestamp      = "invalid timestamp"
+	reasonInvalidDuration       = "invalid duration"
+	reasonContinuationTruncated = "continuation truncated"
+	reasonLineTooLong           = "line too long, skipped"
+)
+
+// maxDiagnosticSamples is how many diagnostics are kept in memory for the upload result page.
+// The downloadable report always contains every diagnostic.
+const maxDiagnosticSamples = 100
+
+// lineRef identifies the line an entry was parsed from
+type lineRef struct {
+	source string
+	number int
+	raw    string
+}
+
+// LineDiagnostic describes a single line that was rejected or only partially parsed
+type LineDiagnostic struct {
+	Source string
+	Line   int
+	Raw    string
+	Reason string
+}
+
+// ReasonCount is the number of diagnostics recorded for one reason
+type ReasonCount struct {
+	Reason string
+	Count  int
+}
+
+// parseDiagnostics collects the diagnostics of one upload. Every diagnostic is written to a
+// CSV report next to the session file, while only a sample is kept for the result page.
+type parseDiagnostics struct {
+	Total   int
+	Samples []LineDiagnostic
+
+	reasons          map[string]int
+	fileName         string
+	appendToPrevious bool // The diagnostics are added to the end of the session's report instead of replacing it
+	tmp              *os.File
+	report           *csv.Writer
+}
+
+// newParseDiagnostics starts a diagnostics report for tabUUID. With keepPrevious the lines of the
+// session's previous report are kept and the new diagnostics are appended to it on commit.
+func newParseDiagnostics(tabUUID string, keepPrevious bool) (*parseDiagnostics, error) {
+	d := &parseDiagnostics{reasons: map[string]int{}, fileName: diagnosticsFileName(tabUUID)}
+	if keepPrevious {
+		_, err := os.Stat(d.fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error opening diagnostics report: %w", err)
+		}
+		d.appendToPrevious = err == nil
+	}
+
+	tmp, err := os.CreateTemp("uploads", tabUUID+"-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating diagnostics report: %w", err)
+	}
+	d.tmp = tmp
+	d.report = csv.NewWriter(tmp)
+	if !d.appendToPrevious {
+		d.report.Write([]string{"file", "line", "reason", "text"})
+	}
+	return d, nil
+}
+
+// newPartialDiagnostics starts a report for a single file parsed concurrently with others, which is
+// added to the upload's report with join
+func newPartialDiagnostics() (*parseDiagnostics, error) {
+	tmp, err := os.CreateTemp("uploads", "diagnostics-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating diagnostics report: %w", err)
+	}
+	return &parseDiagnostics{reasons: map[string]int{}, tmp: tmp, report: csv.NewWriter(tmp)}, nil
+}
+
+// join appends the diagnostics of a partial report and discards it
+func (d *parseDiagnostics) join(part *parseDiagnostics) error {
+	if d == nil || part == nil {
+		return nil
+	}
+	defer part.abort()
+
+	d.Total += part.Total
+	for reason, count := range part.reasons {
+		d.reasons[reason] += count
+	}
+	for _, sample := range part.Samples {
+		if len(d.Samples) < maxDiagnosticSamples {
+			d.Samples = append(d.Samples, sample)
+		}
+	}
+
+	part.report.Flush()
+	d.report.Flush()
+	if err := errors.Join(part.report.Error(), d.report.Error()); err != nil {
+		return fmt.Errorf("error writing diagnostics report: %w", err)
+	}
+	if _, err := part.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(d.tmp, part.tmp); err != nil {
+		return fmt.Errorf("error copying diagnostics report: %w", err)
+	}
+	return nil
+}
+
+// diagnosticsFileName returns the path of the diagnostics report of a session
+func diagnosticsFileName(tabUUID string) string {
+	return fmt.Sprintf("uploads/%s.diagnostics.csv", tabUUID)
+}
+
+// record adds a diagnostic for the given line
+func (d *parseDiagnostics) record(at lineRef, reason string) {
+	if d == nil {
+		return
+	}
+	d.Total++
+	d.reasons[reason]++
+	if len(d.Samples) < maxDiagnosticSamples {
+		d.Samples = append(d.Samples, LineDiagnostic{Source: at.source, Line: at.number, Raw: at.raw, Reason: reason})
+	}
+	d.report.Write([]string{at.source, strconv.Itoa(at.number), reason, at.raw})
+}
+
+// Reasons returns the number of diagnostics per reason, most frequent first
+func (d *parseDiagnostics) Reasons() []ReasonCount {
+	var counts []ReasonCount
+	for reason, count := range d.reasons {
+		counts = append(counts, ReasonCount{Reason: reason, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Reason < counts[j].Reason
+	})
+	return counts
+}
+
+// commit replaces the session's previous diagnostics report with this one, or appends to it
+func (d *parseDiagnostics) commit() error {
+	d.report.Flush()
+	if err := d.report.Error(); err != nil {
+		d.abort()
+		return fmt.Errorf("error writing diagnostics report: %w", err)
+	}
+	if d.appendToPrevious {
+		defer d.abort()
+		return d.appendReport()
+	}
+	if err := d.tmp.Close(); err != nil {
+		os.Remove(d.tmp.Name())
+		return fmt.Errorf("error closing diagnostics report: %w", err)
+	}
+	if err := os.Rename(d.tmp.Name(), d.fileName); err != nil {
+		os.Remove(d.tmp.Name())
+		return fmt.Errorf("error saving diagnostics report: %w", err)
+	}
+	return nil
+}
+
+// appendReport adds the new diagnostics to the end of the session's report. A report that cannot
+// be completely written is cut back to its previous length.
+func (d *parseDiagnostics) appendReport() error {
+	if _, err := d.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	previous, err := os.OpenFile(d.fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening diagnostics report: %w", err)
+	}
+	info, err := previous.Stat()
+	if err != nil {
+		previous.Close()
+		return fmt.Errorf("error opening diagnostics report: %w", err)
+	}
+	if _, err := io.Copy(previous, d.tmp); err != nil {
+		previous.Truncate(info.Size())
+		previous.Close()
+		return fmt.Errorf("error saving diagnostics report: %w", err)
+	}
+	if err := previous.Close(); err != nil {
+		return fmt.Errorf("error saving diagnostics report: %w", err)
+	}
+	return nil
+}
+
+// abort discards the report
+func (d *parseDiagnostics) abort() {
+	d.tmp.Close()
+	os.Remove(d.tmp.Name())
+}
+
+// DiagnosticsHandler serves the diagnostics report of the last upload of a tab as a CSV download
+func DiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	tabUUID := r.URL.Query().Get("tabUUID")
+	if err := validateSessionID(tabUUID); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	file, err := os.Open(diagnosticsFileName(tabUUID))
+	if os.IsNotExist(err) {
+		http.Error(w, "No diagnostics report found for this tab", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to open the diagnostics report", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to open the diagnostics report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="parse-diagnostics.csv"`)
+	http.ServeContent(w, r, "parse-diagnostics.csv", info.ModTime(), file)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"math"
+	"slices"
+)
+
+// durationSketchGrowth is the ratio between the upper bounds of neighbouring buckets of a
+// durationSketch. A duration estimated from its bucket is off by less than 1%.
+const durationSketchGrowth = 1.02
+
+// Durations outside these bounds, in milliseconds, are counted in the first or last bucket, so a
+// sketch never has more than about 1400 buckets
+const (
+	minSketchedDuration = 0.001
+	maxSketchedDuration = 1e9
+)
+
+// durationSketch estimates percentiles of durations in bounded memory. Durations are counted in
+// buckets whose bounds grow by durationSketchGrowth, so the sketch stays the same size however
+// many durations are added, and the sketches of several uploads merge without losing accuracy.
+// Count, sum, minimum and maximum are kept exactly.
+type durationSketch struct {
+	buckets []int // Durations per bucket, starting with the bucket of index offset
+	offset  int
+	zeros   int // Durations of 0 ms or less, which have no bucket
+	count   int
+	sum     float64
+	min     float64
+	max     float64
+}
+
+// sketchBucket returns the index of the bucket a duration is counted in
+func sketchBucket(duration float64) int {
+	duration = min(max(duration, minSketchedDuration), maxSketchedDuration)
+	return int(math.Ceil(math.Log(duration) / math.Log(durationSketchGrowth)))
+}
+
+// add counts a single duration
+func (s *durationSketch) add(duration float64) {
+	if s.count == 0 || duration < s.min {
+		s.min = duration
+	}
+	if s.count == 0 || duration > s.max {
+		s.max = duration
+	}
+	s.count++
+	s.sum += duration
+	if duration <= 0 {
+		s.zeros++
+		return
+	}
+	s.addToBucket(sketchBucket(duration), 1)
+}
+
+// merge adds the durations counted by other
+func (s *durationSketch) merge(other durationSketch) {
+	if other.count == 0 {
+		return
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	s.zeros += other.zeros
+	for i, n := range other.buckets {
+		if n > 0 {
+			s.addToBucket(other.offset+i, n)
+		}
+	}
+}
+
+// addToBucket adds n durations to the bucket of the given index, growing the buckets to include it
+func (s *durationSketch) addToBucket(index, n int) {
+	switch {
+	case len(s.buckets) == 0:
+		s.offset = index
+		s.buckets = []int{0}
+	case index < s.offset:
+		s.buckets = append(make([]int, s.offset-index), s.buckets...)
+		s.offset = index
+	case index >= s.offset+len(s.buckets):
+		s.buckets = append(s.buckets, make([]int, index-s.offset-len(s.buckets)+1)...)
+	}
+	s.buckets[index-s.offset] += n
+}
+
+// valueAt estimates the duration at rank in the sorted durations, 0 being the shortest. The
+// estimate lies in the middle of its bucket, but never outside the shortest and longest duration.
+func (s *durationSketch) valueAt(rank int) float64 {
+	if rank < s.zeros {
+		return min(0, s.max)
+	}
+	rank -= s.zeros
+	for i, n := range s.buckets {
+		if rank < n {
+			estimate := 2 * math.Pow(durationSketchGrowth, float64(s.offset+i)) / (durationSketchGrowth + 1)
+			return min(max(estimate, s.min), s.max)
+		}
+		rank -= n
+	}
+	return s.max
+}
+
+// percentile estimates the duration below which the fraction p of the durations lie
+func (s *durationSketch) percentile(p float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.valueAt(int(p * float64(s.count-1)))
+}
+
+// mean returns the average duration
+func (s *durationSketch) mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.count)
+}
+
+// clone returns a copy that does not share its buckets with s
+func (s *durationSketch) clone() durationSketch {
+	c := *s
+	c.buckets = slices.Clone(s.buckets)
+	return c
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestDurationSketchPercentiles(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name     string
+		duration func() float64
+	}{
+		{"uniform", func() float64 { return random.Float64() * 1000 }},
+		{"long tail", func() float64 { return math.Exp(random.NormFloat64()*2 + 3) }},
+		{"whole milliseconds", func() float64 { return float64(random.Intn(50)) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sketch durationSketch
+			var durations []float64
+			for i := 0; i < 100000; i++ {
+				d := test.duration()
+				sketch.add(d)
+				durations = append(durations, d)
+			}
+			sort.Float64s(durations)
+
+			for _, p := range []float64{0, 0.5, 0.95, 0.99, 1} {
+				want := durations[int(p*float64(len(durations)-1))]
+				got := sketch.percentile(p)
+				if math.Abs(got-want) > want*0.01+minSketchedDuration {
+					t.Errorf("percentile(%g) = %g, want %g within 1%%", p, got, want)
+				}
+			}
+			if sketch.count != len(durations) || sketch.min != durations[0] || sketch.max != durations[len(durations)-1] {
+				t.Errorf("count, min, max = %d, %g, %g, want %d, %g, %g", sketch.count, sketch.min, sketch.max, len(durations), durations[0], durations[len(durations)-1])
+			}
+			if len(sketch.buckets) > 1400 {
+				t.Errorf("%d buckets", len(sketch.buckets))
+			}
+		})
+	}
+}
+
+func TestDurationSketchMerge(t *testing.T) {
+	var all, fast, slow durationSketch
+	for i := 1; i <= 1000; i++ {
+		all.add(float64(i))
+		if i <= 500 {
+			fast.add(float64(i))
+		} else {
+			slow.add(float64(i))
+		}
+	}
+
+	// Merging in either order, or into an empty sketch, counts the same durations as adding them all
+	merged := slow.clone()
+	merged.merge(fast)
+	var fromEmpty durationSketch
+	fromEmpty.merge(fast)
+	fromEmpty.merge(slow)
+	for _, sketch := range []durationSketch{merged, fromEmpty} {
+		if sketch.count != all.count || sketch.sum != all.sum || sketch.min != all.min || sketch.max != all.max {
+			t.Errorf("merged sketch = %d, %g, %g, %g, want %d, %g, %g, %g", sketch.count, sketch.sum, sketch.min, sketch.max, all.count, all.sum, all.min, all.max)
+		}
+		for _, p := range []float64{0, 0.5, 0.95, 1} {
+			if sketch.percentile(p) != all.percentile(p) {
+				t.Errorf("merged percentile(%g) = %g, want %g", p, sketch.percentile(p), all.percentile(p))
+			}
+		}
+	}
+
+	// The clone merged into does not change the original
+	if slow.count != 500 || slow.min != 501 {
+		t.Errorf("original after merging into its clone = %d durations from %g", slow.count, slow.min)
+	}
+}
+
+func TestDurationSketchSingleValues(t *testing.T) {
+	tests := []struct {
+		durations []float64
+		want      float64
+	}{
+		{nil, 0},
+		{[]float64{0}, 0},
+		{[]float64{12}, 12},
+		{[]float64{12, 12, 12}, 12},
+		{[]float64{-5, 0}, 0},
+		{[]float64{2e9}, 2e9},
+	}
+	for _, test := range tests {
+		var sketch durationSketch
+		for _, d := range test.durations {
+			sketch.add(d)
+		}
+		if got := sketch.percentile(0.95); got != test.want {
+			t.Errorf("percentile(0.95) of %v = %g, want %g", test.durations, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// textEncoding decodes the characters of a log file that is not written in UTF-8
+type textEncoding struct {
+	name string
+	next func(src *bufio.Reader) (rune, error) // Reads a single character, nil for UTF-8
+}
+
+// Byte order marks that select the encoding of a file regardless of the selected one
+var (
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+	utf16LEBOM = []byte{0xff, 0xfe}
+	utf16BEBOM = []byte{0xfe, 0xff}
+)
+
+var (
+	utf8Encoding    = &textEncoding{name: "UTF-8"}
+	utf16LEEncoding = &textEncoding{name: "UTF-16LE", next: func(src *bufio.Reader) (rune, error) { return nextUTF16(src, false) }}
+	utf16BEEncoding = &textEncoding{name: "UTF-16BE", next: func(src *bufio.Reader) (rune, error) { return nextUTF16(src, true) }}
+)
+
+// textEncodings lists the encodings that can be selected for an upload by their lower case name
+var textEncodings = map[string]*textEncoding{
+	"utf-8":        utf8Encoding,
+	"utf-16le":     utf16LEEncoding,
+	"utf-16be":     utf16BEEncoding,
+	"windows-1252": {name: "Windows-1252", next: nextWindows1252},
+	"iso-8859-1":   {name: "ISO-8859-1", next: nextLatin1},
+}
+
+// TextEncodingNames returns the names of the encodings that can be selected for an upload
+func TextEncodingNames() []string {
+	var names []string
+	for _, encoding := range textEncodings {
+		names = append(names, encoding.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findTextEncoding looks up an encoding by name, ignoring case. An empty name selects UTF-8.
+func findTextEncoding(name string) (*textEncoding, error) {
+	if name == "" {
+		return utf8Encoding, nil
+	}
+	encoding, ok := textEncodings[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding: %s", name)
+	}
+	return encoding, nil
+}
+
+// decodeText returns a reader that converts file to UTF-8. A byte order mark at the start of the
+// file takes precedence over encoding and is removed.
+func decodeText(file io.Reader, encoding *textEncoding) io.Reader {
+	src := bufio.NewReaderSize(file, 64*1024)
+	start, _ := src.Peek(len(utf8BOM))
+	switch {
+	case bytes.HasPrefix(start, utf8BOM):
+		src.Discard(len(utf8BOM))
+		encoding = utf8Encoding
+	case bytes.HasPrefix(start, utf16LEBOM):
+		src.Discard(len(utf16LEBOM))
+		encoding = utf16LEEncoding
+	case bytes.HasPrefix(start, utf16BEBOM):
+		src.Discard(len(utf16BEBOM))
+		encoding = utf16BEEncoding
+	}
+	if encoding == nil || encoding.next == nil {
+		return src
+	}
+	return &decodingReader{src: src, next: encoding.next}
+}
+
+// decodingReader converts the characters read by next into UTF-8
+type decodingReader struct {
+	src     *bufio.Reader
+	next    func(src *bufio.Reader) (rune, error)
+	pending []byte // Encoded bytes of a character that did not fit into the last read
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	var encoded [utf8.UTFMax]byte
+	for n < len(p) {
+		r, err := d.next(d.src)
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		size := utf8.EncodeRune(encoded[:], r)
+		copied := copy(p[n:], encoded[:size])
+		d.pending = append(d.pending, encoded[copied:size]...)
+		n += copied
+	}
+	return n, nil
+}
+
+// nextUTF16 reads a character of UTF-16 text, combining surrogate pairs. Unpaired surrogates and a
+// trailing odd byte are read as the replacement character.
+func nextUTF16(src *bufio.Reader, bigEndian bool) (rune, error) {
+	unit, err := readUTF16Unit(src, bigEndian)
+	if err != nil {
+		return 0, err
+	}
+	if !utf16.IsSurrogate(rune(unit)) {
+		return rune(unit), nil
+	}
+
+	// A high surrogate is followed by the low one, anything else is left for the next call
+	next, err := src.Peek(2)
+	if err != nil || unit >= 0xdc00 {
+		return utf8.RuneError, nil
+	}
+	low := uint16(next[0]) | uint16(next[1])<<8
+	if bigEndian {
+		low = uint16(next[0])<<8 | uint16(next[1])
+	}
+	r := utf16.DecodeRune(rune(unit), rune(low))
+	if r != utf8.RuneError {
+		src.Discard(2)
+	}
+	return r, nil
+}
+
+// readUTF16Unit reads a single 16 bit code unit
+func readUTF16Unit(src *bufio.Reader, bigEndian bool) (uint16, error) {
+	var unit [2]byte
+	n, err := io.ReadFull(src, unit[:])
+	if err == io.ErrUnexpectedEOF && n == 1 {
+		return utf8.RuneError, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if bigEndian {
+		return uint16(unit[0])<<8 | uint16(unit[1]), nil
+	}
+	return uint16(unit[0]) | uint16(unit[1])<<8, nil
+}
+
+// nextLatin1 reads a character of ISO-8859-1 text, whose bytes are the first 256 code points
+func nextLatin1(src *bufio.Reader) (rune, error) {
+	b, err := src.ReadByte()
+	return rune(b), err
+}
+
+// windows1252 holds the characters of bytes 0x80 to 0x9f, which differ from ISO-8859-1.
+// Unassigned bytes are kept as the control characters of the same value.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+// nextWindows1252 reads a character of Windows-1252 text
+func nextWindows1252(src *bufio.Reader) (rune, error) {
+	b, err := src.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b >= 0x80 && b < 0xa0 {
+		return windows1252[b-0x80], nil
+	}
+	return rune(b), nil
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf16"
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		in       []byte
+		want     string
+	}{
+		{name: "UTF-8", encoding: "", in: []byte("größe €"), want: "größe €"},
+		{name: "UTF-16LE", encoding: "utf-16le", in: []byte{'a', 0, 0xe4, 0, 0xac, 0x20}, want: "aä€"},
+		{name: "UTF-16BE", encoding: "UTF-16BE", in: []byte{0, 'a', 0, 0xe4, 0x20, 0xac}, want: "aä€"},
+		{name: "UTF-16LE surrogate pair", encoding: "utf-16le", in: []byte{'a', 0, 0x3d, 0xd8, 0x00, 0xde, 'b', 0}, want: "a😀b"},
+		{name: "UTF-16BE surrogate pair", encoding: "utf-16be", in: []byte{0, 'a', 0xd8, 0x3d, 0xde, 0x00, 0, 'b'}, want: "a😀b"},
+		{name: "UTF-16LE unpaired high surrogate", encoding: "utf-16le", in: []byte{0x3d, 0xd8, 'b', 0}, want: "�b"},
+		{name: "UTF-16LE unpaired low surrogate", encoding: "utf-16le", in: []byte{0x00, 0xde, 'b', 0}, want: "�b"},
+		{name: "UTF-16LE high surrogate at the end", encoding: "utf-16le", in: []byte{'a', 0, 0x3d, 0xd8}, want: "a�"},
+		{name: "UTF-16LE odd trailing byte", encoding: "utf-16le", in: []byte{'a', 0, 'b'}, want: "a�"},
+		{name: "UTF-16BE odd trailing byte", encoding: "utf-16be", in: []byte{0, 'a', 0}, want: "a�"},
+		{name: "UTF-8 BOM", encoding: "", in: []byte("\xef\xbb\xbfabc"), want: "abc"},
+		{name: "UTF-8 BOM over UTF-16LE", encoding: "utf-16le", in: []byte("\xef\xbb\xbfab"), want: "ab"},
+		{name: "UTF-16LE BOM over UTF-8", encoding: "", in: []byte{0xff, 0xfe, 'a', 0, 'b', 0}, want: "ab"},
+		{name: "UTF-16BE BOM over Windows-1252", encoding: "windows-1252", in: []byte{0xfe, 0xff, 0, 'a', 0x20, 0xac}, want: "a€"},
+		{name: "UTF-16LE BOM over UTF-16BE", encoding: "utf-16be", in: []byte{0xff, 0xfe, 'a', 0}, want: "a"},
+		{name: "Windows-1252", encoding: "windows-1252", in: []byte{'a', 0x80, 0x85, 0x8a, 0x93, 0x94, 0x99, 0x9f, 0xe9}, want: "a€…Š“”™Ÿé"},
+		{name: "Windows-1252 unassigned bytes", encoding: "windows-1252", in: []byte{0x81, 0x8d, 0x8f, 0x90, 0x9d}, want: "\u0081\u008d\u008f\u0090\u009d"},
+		{name: "ISO-8859-1", encoding: "iso-8859-1", in: []byte{'a', 0x80, 0xa3, 0xe9, 0xff}, want: "a\u0080£éÿ"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoding, err := findTextEncoding(test.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(decodeText(bytes.NewReader(test.in), encoding))
+			if err != nil || string(got) != test.want {
+				t.Errorf("decoded % x = %q, %v, want %q", test.in, got, err, test.want)
+			}
+
+			// Characters that do not fit into a read are returned by the next ones
+			got, err = io.ReadAll(iotest.OneByteReader(decodeText(bytes.NewReader(test.in), encoding)))
+			if err != nil || string(got) != test.want {
+				t.Errorf("decoded % x a byte at a time = %q, %v, want %q", test.in, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestWindows1252Table(t *testing.T) {
+	// Bytes 0x80 to 0x9f as listed by the code page, unassigned ones as their control characters
+	in := make([]byte, 0x20)
+	for i := range in {
+		in[i] = byte(0x80 + i)
+	}
+	want := "€\u0081‚ƒ„…†‡ˆ‰Š‹Œ\u008dŽ\u008f\u0090‘’“”•–—˜™š›œ\u009džŸ"
+	got, err := io.ReadAll(decodeText(bytes.NewReader(in), textEncodings["windows-1252"]))
+	if err != nil || string(got) != want {
+		t.Errorf("decoded bytes 0x80 to 0x9f = %q, %v, want %q", got, err, want)
+	}
+
+	// All other bytes are the code points of the same value
+	for _, b := range []byte{0x00, 0x0a, 0x41, 0x7f, 0xa0, 0xc4, 0xff} {
+		got, err := io.ReadAll(decodeText(bytes.NewReader([]byte{b}), textEncodings["windows-1252"]))
+		if err != nil || string(got) != string(rune(b)) {
+			t.Errorf("decoded byte %#x = %q, %v, want %q", b, got, err, string(rune(b)))
+		}
+	}
+}
+
+func TestFindTextEncoding(t *testing.T) {
+	for name, want := range map[string]string{"": "UTF-8", "utf-8": "UTF-8", "Windows-1252": "Windows-1252", "ISO-8859-1": "ISO-8859-1"} {
+		if encoding, err := findTextEncoding(name); err != nil || encoding.name != want {
+			t.Errorf("findTextEncoding(%q) = %v, %v, want %s", name, encoding, err, want)
+		}
+	}
+	if encoding, err := findTextEncoding("ebcdic"); err == nil {
+		t.Errorf("findTextEncoding(ebcdic) = %v, want an error", encoding)
+	}
+}
+
+func TestUploadEncoding(t *testing.T) {
+	useTestServerDir(t)
+	const log = "2024-05-01 10:00:00,000|c1|t1|5|DB|2024-05-01 10:00:00,000|query|SELECT 'café €'|/api/a\n"
+	utf16LE := []byte{0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune(log)) {
+		utf16LE = append(utf16LE, byte(unit), byte(unit>>8))
+	}
+	windows1252 := strings.NewReplacer("é", "\xe9", "€", "\x80").Replace(log)
+	tests := []struct {
+		name     string
+		tab      string
+		encoding string
+		content  string
+	}{
+		{"UTF-16LE with a byte order mark", "0a5d3b6f-8c9e-4d7f-8a0b-2c3d4e5f6071", "windows-1252", string(utf16LE)},
+		{"UTF-8 with a byte order mark", "1b6e4c7a-9d0f-4e8a-9b1c-3d4e5f607182", "utf-16be", "\xef\xbb\xbf" + log},
+		{"Windows-1252 selected in the form", "2c7f5d8b-0e1a-4f9b-8c2d-4e5f60718293", "windows-1252", windows1252},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() { forgetTabStats(test.tab) })
+			w := postUploadForm(test.tab, "app.log", test.content, map[string]string{"encoding": test.encoding})
+			if w.Code != http.StatusOK {
+				t.Fatalf("upload: %d %s", w.Code, w.Body.String())
+			}
+			if _, queryMetrics := tabStats(test.tab); queryMetrics["SELECT 'café €'"] == nil {
+				t.Errorf("queries = %v, want the query decoded to UTF-8", queryMetrics)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// FilterRule decides whether log entries are analysed. Suffix, prefix and regex rules match
+// the request path, callType rules match the call type regardless of case.
+type FilterRule struct {
+	Action string `json:"action"` // "exclude" or "include"
+	Match  string `json:"match"`  // "suffix", "prefix", "regex" or "callType"
+	Value  string `json:"value"`
+
+	regex *regexp.Regexp
+}
+
+// filterRuleConfig is the layout of the filter rule config file
+type filterRuleConfig struct {
+	Rules []*FilterRule `json:"rules"`
+}
+
+// RuleExclusion is the number of entries a rule excluded during an upload
+type RuleExclusion struct {
+	Rule  string
+	Count int
+}
+
+// filterRules holds the configured rules. The first rule that matches an entry decides whether it
+// is analysed; entries that match no rule are included.
+var filterRules = defaultFilterRules()
+
+// defaultFilterRules excludes static assets, which are used when no config file is present
+func defaultFilterRules() []*FilterRule {
+	var rules []*FilterRule
+	for _, ext := range []string{".js", ".js(1)", ".ttf", ".css", ".gif", ".ico", ".png", ".jsf", ".woff", ".woff2", ".jpg", ".map"} {
+		rules = append(rules, &FilterRule{Action: "exclude", Match: "suffix", Value: ext})
+	}
+	return rules
+}
+
+// LoadFilterRules replaces the configured rules with the ones defined in the given JSON config file
+func LoadFilterRules(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var config filterRuleConfig
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return fmt.Errorf("error decoding filter rules from %s: %w", fileName, err)
+	}
+	for _, rule := range config.Rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("invalid filter rule in %s: %w", fileName, err)
+		}
+	}
+
+	filterRules = config.Rules
+	return nil
+}
+
+// parseFilterRules reads rules written one per line as "<action> <match> <value>",
+// e.g. "exclude prefix /actuator/health". Blank lines and lines starting with # are ignored.
+func parseFilterRules(text string) ([]*FilterRule, error) {
+	var rules []*FilterRule
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("line %d: expected \"<action> <match> <value>\"", i+1)
+		}
+
+		// The value is everything after the match type, so regexes may contain spaces
+		rest := strings.TrimSpace(line[len(parts[0]):])
+		value := strings.TrimSpace(rest[len(parts[1]):])
+		rule := &FilterRule{Action: parts[0], Match: parts[1], Value: value}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// formatFilterRules writes rules in the format read by parseFilterRules
+func formatFilterRules(rules []*FilterRule) string {
+	var lines []string
+	for _, rule := range rules {
+		lines = append(lines, rule.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// String returns the rule as "<action> <match> <value>"
+func (r *FilterRule) String() string {
+	return r.Action + " " + r.Match + " " + r.Value
+}
+
+// compile validates the rule and prepares its regular expression
+func (r *FilterRule) compile() error {
+	if r.Action != "exclude" && r.Action != "include" {
+		return fmt.Errorf("unknown action %q, expected exclude or include", r.Action)
+	}
+	if r.Value == "" {
+		return fmt.Errorf("rule %q has no value", r.String())
+	}
+	switch r.Match {
+	case "suffix", "prefix", "callType":
+	case "regex":
+		regex, err := regexp.Compile(r.Value)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", r.String(), err)
+		}
+		r.regex = regex
+	default:
+		return fmt.Errorf("unknown match %q, expected suffix, prefix, regex or callType", r.Match)
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to the entry
+func (r *FilterRule) matches(fileDetail FileDetail) bool {
+	switch r.Match {
+	case "suffix":
+		return strings.HasSuffix(fileDetail.RequestPath, r.Value)
+	case "prefix":
+		return strings.HasPrefix(fileDetail.RequestPath, r.Value)
+	case "regex":
+		return r.regex.MatchString(fileDetail.RequestPath)
+	case "callType":
+		return strings.EqualFold(fileDetail.CallType, r.Value)
+	}
+	return false
+}
+
+// ruleFilter applies a rule list to the entries of one upload and counts the exclusions per rule
+type ruleFilter struct {
+	rules    []*FilterRule
+	excluded []int
+}
+
+// newRuleFilter creates a filter for the given rules
+func newRuleFilter(rules []*FilterRule) *ruleFilter {
+	return &ruleFilter{rules: rules, excluded: make([]int, len(rules))}
+}
+
+// exclude reports whether the entry is excluded from the analysis
+func (f *ruleFilter) exclude(fileDetail FileDetail) bool {
+	if f == nil {
+		return false
+	}
+	for i, rule := range f.rules {
+		if rule.matches(fileDetail) {
+			if rule.Action == "exclude" {
+				f.excluded[i]++
+				return true
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// fork returns a filter with the same rules and its own counts, for parsing a file concurrently
+func (f *ruleFilter) fork() *ruleFilter {
+	if f == nil {
+		return nil
+	}
+	return newRuleFilter(f.rules)
+}
+
+// join adds the exclusion counts of a forked filter
+func (f *ruleFilter) join(fork *ruleFilter) {
+	if f == nil {
+		return
+	}
+	for i, count := range fork.excluded {
+		f.excluded[i] += count
+	}
+}
+
+// exclusions returns the exclusion count of every exclude rule
+func (f *ruleFilter) exclusions() []RuleExclusion {
+	var counts []RuleExclusion
+	for i, rule := range f.rules {
+		if rule.Action == "exclude" {
+			counts = append(counts, RuleExclusion{Rule: rule.String(), Count: f.excluded[i]})
+		}
+	}
+	return counts
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilterRules(t *testing.T) {
+	rules, err := parseFilterRules(`
+# Health checks are noise
+exclude prefix /actuator/health
+include   regex   ^/api/(orders|items) v[0-9]+$
+
+exclude callType DB
+exclude suffix .png`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "exclude prefix /actuator/health\ninclude regex ^/api/(orders|items) v[0-9]+$\nexclude callType DB\nexclude suffix .png"
+	if got := formatFilterRules(rules); got != want {
+		t.Errorf("rules = %q, want %q", got, want)
+	}
+	if again, err := parseFilterRules(formatFilterRules(rules)); err != nil || formatFilterRules(again) != want {
+		t.Errorf("rules read back = %v, %v, want %q", again, err, want)
+	}
+
+	for _, text := range []string{
+		"exclude prefix",
+		"drop prefix /a",
+		"exclude contains /a",
+		"exclude regex /a(",
+		"exclude prefix /a\ninclude",
+	} {
+		if rules, err := parseFilterRules(text); err == nil || !strings.HasPrefix(err.Error(), "line ") {
+			t.Errorf("parseFilterRules(%q) = %v, %v, want an error naming the line", text, rules, err)
+		}
+	}
+}
+
+func TestRuleFilterExclude(t *testing.T) {
+	rules, err := parseFilterRules(`include prefix /static/api
+exclude prefix /static
+exclude suffix .css
+exclude regex ^/api/v[0-9]+/health$
+exclude callType http-out-request`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, callType string
+		want           bool
+	}{
+		{"/static/app.js", "HTTP-In-Response", true},
+		{"/static/api/orders", "HTTP-In-Response", false}, // The first matching rule decides
+		{"/static/api/site.css", "HTTP-In-Response", false},
+		{"/site.css", "HTTP-In-Response", true},
+		{"/api/v2/health", "HTTP-In-Response", true},
+		{"/api/v2/health/db", "HTTP-In-Response", false},
+		{"/api/orders", "HTTP-Out-Request", true},
+		{"/api/orders", "HTTP-In-Response", false},
+		{"", "DB", false},
+	}
+	filter := newRuleFilter(rules)
+	fork := filter.fork()
+	for i, test := range tests {
+		f := filter
+		if i%2 == 1 {
+			f = fork
+		}
+		if got := f.exclude(FileDetail{RequestPath: test.path, CallType: test.callType}); got != test.want {
+			t.Errorf("exclude(%s %s) = %v, want %v", test.path, test.callType, got, test.want)
+		}
+	}
+
+	// Exclusions of a forked filter are counted once it is joined
+	filter.join(fork)
+	want := "[{exclude prefix /static 1} {exclude suffix .css 1} {exclude regex ^/api/v[0-9]+/health$ 1} {exclude callType http-out-request 1}]"
+	if got := fmt.Sprint(filter.exclusions()); got != want {
+		t.Errorf("exclusions = %s, want %s", got, want)
+	}
+
+	var none *ruleFilter
+	if none.exclude(FileDetail{RequestPath: "/static/app.js"}) || none.fork() != nil {
+		t.Error("a nil filter excludes entries")
+	}
+}
+
+func TestDefaultFilterRules(t *testing.T) {
+	filter := newRuleFilter(defaultFilterRules())
+	for path, want := range map[string]bool{"/js/app.js": true, "/fonts/a.woff2": true, "/img/logo.png": true, "/api/orders": false, "/api/json": false} {
+		if got := filter.exclude(FileDetail{RequestPath: path}); got != want {
+			t.Errorf("exclude(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestLoadFilterRules(t *testing.T) {
+	previous := filterRules
+	t.Cleanup(func() { filterRules = previous })
+	dir := t.TempDir()
+	load := func(config string) error {
+		name := filepath.Join(dir, "filterRules.json")
+		if err := os.WriteFile(name, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return LoadFilterRules(name)
+	}
+
+	if err := load(`{"rules":[{"action":"exclude","match":"regex","value":"^/internal/"}]}`); err != nil {
+		t.Fatal(err)
+	}
+	if !newRuleFilter(filterRules).exclude(FileDetail{RequestPath: "/internal/metrics"}) || len(filterRules) != 1 {
+		t.Errorf("rules = %s, want only the configured one", formatFilterRules(filterRules))
+	}
+	for _, config := range []string{`{"rules":[{"action":"exclude","match":"regex","value":"("}]}`, `{"rules":[{"action":"skip","match":"suffix","value":".js"}]}`, `{"rules":`} {
+		if err := load(config); err == nil {
+			t.Errorf("LoadFilterRules(%s) succeeded, want an error", config)
+		}
+		if len(filterRules) != 1 || filterRules[0].Value != "^/internal/" {
+			t.Errorf("rules after loading %s = %s, want them unchanged", config, formatFilterRules(filterRules))
+		}
+	}
+}
+
+func TestExcludedEntriesDropTheirContinuations(t *testing.T) {
+	rules, err := parseFilterRules("exclude prefix /static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := newLineParser("pipe", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := "2024-05-01 10:00:00,000|c1|t1|12|HTTP-In-Response|2024-05-01 10:00:00,000|handle||/static/app.js\n" +
+		"\tat Foo.bar(Foo.java:1)\n" +
+		"2024-05-01 10:00:01,000|c2|t2|12|HTTP-In-Response|2024-05-01 10:00:01,000|handle||/api/orders\n" +
+		"\tat Foo.baz(Foo.java:2)\n"
+	diagnostics := testDiagnostics()
+	filter := newRuleFilter(rules)
+	var events []LogEvent
+	err = readLogEntries(strings.NewReader(log), "app.log", parser, newLogAnalysis(nil, diagnostics, filter), func(event LogEvent, at lineRef) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ThreadId != "t2" || events[0].Continuation != "\tat Foo.baz(Foo.java:2)" {
+		t.Errorf("entries = %+v, want only t2 with its own continuation", events)
+	}
+	if diagnostics.Total != 0 || filter.exclusions()[0].Count != 1 {
+		t.Errorf("%d diagnostics and exclusions %v, want the excluded entry counted only by its rule", diagnostics.Total, filter.exclusions())
+	}
+}
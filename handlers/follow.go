@@ -0,0 +1,497 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// followPollInterval is how often a followed file is checked for new lines. Lines held back for
+// continuation lines are added once a poll finds nothing new, and the lines read are saved every
+// feedCommitInterval.
+const followPollInterval = time.Second
+
+// errFollowDisabled is returned while no follow directory is configured
+var errFollowDisabled = errors.New("following server files is disabled, start the server with -follow-dirs")
+
+// followDirs are the directories whose files can be followed
+var followDirs []string
+
+// followers holds the follower of every tab that follows a file. A follower removes itself once it stopped or failed.
+var (
+	followersMu sync.Mutex
+	followers   = map[string]*follower{}
+)
+
+// SetFollowDirs sets the directories whose files can be followed from the web UI. Following is
+// disabled while no directory is set, since it reads files on the server.
+func SetFollowDirs(dirs []string) error {
+	var resolved []string
+	for _, dir := range dirs {
+		if strings.TrimSpace(dir) == "" {
+			continue
+		}
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return fmt.Errorf("invalid follow directory: %w", err)
+		}
+		abs, err := filepath.Abs(real)
+		if err != nil {
+			return fmt.Errorf("invalid follow directory: %w", err)
+		}
+		resolved = append(resolved, abs)
+	}
+	followDirs = resolved
+	return nil
+}
+
+// followablePath returns the absolute path of a file inside one of the follow directories.
+// The path itself is followed, so a symlink that is switched on rotation is picked up again.
+func followablePath(path string) (string, error) {
+	if len(followDirs) == 0 {
+		return "", errFollowDisabled
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range followDirs {
+		rel, err := filepath.Rel(dir, real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return abs, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not inside a follow directory", path)
+}
+
+// FollowStatus describes the progress of a followed file
+type FollowStatus struct {
+	Path        string
+	Following   bool
+	Lines       int // Lines read since following started
+	Entries     int // Entries in the session file, including earlier uploads
+	Rejected    int // Lines rejected or only partially parsed since following started
+	Rotations   int
+	Truncations int
+	Error       string
+	Updated     time.Time
+}
+
+// follower tails a log file and feeds new lines to a session, so the index page can show the
+// statistics while the file grows
+type follower struct {
+	tabUUID  string
+	path     string
+	encoding *textEncoding
+	feed     *sessionFeed
+	stop     chan struct{}
+	done     chan struct{}
+
+	// Only used by the follow goroutine
+	file       *os.File
+	reader     *bufio.Reader
+	offset     int64  // Bytes of the open file that have been read, before they are decoded
+	partial    string // Last line of the file while it is still being written
+	skipping   bool   // The last line is longer than maxLineBytes, only its start is kept in partial
+	lineNumber int
+	linesRead  int
+
+	mu     sync.Mutex // Guards status, which is read by status requests
+	status FollowStatus
+}
+
+// startFollower opens path and follows it for tabUUID in the background, replacing the tab's
+// previous follower. Without fromStart only lines appended from now on are read.
+func startFollower(tabUUID, path string, fromStart bool, parser *lineParser, filter *ruleFilter) (*follower, error) {
+	f, err := newFollower(tabUUID, path, fromStart, parser, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	followersMu.Lock()
+	previous := followers[tabUUID]
+	followers[tabUUID] = f
+	followersMu.Unlock()
+	if previous != nil {
+		previous.halt()
+	}
+
+	go f.run()
+	return f, nil
+}
+
+// newFollower opens path for following it into the session tabUUID
+func newFollower(tabUUID, path string, fromStart bool, parser *lineParser, filter *ruleFilter) (*follower, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(0)
+	if !fromStart {
+		if offset, err = file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	f := &follower{
+		tabUUID:  tabUUID,
+		path:     path,
+		encoding: parser.encoding,
+		feed:     newSessionFeed(tabUUID, path, parser, filter),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		status:   FollowStatus{Path: path, Following: true, Updated: time.Now()},
+	}
+	f.readFrom(file, offset)
+	return f, nil
+}
+
+// run polls the file until the follower is stopped or fails
+func (f *follower) run() {
+	defer close(f.done)
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.poll(false); err != nil {
+			f.close(err)
+			return
+		}
+		select {
+		case <-f.stop:
+			f.close(f.poll(true))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// halt stops the follower and waits until the lines read so far are saved
+func (f *follower) halt() {
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+	<-f.done
+}
+
+// close releases the file, records why following ended and removes the follower from its tab,
+// unless another one replaced it already
+func (f *follower) close(err error) {
+	f.file.Close()
+	f.feed.abort()
+
+	followersMu.Lock()
+	if followers[f.tabUUID] == f {
+		delete(followers, f.tabUUID)
+	}
+	followersMu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.Following = false
+	f.status.Updated = time.Now()
+	if err != nil {
+		log.Printf("Stopped following %s: %v\n", f.path, err)
+		f.status.Error = err.Error()
+	}
+}
+
+// poll adds the lines appended since the last poll to the session. The final poll also adds a
+// last line without a line break and every line held back for continuation lines.
+func (f *follower) poll(final bool) error {
+	read := f.linesRead
+	if err := f.readLines(); err != nil {
+		return err
+	}
+
+	rotated, truncated, err := f.checkFile()
+	if err != nil {
+		return err
+	}
+	switch {
+	case truncated:
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		f.restart(f.file)
+		f.mu.Lock()
+		f.status.Truncations++
+		f.mu.Unlock()
+		if err := f.readLines(); err != nil {
+			return err
+		}
+	case rotated:
+		// The rotated file may have been written to since it was read, so it is read to its end first
+		if err := f.readLines(); err != nil {
+			return err
+		}
+		if err := f.addPartial(); err != nil {
+			return err
+		}
+		if err := f.reopen(); err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.status.Rotations++
+		f.mu.Unlock()
+		if err := f.readLines(); err != nil {
+			return err
+		}
+	}
+
+	if final {
+		if err := f.addPartial(); err != nil {
+			return err
+		}
+	}
+	if final || f.linesRead == read {
+		if err := f.feed.flush(); err != nil {
+			return err
+		}
+	}
+	commit := f.feed.commitDue
+	if final {
+		commit = f.feed.commit
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.Lines = f.linesRead
+	f.status.Entries, f.status.Rejected = f.feed.counts()
+	f.status.Updated = time.Now()
+	return nil
+}
+
+// readLines adds the complete lines available in the open file. Of a line longer than maxLineBytes
+// only the start is kept for its diagnostic, the rest is skipped as it is read.
+func (f *follower) readLines() error {
+	for {
+		chunk, err := f.reader.ReadSlice('\n')
+		switch {
+		case f.skipping:
+		case len(f.partial)+len(chunk) > maxLineBytes:
+			preview := f.partial + string(chunk[:min(len(chunk), maxSkippedLinePreview)])
+			f.partial = preview[:min(len(preview), maxSkippedLinePreview)]
+			f.skipping = true
+		default:
+			f.partial += string(chunk)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f.addPartial(); err != nil {
+			return err
+		}
+	}
+}
+
+// addPartial adds the line read so far as a complete line
+func (f *follower) addPartial() error {
+	if f.partial == "" {
+		return nil
+	}
+	f.lineNumber++
+	f.linesRead++
+	at := lineRef{source: f.path, number: f.lineNumber, raw: strings.TrimRight(f.partial, "\r\n")}
+	f.partial = ""
+	if f.skipping {
+		f.skipping = false
+		return f.feed.skip(at)
+	}
+	return f.feed.add(at)
+}
+
+// checkFile detects whether the followed path now names a new file, or the open file was truncated
+func (f *follower) checkFile() (rotated, truncated bool, err error) {
+	current, err := f.file.Stat()
+	if err != nil {
+		return false, false, err
+	}
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		// The file was moved away and the new one is not created yet
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if !os.SameFile(current, info) {
+		return true, false, nil
+	}
+	return false, current.Size() < f.offset, nil
+}
+
+// reopen switches to the file that replaced the followed one on rotation
+func (f *follower) reopen() error {
+	if _, err := followablePath(f.path); err != nil {
+		return err
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	f.file.Close()
+	f.restart(file)
+	return nil
+}
+
+// restart reads file from its start
+func (f *follower) restart(file *os.File) {
+	f.readFrom(file, 0)
+	f.partial = ""
+	f.skipping = false
+	f.lineNumber = 0
+}
+
+// readFrom reads the lines of file from offset on, converted to UTF-8 like an uploaded file
+func (f *follower) readFrom(file *os.File, offset int64) {
+	f.file = file
+	f.offset = offset
+	f.reader = bufio.NewReaderSize(decodeText(offsetCounter{file, &f.offset}, f.encoding), 64*1024)
+}
+
+// offsetCounter adds the bytes read from the followed file to its offset
+type offsetCounter struct {
+	io.Reader
+	offset *int64
+}
+
+func (c offsetCounter) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	*c.offset += int64(n)
+	return n, err
+}
+
+// followResponse is the live state of a followed file as polled by the index page
+type followResponse struct {
+	Status           FollowStatus
+	Overall          OverallStats
+	TimeBuckets      map[string]*TimeBucketStats
+	RequestPathStats map[string]*RequestPathStats
+	QueryMetrics     map[string]*QueryMetrics
+}
+
+// response returns the status of the follower together with the current statistics of its tab
+func (f *follower) response() followResponse {
+	f.mu.Lock()
+	status := f.status
+	f.mu.Unlock()
+
+	response := followResponse{
+		Status:      status,
+		Overall:     f.feed.overallStats(),
+		TimeBuckets: f.feed.timeBuckets(),
+	}
+	response.RequestPathStats, response.QueryMetrics = tabStats(f.tabUUID)
+	return response
+}
+
+// FollowHandler starts following a log file on the server for a tab. The log format, time zone
+// and filter rules are read from the same form fields as an upload.
+func FollowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tabUUID := r.FormValue("uniqueID")
+	if err := validateSessionID(tabUUID); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	path, err := followablePath(r.FormValue("path"))
+	if errors.Is(err, errFollowDisabled) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot follow this file: %v", err), http.StatusBadRequest)
+		return
+	}
+	parser, rules, err := uploadSettings(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, err := startFollower(tabUUID, path, r.FormValue("fromStart") != "", parser, newRuleFilter(rules))
+	if err != nil {
+		log.Printf("Error following %s: %v\n", path, err)
+		http.Error(w, "Failed to open the file", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Following %s for tab %s\n", path, tabUUID)
+	writeFollowResponse(w, f)
+}
+
+// FollowStatusHandler returns the status and statistics of the file followed for a tab
+func FollowStatusHandler(w http.ResponseWriter, r *http.Request) {
+	f := tabFollower(w, r)
+	if f == nil {
+		return
+	}
+	writeFollowResponse(w, f)
+}
+
+// FollowStopHandler stops following the file of a tab once the lines read so far are saved
+func FollowStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	f := tabFollower(w, r)
+	if f == nil {
+		return
+	}
+	f.halt()
+	writeFollowResponse(w, f)
+}
+
+// tabFollower returns the follower of the tab named by the tabUUID parameter, or writes an error
+func tabFollower(w http.ResponseWriter, r *http.Request) *follower {
+	tabUUID := r.FormValue("tabUUID")
+	if tabUUID == "" {
+		http.Error(w, "Tab UUID query parameter is required", http.StatusBadRequest)
+		return nil
+	}
+	followersMu.Lock()
+	f := followers[tabUUID]
+	followersMu.Unlock()
+	if f == nil {
+		http.Error(w, "No file is followed for this tab", http.StatusNotFound)
+	}
+	return f
+}
+
+// writeFollowResponse writes the state of a follower as JSON
+func writeFollowResponse(w http.ResponseWriter, f *follower) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(f.response()); err != nil {
+		log.Printf("Error writing follow status: %v\n", err)
+	}
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFollower follows path for tab from its start without running the follow goroutine, so
+// the test polls it itself
+func newTestFollower(t *testing.T, tab, path string) *follower {
+	t.Helper()
+	parser, err := newLineParser("", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFollower(tab, path, true, parser, newRuleFilter(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.file.Close() })
+	return f
+}
+
+// appendFile appends content to the file at path
+func appendFile(t *testing.T, path, content string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowerCommitsInBatches(t *testing.T) {
+	useTestServerDir(t)
+	tab := "3cadbfea-1e2f-4abc-9d3e-8f9a0b1c2d3e"
+	t.Cleanup(func() { forgetTabStats(tab) })
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte(testUploadLog(0, 2)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFollower(t, tab, path)
+
+	// Lines are collected until the batch is due
+	if err := f.poll(false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := f.feed.counts(); entries != 0 {
+		t.Errorf("entries after the first poll = %d, want none committed yet", entries)
+	}
+	if exists, err := sessionStore.Exists(tab); exists || err != nil {
+		t.Errorf("session exists after the first poll = %v, %v, want it not written yet", exists, err)
+	}
+
+	f.feed.batchStarted = f.feed.batchStarted.Add(-feedCommitInterval)
+	if err := f.poll(false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := f.feed.counts(); entries != 6 {
+		t.Errorf("entries once the batch is due = %d, want 6", entries)
+	}
+
+	// The final poll saves what was appended since, even if the batch is not due
+	appendFile(t, path, testUploadLog(1, 1))
+	if err := f.poll(false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := f.feed.counts(); entries != 6 {
+		t.Errorf("entries after appending = %d, want the new ones not committed yet", entries)
+	}
+	if err := f.poll(true); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := sessionStore.Stat(tab); err != nil || stat.Entries != 9 {
+		t.Errorf("session after the final poll = %+v, %v, want 9 entries", stat, err)
+	}
+}
+
+func TestFollowerSkipsLongLines(t *testing.T) {
+	useTestServerDir(t)
+	tab := "4dbecafb-2f3a-4bcd-8e4f-9a0b1c2d3e4f"
+	t.Cleanup(func() { forgetTabStats(tab) })
+	entry := "2024-05-01 10:00:00,000|c1|t1|12|HTTP-In-Response|2024-05-01 10:00:00,000|handle||/api/orders"
+	path := filepath.Join(t.TempDir(), "app.log")
+	log := entry + "\n" +
+		strings.Repeat("x", 2*maxLineBytes) + "\n" +
+		entry + "\n" +
+		strings.Repeat("y", maxLineBytes+1) // Still being written
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFollower(t, tab, path)
+
+	if err := f.poll(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.partial) > maxLineBytes || !f.skipping {
+		t.Errorf("unfinished long line kept with %d bytes, skipping %v, want at most %d bytes kept", len(f.partial), f.skipping, maxLineBytes)
+	}
+	if err := f.poll(true); err != nil {
+		t.Fatal(err)
+	}
+	entries, rejected := f.feed.counts()
+	if entries != 2 || rejected != 2 || f.linesRead != 4 {
+		t.Errorf("entries, rejected, lines read = %d, %d, %d, want 2, 2, 4", entries, rejected, f.linesRead)
+	}
+}
+
+func TestStoppedFollowerIsRemoved(t *testing.T) {
+	useTestServerDir(t)
+	dir := t.TempDir()
+	previous := followDirs
+	t.Cleanup(func() { followDirs = previous })
+	if err := SetFollowDirs([]string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	tab := "5ecfdbac-3a4b-4cde-9f5a-0b1c2d3e4f5a"
+	t.Cleanup(func() {
+		stopFollowing(tab)
+		forgetTabStats(tab)
+	})
+	path := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(path, []byte(testUploadLog(0, 2)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	parser, err := newLineParser("", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	followed := func() *follower {
+		followersMu.Lock()
+		defer followersMu.Unlock()
+		return followers[tab]
+	}
+
+	// Stopped from the page, the final status is part of the response
+	if _, err := startFollower(tab, path, true, parser, newRuleFilter(nil)); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	FollowStopHandler(w, httptest.NewRequest(http.MethodPost, "/follow/stop?tabUUID="+tab, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Entries":6`) {
+		t.Errorf("stop: %d %s, want the final status", w.Code, w.Body.String())
+	}
+	if f := followed(); f != nil {
+		t.Errorf("follower of a stopped tab kept: %s", f.path)
+	}
+
+	// Failed, because the file was replaced by a link out of the follow directories
+	if _, err := startFollower(tab, path, true, parser, newRuleFilter(nil)); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "other.log")
+	if err := os.WriteFile(outside, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, path); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * followPollInterval)
+	for followed() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f := followed(); f != nil {
+		t.Errorf("follower of a failed tab kept: %s", f.path)
+	}
+}
@@ -0,0 +1,461 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexedSessionStore keeps every session in a bbolt database <dir>/<tabUUID>.bolt holding
+//
+//	entries                    every entry as JSON under its sequence number
+//	correlation, path, query   the sequence numbers of the entries under the value of the field
+//	keys                       the sequence number of the first entry with each entryKey, used to drop duplicates
+//	meta                       how many entries are committed and when
+//
+// Drill-downs scan the index of a correlation ID, request path or query for the exact value and
+// only read the entries it points to. A writer adds its entries in batches, but readers only see
+// the entries below the committed count, which the writer raises in its last transaction. Entries
+// of a writer that was aborted or never finished are removed when the next writer opens the session.
+type indexedSessionStore struct {
+	dir string
+}
+
+// indexedWriteBatch is how many entries a writer adds in a single transaction
+const indexedWriteBatch = 5000
+
+// Buckets of a session database
+var (
+	entriesBucket = []byte("entries")
+	metaBucket    = []byte("meta")
+	keysBucket    = []byte("keys")
+
+	// Indexed fields, in the order of indexedFields
+	correlationBucket = []byte("correlation")
+	pathBucket        = []byte("path")
+	queryBucket       = []byte("query")
+)
+
+// Keys of the meta bucket
+var (
+	metaEntries  = []byte("entries")
+	metaModified = []byte("modified")
+)
+
+// indexedField is a field of the entries with an index bucket
+type indexedField struct {
+	bucket []byte
+	value  func(event *LogEvent) string
+}
+
+var indexedFields = []indexedField{
+	{correlationBucket, func(event *LogEvent) string { return event.CorrelationId }},
+	{pathBucket, func(event *LogEvent) string { return event.RequestPath }},
+	{queryBucket, func(event *LogEvent) string { return event.RequestQuery }},
+}
+
+// sessionFile returns the database of the session of tabUUID
+func (s indexedSessionStore) sessionFile(tabUUID string) string {
+	return filepath.Join(s.dir, tabUUID+".bolt")
+}
+
+// sequenceKey encodes a sequence number so keys sort in the order the entries were added
+func sequenceKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// indexPrefix is the start of the index keys of value. The length in front keeps values that start
+// with another value apart from it.
+func indexPrefix(value string) []byte {
+	prefix := binary.AppendUvarint(nil, uint64(len(value)))
+	return append(prefix, value...)
+}
+
+// indexKey is the key of an entry in an index, the value followed by the entry's sequence number
+func indexKey(value string, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(indexPrefix(value), seq)
+}
+
+// openDBs holds the databases that are open. bbolt locks its file for a single handle, so every
+// writer and reader of a session in this process shares one, which is closed once it is unused.
+var openDBs = struct {
+	sync.Mutex
+	handles map[string]*dbHandle
+}{handles: map[string]*dbHandle{}}
+
+type dbHandle struct {
+	db      *bolt.DB
+	users   int
+	removed bool // The file was deleted while the handle was in use
+}
+
+// openDB returns the database at path and the function releasing it. Without create a missing
+// database fails with os.ErrNotExist instead of being created.
+func openDB(path string, create bool) (*bolt.DB, func(), error) {
+	openDBs.Lock()
+	defer openDBs.Unlock()
+	handle, exists := openDBs.handles[path]
+	if !exists {
+		if _, err := os.Stat(path); err != nil && (!create || !errors.Is(err, os.ErrNotExist)) {
+			return nil, nil, err
+		}
+		db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: 10 * time.Second})
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening session database: %w", err)
+		}
+		handle = &dbHandle{db: db}
+		openDBs.handles[path] = handle
+	}
+	handle.users++
+
+	released := false
+	return handle.db, func() {
+		openDBs.Lock()
+		defer openDBs.Unlock()
+		if released {
+			return
+		}
+		released = true
+		handle.users--
+		if handle.users == 0 {
+			handle.db.Close()
+			if !handle.removed {
+				delete(openDBs.handles, path)
+			}
+		}
+	}, nil
+}
+
+// removeDB deletes the database at path. A handle still in use keeps reading the deleted file until
+// it is released, the next openDB starts a new one.
+func removeDB(path string) error {
+	openDBs.Lock()
+	defer openDBs.Unlock()
+	if handle, exists := openDBs.handles[path]; exists {
+		handle.removed = true
+		delete(openDBs.handles, path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// committedEntries returns the number of committed entries, failing with os.ErrNotExist for a
+// session whose first writer did not commit yet
+func committedEntries(tx *bolt.Tx) (uint64, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil || meta.Get(metaEntries) == nil {
+		return 0, fmt.Errorf("session is not committed yet: %w", os.ErrNotExist)
+	}
+	return binary.BigEndian.Uint64(meta.Get(metaEntries)), nil
+}
+
+// view runs fn in a read transaction of the session of tabUUID with its committed entry count
+func (s indexedSessionStore) view(tabUUID string, fn func(tx *bolt.Tx, committed uint64) error) error {
+	db, release, err := openDB(s.sessionFile(tabUUID), false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return db.View(func(tx *bolt.Tx) error {
+		committed, err := committedEntries(tx)
+		if err != nil {
+			return err
+		}
+		return fn(tx, committed)
+	})
+}
+
+func (s indexedSessionStore) OpenWriter(tabUUID string) (SessionWriter, error) {
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating session directory: %w", err)
+	}
+	w := &indexedSessionWriter{path: s.sessionFile(tabUUID)}
+	if err := w.open(); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s indexedSessionStore) Export(tabUUID string, w io.Writer) error {
+	return s.view(tabUUID, func(tx *bolt.Tx, committed uint64) error {
+		// The entries are written as the elements of a JSON array
+		out := bufio.NewWriterSize(w, 64*1024)
+		out.WriteString("[")
+		cursor := tx.Bucket(entriesBucket).Cursor()
+		for key, data := cursor.First(); key != nil && binary.BigEndian.Uint64(key) < committed; key, data = cursor.Next() {
+			if binary.BigEndian.Uint64(key) > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n  ")
+			out.Write(data)
+		}
+		out.WriteString("\n]\n")
+		return out.Flush()
+	})
+}
+
+func (s indexedSessionStore) ByCorrelationIDs(tabUUID string, ids []string) ([]LogEvent, error) {
+	return s.find(tabUUID, correlationBucket, ids)
+}
+
+func (s indexedSessionStore) ByRequestPath(tabUUID, path string) ([]LogEvent, error) {
+	return s.find(tabUUID, pathBucket, []string{path})
+}
+
+func (s indexedSessionStore) ByQuery(tabUUID, query string) ([]LogEvent, error) {
+	return s.find(tabUUID, queryBucket, []string{query})
+}
+
+func (s indexedSessionStore) Sessions() ([]string, error) {
+	return sessionsWithSuffix(s.dir, ".bolt", false)
+}
+
+func (s indexedSessionStore) Exists(tabUUID string) (bool, error) {
+	err := s.view(tabUUID, func(*bolt.Tx, uint64) error { return nil })
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s indexedSessionStore) Stat(tabUUID string) (SessionStat, error) {
+	var stat SessionStat
+	err := s.view(tabUUID, func(tx *bolt.Tx, committed uint64) error {
+		stat.Entries = int(committed)
+		stat.Bytes = tx.Size()
+		return stat.Modified.UnmarshalBinary(tx.Bucket(metaBucket).Get(metaModified))
+	})
+	return stat, err
+}
+
+func (s indexedSessionStore) Delete(tabUUID string) error {
+	return removeDB(s.sessionFile(tabUUID))
+}
+
+// find scans the index bucket for every value and returns the committed entries it points to in the
+// order they were added
+func (s indexedSessionStore) find(tabUUID string, bucket []byte, values []string) ([]LogEvent, error) {
+	var events []LogEvent
+	err := s.view(tabUUID, func(tx *bolt.Tx, committed uint64) error {
+		var seqs []uint64
+		cursor := tx.Bucket(bucket).Cursor()
+		for _, value := range values {
+			prefix := indexPrefix(value)
+			for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+				if seq := binary.BigEndian.Uint64(key[len(prefix):]); seq < committed {
+					seqs = append(seqs, seq)
+				}
+			}
+		}
+		sortUint64s(seqs)
+
+		entries := tx.Bucket(entriesBucket)
+		for i, seq := range seqs {
+			if i > 0 && seq == seqs[i-1] {
+				continue
+			}
+			var event LogEvent
+			if err := json.Unmarshal(entries.Get(sequenceKey(seq)), &event); err != nil {
+				return fmt.Errorf("error decoding session entry %d: %w", seq, err)
+			}
+			event.ensureTyped()
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// indexedSessionWriter adds entries to a session of the indexed store. Only the current batch of
+// entries is held in memory.
+type indexedSessionWriter struct {
+	path      string
+	db        *bolt.DB
+	release   func()
+	isNew     bool     // Whether the session was never committed
+	committed uint64   // Entries committed when the writer was opened
+	next      uint64   // Sequence number of the next entry
+	batch     [][]byte // Encoded entries not yet added to the database
+	events    []LogEvent
+}
+
+// open creates the buckets of a new session and removes the entries of an earlier writer that did
+// not commit
+func (w *indexedSessionWriter) open() error {
+	var err error
+	if w.db, w.release, err = openDB(w.path, true); err != nil {
+		return err
+	}
+	return w.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{entriesBucket, metaBucket, keysBucket, correlationBucket, pathBucket, queryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return fmt.Errorf("error creating session bucket: %w", err)
+			}
+		}
+		committed, err := committedEntries(tx)
+		w.isNew = errors.Is(err, os.ErrNotExist)
+		if err != nil && !w.isNew {
+			return err
+		}
+		w.committed, w.next = committed, committed
+		return removeUncommitted(tx, committed)
+	})
+}
+
+// removeUncommitted deletes the entries from committed on together with their index keys
+func removeUncommitted(tx *bolt.Tx, committed uint64) error {
+	entries := tx.Bucket(entriesBucket)
+	keys := tx.Bucket(keysBucket)
+	cursor := entries.Cursor()
+	for key, data := cursor.Seek(sequenceKey(committed)); key != nil; key, data = cursor.Seek(sequenceKey(committed)) {
+		seq := binary.BigEndian.Uint64(key)
+		var event LogEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("error decoding session entry %d: %w", seq, err)
+		}
+		for _, field := range indexedFields {
+			if err := tx.Bucket(field.bucket).Delete(indexKey(field.value(&event), seq)); err != nil {
+				return err
+			}
+		}
+		dedupeKey := sequenceKey(entryKey(event.FileDetail))
+		if first := keys.Get(dedupeKey); first != nil && binary.BigEndian.Uint64(first) == seq {
+			if err := keys.Delete(dedupeKey); err != nil {
+				return err
+			}
+		}
+		if err := entries.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write adds a single log event to the batch, which is added to the database once it is full
+func (w *indexedSessionWriter) Write(event LogEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error encoding JSON data: %w", err)
+	}
+	w.batch = append(w.batch, data)
+	w.events = append(w.events, event)
+	if len(w.batch) >= indexedWriteBatch {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush adds the batch to the database, invisible to readers until commit
+func (w *indexedSessionWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		keys := tx.Bucket(keysBucket)
+		for i, data := range w.batch {
+			seq := w.next + uint64(i)
+			if err := entries.Put(sequenceKey(seq), data); err != nil {
+				return err
+			}
+			event := &w.events[i]
+			for _, field := range indexedFields {
+				if err := tx.Bucket(field.bucket).Put(indexKey(field.value(event), seq), nil); err != nil {
+					return err
+				}
+			}
+			dedupeKey := sequenceKey(entryKey(event.FileDetail))
+			if keys.Get(dedupeKey) == nil {
+				if err := keys.Put(dedupeKey, sequenceKey(seq)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error writing session entries: %w", err)
+	}
+	w.next += uint64(len(w.batch))
+	w.batch, w.events = w.batch[:0], w.events[:0]
+	return nil
+}
+
+func (w *indexedSessionWriter) Contains(key uint64) bool {
+	found := false
+	w.db.View(func(tx *bolt.Tx) error {
+		first := tx.Bucket(keysBucket).Get(sequenceKey(key))
+		found = first != nil && binary.BigEndian.Uint64(first) < w.committed
+		return nil
+	})
+	return found
+}
+
+func (w *indexedSessionWriter) Count() int {
+	return int(w.next) + len(w.batch)
+}
+
+func (w *indexedSessionWriter) Name() string {
+	return w.path
+}
+
+// Commit adds the rest of the batch and makes the new entries visible by raising the committed count
+func (w *indexedSessionWriter) Commit() error {
+	err := w.flush()
+	if err == nil {
+		err = w.db.Update(func(tx *bolt.Tx) error {
+			modified, err := time.Now().MarshalBinary()
+			if err != nil {
+				return err
+			}
+			meta := tx.Bucket(metaBucket)
+			if err := meta.Put(metaEntries, sequenceKey(w.next)); err != nil {
+				return err
+			}
+			return meta.Put(metaModified, modified)
+		})
+	}
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("error committing session: %w", err)
+	}
+	w.close()
+	fmt.Printf("Session successfully saved to: %s\n", w.path)
+	return nil
+}
+
+// Abort removes the uncommitted entries again, or the whole session if it was never committed
+func (w *indexedSessionWriter) Abort() {
+	if w.db != nil && !w.isNew {
+		w.db.Update(func(tx *bolt.Tx) error {
+			return removeUncommitted(tx, w.committed)
+		})
+	}
+	w.close()
+	if w.isNew {
+		removeDB(w.path)
+	}
+}
+
+// close releases the database
+func (w *indexedSessionWriter) close() {
+	if w.release != nil {
+		w.release()
+		w.release = nil
+	}
+	w.db = nil
+	w.batch, w.events = nil, nil
+}
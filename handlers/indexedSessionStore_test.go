@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+const testTab = "0d6c5f2e-8a43-4c1b-9a57-3f2b1e6d7c80"
+
+// testEvent returns an entry of a request with the given correlation ID, path and query
+func testEvent(i int, correlationID, path, query string) LogEvent {
+	return newLogEvent(FileDetail{
+		Timestamp:               fmt.Sprintf("2024-05-01 10:00:%02d,000", i%60),
+		CorrelationId:           correlationID,
+		ThreadId:                fmt.Sprintf("t%d", i),
+		TotalDurationForRequest: "12",
+		CallType:                "HTTP-In-Response",
+		RequestPath:             path,
+		RequestQuery:            query,
+	})
+}
+
+// writeSession adds events to the session and commits them
+func writeSession(t *testing.T, store SessionStore, events ...LogEvent) {
+	t.Helper()
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	for _, event := range events {
+		if err := w.Write(event); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+// threadIDs returns the thread IDs of events, which the test events are told apart by
+func threadIDs(events []LogEvent) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ThreadId)
+	}
+	return ids
+}
+
+func assertThreadIDs(t *testing.T, what string, events []LogEvent, err error, want ...string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if got := threadIDs(events); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
+
+func TestIndexedSessionStoreCommit(t *testing.T) {
+	store := indexedSessionStore{dir: t.TempDir()}
+	writeSession(t, store,
+		testEvent(0, "c1", "/api/a", "select 1"),
+		testEvent(1, "c2", "/api/b", "select 2"),
+	)
+	writeSession(t, store, testEvent(2, "c1", "/api/b", "select 1"))
+
+	events, err := store.ByCorrelationIDs(testTab, []string{"c1"})
+	assertThreadIDs(t, "ByCorrelationIDs(c1)", events, err, "t0", "t2")
+	events, err = store.ByCorrelationIDs(testTab, []string{"c2", "c1"})
+	assertThreadIDs(t, "ByCorrelationIDs(c2, c1)", events, err, "t0", "t1", "t2")
+	events, err = store.ByRequestPath(testTab, "/api/b")
+	assertThreadIDs(t, "ByRequestPath", events, err, "t1", "t2")
+	events, err = store.ByQuery(testTab, "select 1")
+	assertThreadIDs(t, "ByQuery", events, err, "t0", "t2")
+
+	stat, err := store.Stat(testTab)
+	if err != nil || stat.Entries != 3 {
+		t.Errorf("Stat = %+v, %v, want 3 entries", stat, err)
+	}
+	var exported bytes.Buffer
+	if err := store.Export(testTab, &exported); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	var all []LogEvent
+	if err := json.Unmarshal(exported.Bytes(), &all); err != nil {
+		t.Fatalf("Export is not a JSON array: %v\n%s", err, exported.String())
+	}
+	assertThreadIDs(t, "Export", all, nil, "t0", "t1", "t2")
+
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	defer w.Abort()
+	if !w.Contains(entryKey(all[1].FileDetail)) || w.Contains(entryKey(testEvent(3, "c3", "/", "").FileDetail)) {
+		t.Error("Contains does not report exactly the committed entries")
+	}
+	if w.Count() != 3 {
+		t.Errorf("Count = %d, want 3", w.Count())
+	}
+}
+
+func TestIndexedSessionStoreAbort(t *testing.T) {
+	store := indexedSessionStore{dir: t.TempDir()}
+
+	// A session whose first writer aborts is not stored
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	w.Write(testEvent(0, "c1", "/api/a", ""))
+	w.Abort()
+	if exists, err := store.Exists(testTab); exists || err != nil {
+		t.Errorf("Exists after aborting the first writer = %v, %v", exists, err)
+	}
+	if _, err := store.ByRequestPath(testTab, "/api/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ByRequestPath of a missing session: %v, want os.ErrNotExist", err)
+	}
+
+	// Entries of an aborted writer disappear, including those already added in full batches
+	writeSession(t, store, testEvent(0, "c1", "/api/a", ""))
+	w, err = store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	for i := 1; i <= indexedWriteBatch+1; i++ {
+		if err := w.Write(testEvent(i, "c1", "/api/a", "")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	w.Abort()
+	events, err := store.ByCorrelationIDs(testTab, []string{"c1"})
+	assertThreadIDs(t, "ByCorrelationIDs after abort", events, err, "t0")
+
+	writeSession(t, store, testEvent(1, "c2", "/api/a", ""))
+	events, err = store.ByRequestPath(testTab, "/api/a")
+	assertThreadIDs(t, "ByRequestPath after the next commit", events, err, "t0", "t1")
+}
+
+func TestIndexedSessionStoreCrashRecovery(t *testing.T) {
+	store := indexedSessionStore{dir: t.TempDir()}
+	writeSession(t, store, testEvent(0, "c1", "/api/a", "select 1"))
+
+	// A writer that is never committed or aborted leaves its full batches in the database
+	opened, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	crashed := opened.(*indexedSessionWriter)
+	for i := 1; i <= indexedWriteBatch; i++ {
+		if err := crashed.Write(testEvent(i, "c1", "/api/a", "select 1")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	crashed.close()
+
+	events, err := store.ByQuery(testTab, "select 1")
+	assertThreadIDs(t, "ByQuery while uncommitted entries are stored", events, err, "t0")
+
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter after the crash: %v", err)
+	}
+	if w.Count() != 1 {
+		t.Errorf("Count after the crash = %d, want 1", w.Count())
+	}
+	if w.Contains(entryKey(testEvent(1, "c1", "/api/a", "select 1").FileDetail)) {
+		t.Error("Contains reports an entry that was never committed")
+	}
+	w.Write(testEvent(1, "c2", "/api/b", "select 2"))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	events, err = store.ByCorrelationIDs(testTab, []string{"c1", "c2"})
+	assertThreadIDs(t, "ByCorrelationIDs after recovery", events, err, "t0", "t1")
+	if stat, err := store.Stat(testTab); err != nil || stat.Entries != 2 {
+		t.Errorf("Stat after recovery = %+v, %v, want 2 entries", stat, err)
+	}
+}
+
+func TestIndexedSessionStoreExactLookups(t *testing.T) {
+	store := indexedSessionStore{dir: t.TempDir()}
+
+	// Values that share a prefix, or whose bytes run into the sequence number of another value's
+	// keys, are kept apart
+	writeSession(t, store,
+		testEvent(0, "c1", "/api", ""),
+		testEvent(1, "c1\x00", "/api/a", ""),
+		testEvent(2, "c10", "/api\x00\x00\x00\x00\x00\x00\x00\x00", ""),
+		testEvent(3, "", "", ""),
+	)
+	events, err := store.ByCorrelationIDs(testTab, []string{"c1"})
+	assertThreadIDs(t, "ByCorrelationIDs(c1)", events, err, "t0")
+	events, err = store.ByRequestPath(testTab, "/api")
+	assertThreadIDs(t, "ByRequestPath(/api)", events, err, "t0")
+	events, err = store.ByRequestPath(testTab, "")
+	assertThreadIDs(t, "ByRequestPath of the empty path", events, err, "t3")
+	events, err = store.ByQuery(testTab, "missing")
+	assertThreadIDs(t, "ByQuery of a missing query", events, err)
+}
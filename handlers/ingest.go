@@ -0,0 +1,675 @@
+package handlers
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logAnalysis accumulates the statistics of one upload while its lines are
+// streamed in, so neither the raw file nor every parsed line has to be held in memory.
+// Every upload, ingest and batch of a followed file has its own analysis, so concurrent
+// requests never share one.
+type logAnalysis struct {
+	pathStats     map[string]*RequestPathStats
+	queryMetrics  map[string]*QueryMetrics
+	timeBuckets   map[string]*TimeBucketStats
+	httpResponses slowestResponses // The slowest HTTP responses, at most maxSlowestResponses of them
+	sources       []string         // Files and archive members in the order they were processed
+
+	bucketDuration     time.Duration
+	tabUUID            string              // Session the entries are saved to, empty without one
+	lock               *sync.Mutex         // Lock of the session, held until commit or abort
+	newSession         bool                // The session was not stored before the analysis
+	session            SessionWriter       // Receives every accepted entry, may be nil
+	diagnostics        *parseDiagnostics   // Records rejected and partially parsed lines, may be nil
+	filter             *ruleFilter         // Decides which entries are analysed, may be nil
+	sampler            *correlationSampler // Sample of the requests the merger keeps, nil keeps every entry
+	progress           *analysisProgress   // Counts parsed and rejected lines of an analysis job, may be nil
+	totalHTTPRequests  int
+	totalHTTPResponses int
+	durations          durationSketch // Durations of every HTTP response
+
+	// Entries sampled at another scale than the analysis' own are counted apart by their scale
+	// and scaled on their own by applySampleScale
+	sampledParts map[float64]*logAnalysis
+	partScale    float64 // Scale of the entries of a part, 0 for an analysis that is no part
+	estimated    bool    // Counts were scaled up from a sample
+}
+
+// newLogAnalysis creates an empty analysis that writes accepted entries to session
+// and problems with individual lines to diagnostics. Entries excluded by filter are skipped.
+func newLogAnalysis(session SessionWriter, diagnostics *parseDiagnostics, filter *ruleFilter) *logAnalysis {
+	return &logAnalysis{
+		pathStats:      map[string]*RequestPathStats{},
+		queryMetrics:   map[string]*QueryMetrics{},
+		timeBuckets:    map[string]*TimeBucketStats{},
+		bucketDuration: 1 * time.Minute,
+		session:        session,
+		diagnostics:    diagnostics,
+		filter:         filter,
+	}
+}
+
+// newSessionAnalysis starts an analysis whose accepted entries are added to the session of
+// tabUUID in the session store. Its diagnostics replace the session's previous report unless keepDiagnostics is set.
+// The session stays locked until the analysis is committed or aborted.
+func newSessionAnalysis(tabUUID string, filter *ruleFilter, keepDiagnostics bool) (*logAnalysis, error) {
+	if err := validateSessionID(tabUUID); err != nil {
+		return nil, err
+	}
+	lock := lockSession(tabUUID)
+	exists, err := sessionStore.Exists(tabUUID)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	session, err := sessionStore.OpenWriter(tabUUID)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	diagnostics, err := newParseDiagnostics(tabUUID, keepDiagnostics)
+	if err != nil {
+		session.Abort()
+		lock.Unlock()
+		return nil, err
+	}
+	analysis := newLogAnalysis(session, diagnostics, filter)
+	analysis.tabUUID = tabUUID
+	analysis.lock = lock
+	analysis.newSession = !exists
+	return analysis, nil
+}
+
+// commit saves the session, the diagnostics report and the sources of the upload and merges the
+// statistics into the tab. All of it happens under the session's lock, so a session that is deleted
+// meanwhile is not recreated by half. A report that cannot be saved is only logged, since the
+// entries themselves are already safe. A tab whose statistics are not in memory, e.g. after a
+// restart, gets them rebuilt from the whole session instead.
+func (a *logAnalysis) commit() error {
+	defer a.unlock()
+	if err := a.session.Commit(); err != nil {
+		a.diagnostics.abort()
+		return err
+	}
+	recordSessionUpload(a.tabUUID, a.sources)
+	if err := a.diagnostics.commit(); err != nil {
+		log.Printf("Error saving diagnostics report: %v\n", err)
+	}
+	if a.newSession || tabStatsLoaded(a.tabUUID) {
+		a.mergeIntoTab(a.tabUUID)
+	} else if err := rebuildTabStats(a.tabUUID); err != nil {
+		log.Printf("Error rebuilding statistics of %s: %v\n", a.tabUUID, err)
+	}
+	return nil
+}
+
+// abort discards the new session entries and the diagnostics report, leaving the previous ones in place
+func (a *logAnalysis) abort() {
+	defer a.unlock()
+	a.session.Abort()
+	a.diagnostics.abort()
+}
+
+// unlock releases the session's lock
+func (a *logAnalysis) unlock() {
+	if a.lock != nil {
+		a.lock.Unlock()
+		a.lock = nil
+	}
+}
+
+// maxContinuationBytes caps the continuation text kept for a single entry
+const maxContinuationBytes = 64 * 1024
+
+// maxLineBytes caps the length of a single line, including its line break. Longer lines are skipped and recorded, so a
+// file without line breaks is never held in memory whole.
+const maxLineBytes = 1024 * 1024
+
+// maxSkippedLinePreview is how much of a skipped line is kept in its diagnostic
+const maxSkippedLinePreview = 1024
+
+// maxWrappedLines is how many unmatched lines are kept to rejoin a record that was wrapped over several lines
+const maxWrappedLines = 20
+
+// processFile streams the uploaded file line by line and feeds every entry into the analysis.
+// source names the file or archive member the entries came from.
+func processFile(file io.Reader, source string, parser *lineParser, analysis *logAnalysis) error {
+	return readLogEntries(file, source, parser, analysis, analysis.add)
+}
+
+// readLogEntries streams a file line by line and hands every entry to emit. Lines that are
+// rejected or excluded are recorded in the analysis. Files in another encoding are converted to UTF-8 first.
+func readLogEntries(file io.Reader, source string, parser *lineParser, analysis *logAnalysis, emit func(LogEvent, lineRef) error) error {
+	analysis.sources = append(analysis.sources, source)
+
+	assembler := &entryAssembler{parser: parser.forFile(), source: source, analysis: analysis, emit: emit, timestamps: newTimestampParser(parser.location)}
+	reader := bufio.NewReaderSize(decodeText(file, parser.encoding), 64*1024)
+	lineNumber := 0
+	for {
+		line, tooLong, err := readLine(reader)
+		if tooLong {
+			lineNumber++
+			analysis.diagnostics.record(lineRef{source: source, number: lineNumber, raw: line[:maxSkippedLinePreview]}, reasonLineTooLong)
+			analysis.progress.reject()
+		} else if len(line) > 0 {
+			lineNumber++
+			at := lineRef{source: source, number: lineNumber, raw: strings.TrimRight(line, "\r\n")}
+			if addErr := assembler.addLine(at); addErr != nil {
+				return addErr
+			}
+		}
+		if err == io.EOF {
+			return assembler.flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readLine reads the next line including its line break. Of a line longer than maxLineBytes only
+// the first maxLineBytes are returned, together with tooLong, and the rest is skipped.
+func readLine(reader *bufio.Reader) (line string, tooLong bool, err error) {
+	var buf []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(buf)+len(chunk) > maxLineBytes {
+			buf = append(buf, chunk[:maxLineBytes-len(buf)]...)
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			return string(buf), true, err
+		}
+		buf = append(buf, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(buf), false, err
+		}
+	}
+}
+
+// entryAssembler turns physical lines into log entries. Lines that match no log format are either
+// the rest of a record wrapped over several lines, e.g. a long SQL statement, or continuation lines
+// such as stack trace frames, which are attached to the preceding entry as its Continuation.
+type entryAssembler struct {
+	parser     *lineParser
+	source     string
+	analysis   *logAnalysis                  // Records rejected lines and decides which entries are excluded
+	emit       func(LogEvent, lineRef) error // Receives every assembled entry
+	timestamps *timestampParser
+
+	// The last entry is held back until the next one starts, so continuation lines can still be added
+	pending         *FileDetail
+	pendingFormat   *LogFormat
+	pendingAt       lineRef
+	pendingExcluded bool      // The last entry was excluded, so its continuation lines are dropped too
+	unmatched       []lineRef // Lines since the last entry that matched no format
+}
+
+// addLine assembles a single physical line
+func (e *entryAssembler) addLine(at lineRef) error {
+	if strings.TrimSpace(at.raw) == "" {
+		return nil
+	}
+	if fileDetail, format, ok := e.parser.parse(at.raw); ok {
+		return e.startEntry(fileDetail, format, at, len(e.unmatched))
+	}
+
+	// A wrapped record matches once its first lines are joined with this one, shortest join first
+	for start := len(e.unmatched) - 1; start >= 0; start-- {
+		lines := []string{}
+		for _, wrapped := range e.unmatched[start:] {
+			lines = append(lines, wrapped.raw)
+		}
+		joined := strings.Join(append(lines, at.raw), "\n")
+		if fileDetail, format, ok := e.parser.parse(joined); ok {
+			return e.startEntry(fileDetail, format, lineRef{source: at.source, number: e.unmatched[start].number, raw: joined}, start)
+		}
+	}
+
+	e.unmatched = append(e.unmatched, at)
+	if len(e.unmatched) > maxWrappedLines {
+		e.attachContinuation(e.unmatched[0])
+		e.unmatched = e.unmatched[1:]
+	}
+	return nil
+}
+
+// startEntry attaches the first continuation unmatched lines to the pending entry, hands it to
+// the analysis and holds back the new entry instead
+func (e *entryAssembler) startEntry(fileDetail FileDetail, format *LogFormat, at lineRef, continuation int) error {
+	for _, line := range e.unmatched[:continuation] {
+		e.attachContinuation(line)
+	}
+	e.unmatched = nil
+	if err := e.flushPending(); err != nil {
+		return err
+	}
+
+	// Continuation lines of excluded entries are dropped together with the entry
+	e.pendingExcluded = e.analysis.filter.exclude(fileDetail)
+	if !e.pendingExcluded {
+		fileDetail.Source = e.source
+		e.pending, e.pendingFormat, e.pendingAt = &fileDetail, format, at
+	}
+	return nil
+}
+
+// holding reports whether lines are held back waiting for the lines that follow them
+func (e *entryAssembler) holding() bool {
+	return e.pending != nil || len(e.unmatched) > 0
+}
+
+// flush attaches the remaining unmatched lines and hands the last entry to the analysis
+func (e *entryAssembler) flush() error {
+	for _, line := range e.unmatched {
+		e.attachContinuation(line)
+	}
+	e.unmatched = nil
+	return e.flushPending()
+}
+
+func (e *entryAssembler) flushPending() error {
+	if e.pending == nil {
+		return nil
+	}
+
+	// Fields are typed once here so every handler works with the same parsed values
+	event := newLogEvent(*e.pending)
+	if t, ok := e.timestamps.parse(event.Timestamp, e.pendingFormat.TimestampLayout); ok {
+		event.Time = t
+	} else {
+		e.analysis.diagnostics.record(e.pendingAt, reasonInvalidTimestamp)
+	}
+	if event.needsDuration() && !event.HasDuration {
+		e.analysis.diagnostics.record(e.pendingAt, reasonInvalidDuration)
+	}
+
+	err := e.emit(event, e.pendingAt)
+	e.pending = nil
+	return err
+}
+
+// attachContinuation adds a continuation line to the pending entry, truncating overly long continuations.
+// Lines before the first entry have nothing to attach to, and lines that start like a record of their
+// own but match no format are not continuations, both are rejected.
+func (e *entryAssembler) attachContinuation(at lineRef) {
+	if (e.pending == nil && !e.pendingExcluded) || looksLikeRecord(at.raw) {
+		e.analysis.diagnostics.record(at, reasonNoFormat)
+		e.analysis.progress.reject()
+		return
+	}
+	if e.pending == nil {
+		return // Continuation lines of excluded entries are dropped with the entry
+	}
+	line := at.raw
+	if len(e.pending.Continuation) >= maxContinuationBytes {
+		e.analysis.diagnostics.record(at, reasonContinuationTruncated)
+		return
+	}
+	if e.pending.Continuation != "" {
+		e.pending.Continuation += "\n"
+	}
+	if remaining := maxContinuationBytes - len(e.pending.Continuation); len(line) > remaining {
+		e.analysis.diagnostics.record(at, reasonContinuationTruncated)
+		line = line[:remaining]
+	}
+	e.pending.Continuation += line
+}
+
+// looksLikeRecord reports whether a line that matches no format is a log record of its own, an
+// NDJSON object or a line starting with a timestamp, rather than e.g. a stack trace frame
+func looksLikeRecord(line string) bool {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") && json.Valid([]byte(line)) {
+		return true
+	}
+	return startsWithTimestamp(line)
+}
+
+// add hands a single log entry to the session writer and counts it in the statistics. The entry
+// of a sampled analysis is saved with the sample's scale, so its counts can be estimated again when
+// the session is rebuilt. It is called like any emit function, but problems with the entry's line, e.g. an invalid duration, are
+// recorded while the line is parsed, since its text is not kept until merged entries are added.
+func (a *logAnalysis) add(event LogEvent, at lineRef) error {
+	if a.sampler != nil {
+		event.SampleScale = max(event.SampleScale, 1) * a.sampler.scale()
+	}
+	if a.session != nil {
+		if err := a.session.Write(event); err != nil {
+			return err
+		}
+	}
+	a.count(event)
+	return nil
+}
+
+// count updates every statistic with a single log entry. Entries of a sample with another scale
+// than the analysis' own are counted in a part of their own.
+func (a *logAnalysis) count(event LogEvent) {
+	if event.SampleScale != a.sampleScale() {
+		part := a.sampledParts[event.SampleScale]
+		if part == nil {
+			part = newLogAnalysis(nil, nil, nil)
+			part.bucketDuration = a.bucketDuration
+			part.partScale = event.SampleScale
+			if a.sampledParts == nil {
+				a.sampledParts = map[float64]*logAnalysis{}
+			}
+			a.sampledParts[event.SampleScale] = part
+		}
+		part.count(event)
+		return
+	}
+
+	a.addToTimeBucket(event)
+
+	switch event.Kind {
+	case CallHTTPRequest:
+		a.totalHTTPRequests++
+
+	case CallHTTPResponse:
+		a.httpResponses.add(event)
+		a.totalHTTPResponses++
+
+		if !event.HasDuration {
+			return // Skip invalid durations
+		}
+		duration := event.DurationMillis
+		a.durations.add(duration)
+
+		// Initialize stats for this request path if not already
+		stats, exists := a.pathStats[event.RequestPath]
+		if !exists {
+			stats = &RequestPathStats{MaxTime: duration, MinTime: duration}
+			a.pathStats[event.RequestPath] = stats
+		}
+		stats.Count++
+		stats.TotalTime += duration
+		stats.durations.add(duration)
+		stats.AverageTime = stats.TotalTime / float64(stats.Count)
+		if duration > stats.MaxTime {
+			stats.MaxTime = duration
+		}
+		if duration < stats.MinTime {
+			stats.MinTime = duration
+		}
+
+	default:
+		query := strings.TrimSpace(event.RequestQuery)
+		if query == "" {
+			return // Skip empty queries
+		}
+
+		// Queries are listed even when none of their durations can be parsed
+		metrics, exists := a.queryMetrics[query]
+		if !exists {
+			metrics = &QueryMetrics{MaxTime: 0, MinTime: 1e9}
+			a.queryMetrics[query] = metrics
+		}
+
+		if !event.HasDuration {
+			return // Skip invalid durations
+		}
+		duration := event.DurationMillis
+		metrics.Count++
+		metrics.TotalTime += duration
+		metrics.AverageTime = metrics.TotalTime / float64(metrics.Count)
+		metrics.durations.add(duration)
+		if duration > metrics.MaxTime {
+			metrics.MaxTime = duration
+		}
+		if duration < metrics.MinTime {
+			metrics.MinTime = duration
+		}
+	}
+}
+
+// addToTimeBucket counts the entry in its time bucket and keeps the response duration for the bucket stats.
+// Entries without a valid timestamp are left out of the timeline.
+func (a *logAnalysis) addToTimeBucket(event LogEvent) {
+	if event.Time.IsZero() {
+		return
+	}
+
+	bucketTime := event.Time.Truncate(a.bucketDuration).Format("15:04:05")
+
+	// Initialize a new bucket if one doesn't already exist for this time
+	bucket, exists := a.timeBuckets[bucketTime]
+	if !exists {
+		bucket = &TimeBucketStats{}
+		a.timeBuckets[bucketTime] = bucket
+	}
+
+	switch event.Kind {
+	case CallHTTPRequest:
+		bucket.RequestCount++
+
+	case CallHTTPResponse:
+		bucket.ResponseCount++
+
+		// Add duration to the bucket's sketch for stats calculation
+		if event.HasDuration {
+			bucket.durations.add(event.DurationMillis)
+		}
+	}
+}
+
+// finish computes the percentiles and averages once all lines have been added. The counts of a
+// sampled analysis are scaled to estimates for the whole upload.
+func (a *logAnalysis) finish() {
+	a.computeStats()
+	a.applySampleScale()
+
+	// Print global stats
+	if a.durations.count > 0 {
+		fmt.Printf("Total HTTP-IN-Requests: %d\n", a.totalHTTPRequests)
+		fmt.Printf("Total HTTP-IN-Responses: %d\n", a.totalHTTPResponses)
+		fmt.Printf("Overall Average Duration: %.2f ms\n", a.durations.mean())
+		fmt.Printf("Overall 95th Percentile Duration: %.2f ms\n", a.durations.percentile(0.95))
+	}
+
+	// Every request should be answered by a response, the counts stand in for matching correlation IDs
+	if a.totalHTTPResponses >= a.totalHTTPRequests {
+		fmt.Println("✅ All requests have matching responses in this file.")
+	} else {
+		fmt.Println("⚠️  Not all requests have matching responses. Some responses might be in another file.")
+	}
+}
+
+// computeStats computes the percentiles and averages of the statistics collected so far
+func (a *logAnalysis) computeStats() {
+	for _, stats := range a.pathStats {
+		updateRequestPathPercentile(stats)
+	}
+	for _, metrics := range a.queryMetrics {
+		updateQueryPercentile(metrics)
+	}
+
+	// Compute stats for responses
+	for _, bucket := range a.timeBuckets {
+		updateTimeBucketStats(bucket)
+	}
+}
+
+// mergeTotals adds the time buckets and overall counters of batch, so an analysis can keep
+// running totals over the batches of a followed file
+func (a *logAnalysis) mergeTotals(batch *logAnalysis) {
+	for key, stats := range batch.timeBuckets {
+		bucket, exists := a.timeBuckets[key]
+		if !exists {
+			a.timeBuckets[key] = stats
+			continue
+		}
+		bucket.RequestCount += stats.RequestCount
+		bucket.ResponseCount += stats.ResponseCount
+		bucket.durations.merge(stats.durations)
+		updateTimeBucketStats(bucket)
+	}
+
+	a.totalHTTPRequests += batch.totalHTTPRequests
+	a.totalHTTPResponses += batch.totalHTTPResponses
+	a.durations.merge(batch.durations)
+}
+
+// overallStats returns the average and 95th percentile over all HTTP responses of the upload
+func (a *logAnalysis) overallStats() OverallStats {
+	overallAvg, overallPercentile := a.durations.mean(), a.durations.percentile(0.95)
+
+	//Generate a completion message based on request-reponse count
+	completionMessage := ""
+	if a.totalHTTPRequests == a.totalHTTPResponses {
+		completionMessage = "✅ All requests are completed in this file."
+	} else {
+		completionMessage = "⚠️ Not all requests are completed in this file. Some responses might be in another file."
+	}
+
+	// Entries of a sampled session that was imported keep their scale, but not how they were sampled
+	sample := a.sampler.String()
+	if a.estimated && sample == "" {
+		sample = "some of the correlation IDs"
+	}
+
+	return OverallStats{
+		Average:            overallAvg,
+		Percentile:         overallPercentile,
+		TotalHTTPRequests:  a.totalHTTPRequests,
+		TotalHTTPResponses: a.totalHTTPResponses,
+		CompletionMessage:  completionMessage,
+		Estimated:          a.estimated,
+		Sample:             sample,
+	}
+}
+
+// mergeIntoTab adds the request path and query statistics of the analysis to the stats kept for tabUUID.
+// This is the only place an analysis touches state shared between requests. New paths and queries are
+// copied, so the tab never holds on to the statistics of an upload.
+func (a *logAnalysis) mergeIntoTab(tabUUID string) {
+	tabStatsMu.Lock()
+	defer tabStatsMu.Unlock()
+
+	//Initialize stats maps for this tab if not already present
+	if _, exists := requestPathStats[tabUUID]; !exists {
+		requestPathStats[tabUUID] = map[string]*RequestPathStats{}
+	}
+	if _, exists := queryMetricsMap[tabUUID]; !exists {
+		queryMetricsMap[tabUUID] = map[string]*QueryMetrics{}
+	}
+	mergePathStats(requestPathStats[tabUUID], a.pathStats)
+	mergeQueryMetrics(queryMetricsMap[tabUUID], a.queryMetrics)
+}
+
+// mergePathStats adds the request path statistics of from to into, copying paths that are new to it
+func mergePathStats(into, from map[string]*RequestPathStats) {
+	for path, stats := range from {
+		existing, exists := into[path]
+		if !exists {
+			stats := *stats
+			stats.durations = stats.durations.clone()
+			into[path] = &stats
+			continue
+		}
+		existing.Count += stats.Count
+		existing.TotalTime += stats.TotalTime
+		existing.durations.merge(stats.durations)
+		existing.AverageTime = existing.TotalTime / float64(existing.Count)
+		existing.MaxTime = max(existing.MaxTime, stats.MaxTime)
+		existing.MinTime = min(existing.MinTime, stats.MinTime)
+		existing.Estimated = existing.Estimated || stats.Estimated
+		updateRequestPathPercentile(existing)
+	}
+}
+
+// mergeQueryMetrics adds the query metrics of from to into, copying queries that are new to it
+func mergeQueryMetrics(into, from map[string]*QueryMetrics) {
+	for query, metrics := range from {
+		existing, exists := into[query]
+		if !exists {
+			metrics := *metrics
+			metrics.durations = metrics.durations.clone()
+			into[query] = &metrics
+			continue
+		}
+		existing.Count += metrics.Count
+		existing.TotalTime += metrics.TotalTime
+		existing.durations.merge(metrics.durations)
+		if existing.Count > 0 {
+			existing.AverageTime = existing.TotalTime / float64(existing.Count)
+		}
+		existing.MaxTime = max(existing.MaxTime, metrics.MaxTime)
+		existing.MinTime = min(existing.MinTime, metrics.MinTime)
+		existing.Estimated = existing.Estimated || metrics.Estimated
+		updateQueryPercentile(existing)
+	}
+}
+
+// maxSlowestResponses caps how many HTTP responses an analysis keeps for the slowest requests table
+const maxSlowestResponses = 1000
+
+// slowestResponses keeps the slowest HTTP responses in a min-heap ordered by duration, so memory stays
+// bounded however many responses a file has. Responses without a valid duration count as the fastest.
+type slowestResponses []LogEvent
+
+func (h slowestResponses) Len() int            { return len(h) }
+func (h slowestResponses) Less(i, j int) bool  { return h[i].DurationMillis < h[j].DurationMillis }
+func (h slowestResponses) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slowestResponses) Push(x interface{}) { *h = append(*h, x.(LogEvent)) }
+func (h *slowestResponses) Pop() interface{} {
+	old := *h
+	event := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return event
+}
+
+// add keeps the response if it is among the slowest seen so far
+func (h *slowestResponses) add(event LogEvent) {
+	if h.Len() < maxSlowestResponses {
+		heap.Push(h, event)
+	} else if event.DurationMillis > (*h)[0].DurationMillis {
+		(*h)[0] = event
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted returns the kept responses, the slowest first
+func (h slowestResponses) sorted() []LogEvent {
+	events := append([]LogEvent(nil), h...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].DurationMillis > events[j].DurationMillis })
+	return events
+}
+
+// updateTimeBucketStats calculates the average and 95th percentile duration of a time bucket
+func updateTimeBucketStats(bucket *TimeBucketStats) {
+	if bucket.durations.count == 0 {
+		return
+	}
+	bucket.AvgDuration = bucket.durations.mean()
+	bucket.Percentile95 = bucket.durations.percentile(0.95)
+}
+
+// updateRequestPathPercentile calculates the 95th percentile for a request path
+func updateRequestPathPercentile(stats *RequestPathStats) {
+	if stats.durations.count > 0 {
+		stats.Percentile = stats.durations.percentile(0.95)
+	}
+}
+
+// updateQueryPercentile calculates the 95th percentile for a query
+func updateQueryPercentile(metrics *QueryMetrics) {
+	n := metrics.durations.count
+	if n > 0 {
+		index := int(float64(n)*0.95+0.5) - 1
+		if index >= n {
+			index = n - 1
+		}
+		metrics.Percentile = metrics.durations.valueAt(index)
+	}
+}
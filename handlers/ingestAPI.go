@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxIngestBodyBytes caps the size of a single ingest request after decompression
+const maxIngestBodyBytes = 64 << 20
+
+// ingestSource is the source shown for entries pushed through the ingest API
+const ingestSource = "api/ingest"
+
+// ndjsonWrapperKeys are the fields log shippers put the raw log line in, e.g. "log" for Fluent Bit
+// and "message" for Vector
+var ndjsonWrapperKeys = []string{"log", "message"}
+
+// IngestResult acknowledges an ingest request
+type IngestResult struct {
+	Session  string `json:"session"`
+	Accepted int    `json:"accepted"` // Entries added to the session
+	Rejected int    `json:"rejected"` // Lines that matched no log format
+	Partial  int    `json:"partial"`  // Lines of accepted entries with an invalid timestamp or duration, or a truncated continuation
+	Excluded int    `json:"excluded"` // Entries dropped by the filter rules
+}
+
+// IngestAPIHandler appends log lines pushed by a log shipper to a session. The body holds raw log
+// lines, or an NDJSON batch if the content type is application/x-ndjson, and may be gzip encoded.
+// The log format, time zone and encoding are selected with the logFormat, timeZone and encoding
+// query parameters.
+// Every request is parsed on its own, so continuation lines must arrive with their entry.
+func IngestAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	session := query.Get("session")
+	if err := validateSessionID(session); err != nil {
+		http.Error(w, "Invalid session name, use letters, digits, '.', '_' and '-'", http.StatusBadRequest)
+		return
+	}
+	location, err := time.LoadLocation(query.Get("timeZone"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown time zone: %v", err), http.StatusBadRequest)
+		return
+	}
+	parser, err := newLineParser(query.Get("logFormat"), location)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unknown log format: %v", err), http.StatusBadRequest)
+		return
+	}
+	if parser.encoding, err = findTextEncoding(query.Get("encoding")); err != nil {
+		http.Error(w, fmt.Sprintf("Unknown encoding: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxIngestBodyBytes)
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(w, gz, maxIngestBodyBytes)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-ndjson" {
+		// The records are decoded before they are read as JSON, the extracted lines are UTF-8
+		body = decodeText(body, parser.encoding)
+		parser.encoding = nil
+		body, err = ndjsonLines(body, parser)
+		if err != nil {
+			writeIngestError(w, err)
+			return
+		}
+	}
+
+	// Diagnostics of earlier batches are kept, the report covers everything pushed to the session
+	filter := newRuleFilter(filterRules)
+	analysis, err := newSessionAnalysis(session, filter, true)
+	if err != nil {
+		log.Printf("Error opening session file for %s: %v\n", session, err)
+		http.Error(w, "Error saving the log lines", http.StatusInternalServerError)
+		return
+	}
+	existing := analysis.session.Count()
+	if err := processFile(body, ingestSource, parser, analysis); err != nil {
+		analysis.abort()
+		writeIngestError(w, err)
+		return
+	}
+	analysis.computeStats()
+	if err := analysis.commit(); err != nil {
+		log.Printf("Error saving JSON file for %s: %v\n", session, err)
+		http.Error(w, "Error saving the log lines", http.StatusInternalServerError)
+		return
+	}
+
+	result := IngestResult{
+		Session:  session,
+		Accepted: analysis.session.Count() - existing,
+		Rejected: analysis.diagnostics.reasons[reasonNoFormat],
+	}
+	result.Partial = analysis.diagnostics.Total - result.Rejected
+	for _, exclusion := range filter.exclusions() {
+		result.Excluded += exclusion.Count
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Error writing ingest result: %v\n", err)
+	}
+}
+
+// writeIngestError reports a request body that could not be read
+func writeIngestError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, gzip.ErrChecksum), errors.Is(err, gzip.ErrHeader), errors.Is(err, io.ErrUnexpectedEOF):
+		http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+	default:
+		log.Printf("Error reading ingest request: %v\n", err)
+		http.Error(w, "Error reading the request body", http.StatusInternalServerError)
+	}
+}
+
+// ndjsonLines extracts the log lines from an NDJSON batch. Records either wrap the raw line in one of
+// the ndjsonWrapperKeys or are structured log entries that are read by a JSON log format.
+func ndjsonLines(body io.Reader, parser *lineParser) (io.Reader, error) {
+	var lines bytes.Buffer
+	reader := bufio.NewReaderSize(body, 64*1024)
+	for {
+		record, err := reader.ReadString('\n')
+		if record = strings.TrimSpace(record); record != "" {
+			lines.WriteString(ndjsonLine(record, parser))
+			lines.WriteByte('\n')
+		}
+		if err == io.EOF {
+			return &lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ndjsonLine returns the log line of a single NDJSON record. Records that are not JSON are kept
+// as they are and rejected later if no log format reads them.
+func ndjsonLine(record string, parser *lineParser) string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(record), &object); err != nil {
+		return record
+	}
+	for _, key := range ndjsonWrapperKeys {
+		var line string
+		if raw, ok := object[key]; !ok || json.Unmarshal(raw, &line) != nil {
+			continue
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		// A structured entry may have a message field of its own
+		if _, _, ok := parser.parse(line); !ok {
+			if _, _, ok := parser.parse(record); ok {
+				return record
+			}
+		}
+		return line
+	}
+	return record
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IngestOptions configures the ingestion of log files from the local file system
+type IngestOptions struct {
+	Session   string // Name of the session, the web UI reads it as the tab UUID
+	LogFormat string // Empty auto-detects the format of every line
+	TimeZone  string // Zone of timestamps without an offset, empty means UTC
+	Encoding  string // Encoding of files without a byte order mark, empty means UTF-8
+	RulesFile string // Filter rules written one per line, empty uses the configured rules
+
+	// At most one of them is set to analyze only a sample of the requests
+	SampleEvery   int     // Keep about 1 in N correlation IDs
+	SamplePercent float64 // Keep this percentage of the correlation IDs
+}
+
+// IngestFiles parses the log files matched by patterns into the session named options.Session,
+// the same session an upload through the web UI writes. A pattern may be a file, a directory, which is
+// read recursively, or a glob. Archives are unpacked like uploaded ones.
+func IngestFiles(options IngestOptions, patterns []string) error {
+	if err := validateSessionID(options.Session); err != nil {
+		return fmt.Errorf("%q: %w", options.Session, err)
+	}
+
+	location, err := time.LoadLocation(options.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone: %w", err)
+	}
+	parser, err := newLineParser(options.LogFormat, location)
+	if err != nil {
+		return err
+	}
+	if parser.encoding, err = findTextEncoding(options.Encoding); err != nil {
+		return err
+	}
+	rules := filterRules
+	if options.RulesFile != "" {
+		text, err := os.ReadFile(options.RulesFile)
+		if err != nil {
+			return fmt.Errorf("error reading filter rules: %w", err)
+		}
+		if rules, err = parseFilterRules(string(text)); err != nil {
+			return fmt.Errorf("invalid filter rules in %s: %w", options.RulesFile, err)
+		}
+	}
+
+	sampler, err := newCorrelationSampler(options.SampleEvery, options.SamplePercent)
+	if err != nil {
+		return err
+	}
+
+	paths, err := expandLogPaths(patterns)
+	if err != nil {
+		return err
+	}
+
+	analysis, err := newSessionAnalysis(options.Session, newRuleFilter(rules), false)
+	if err != nil {
+		return err
+	}
+	analysis.sampler = sampler
+	merger := newSourceMerger(analysis)
+	merger.direct = len(paths) == 1 && isSingleLocalLogFile(paths[0])
+	defer merger.close()
+	var jobs []parseJob
+	for _, path := range paths {
+		jobs = append(jobs, func(merger *sourceMerger) error {
+			if err := ingestLocalFile(path, parser, merger); err != nil {
+				return fmt.Errorf("error processing %s: %w", path, err)
+			}
+			return nil
+		})
+	}
+	if err := merger.parseFiles(jobs); err != nil {
+		analysis.abort()
+		return err
+	}
+	if err := merger.merge(context.Background()); err != nil {
+		analysis.abort()
+		return err
+	}
+	analysis.finish()
+	if err := analysis.commit(); err != nil {
+		return err
+	}
+
+	stats := analysis.overallStats()
+	fmt.Printf("Ingested %d log files into %s\n", len(analysis.sources), analysis.session.Name())
+	fmt.Printf("HTTP requests: %d, HTTP responses: %d, lines rejected or partially parsed: %d, duplicates dropped: %d\n",
+		stats.TotalHTTPRequests, stats.TotalHTTPResponses, analysis.diagnostics.Total, merger.Duplicates)
+	if stats.Estimated {
+		fmt.Printf("Request and response counts are estimated from a sample of %s\n", stats.Sample)
+	}
+	return nil
+}
+
+// ingestLocalFile feeds a file, or every log file inside an archive, into the merger
+func ingestLocalFile(path string, parser *lineParser, merger *sourceMerger) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return forEachLogFile(path, file, info.Size(), func(source string, r io.Reader) error {
+		return merger.processFile(r, source, parser)
+	})
+}
+
+// isSingleLocalLogFile reports whether path is a single log file rather than an archive of several
+func isSingleLocalLogFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return isSingleLogFile(file, info.Size())
+}
+
+// expandLogPaths resolves files, directories and globs into a list of files. Files are listed once,
+// in the order of the patterns, and the files of a directory or glob are sorted by name.
+func expandLogPaths(patterns []string) ([]string, error) {
+	var paths []string
+	seen := map[string]bool{}
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, pattern := range patterns {
+		matches := []string{pattern}
+		if _, err := os.Stat(pattern); err != nil {
+			// Patterns the shell did not expand, e.g. quoted ones, are expanded here
+			if !strings.ContainsAny(pattern, "*?[") {
+				return nil, err
+			}
+			if matches, err = filepath.Glob(pattern); err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", pattern)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+			var files []string
+			err = filepath.WalkDir(match, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if entry.Type().IsRegular() {
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(files)
+			for _, file := range files {
+				add(file)
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no log files to ingest")
+	}
+	return paths, nil
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDiagnostics returns diagnostics that keep their samples and discard the report
+func testDiagnostics() *parseDiagnostics {
+	return &parseDiagnostics{reasons: map[string]int{}, report: csv.NewWriter(io.Discard)}
+}
+
+// parseTestLog reads a log with the given format, empty auto-detecting it, and returns the
+// assembled entries together with the diagnostics of its lines
+func parseTestLog(t *testing.T, format, log string) ([]LogEvent, *parseDiagnostics) {
+	t.Helper()
+	parser, err := newLineParser(format, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagnostics := testDiagnostics()
+	analysis := newLogAnalysis(nil, diagnostics, nil)
+	var events []LogEvent
+	err = readLogEntries(strings.NewReader(log), "app.log", parser, analysis, func(event LogEvent, at lineRef) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readLogEntries: %v", err)
+	}
+	return events, diagnostics
+}
+
+// diagnosticLines returns "line: reason" for every recorded diagnostic
+func diagnosticLines(diagnostics *parseDiagnostics) []string {
+	var lines []string
+	for _, sample := range diagnostics.Samples {
+		lines = append(lines, fmt.Sprintf("%d: %s", sample.Line, sample.Reason))
+	}
+	return lines
+}
+
+func TestReadLogEntriesSkipsLongLines(t *testing.T) {
+	entry := "2024-05-01 10:00:00,000|c1|t1|12|HTTP-In-Response|2024-05-01 10:00:00,000|handle||/api/orders"
+	log := entry + "\n" +
+		strings.Repeat("x", maxLineBytes-1) + "\n" + // The longest line that is read
+		strings.Repeat("y", 3*maxLineBytes) + "\n" +
+		entry + "\n" +
+		strings.Repeat("z", maxLineBytes+1) // Without a line break at the end of the file
+
+	events, diagnostics := parseTestLog(t, "pipe", log)
+	if len(events) != 2 {
+		t.Fatalf("%d entries, want 2", len(events))
+	}
+	if got := len(events[0].Continuation); got != maxContinuationBytes {
+		t.Errorf("continuation of %d bytes, want the longest line truncated to %d", got, maxContinuationBytes)
+	}
+	// The line after an entry is attached once the next entry starts, as it might have been wrapped
+	want := []string{"3: line too long, skipped", "2: continuation truncated", "5: line too long, skipped"}
+	if got := diagnosticLines(diagnostics); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("diagnostics = %v, want %v", got, want)
+	}
+	for _, sample := range []LineDiagnostic{diagnostics.Samples[0], diagnostics.Samples[2]} {
+		if len(sample.Raw) != maxSkippedLinePreview {
+			t.Errorf("diagnostic of line %d keeps %d bytes of the line, want %d", sample.Line, len(sample.Raw), maxSkippedLinePreview)
+		}
+	}
+}
+
+func TestReadLogEntriesAttachesContinuations(t *testing.T) {
+	entry := func(thread string) string {
+		return "2024-05-01 10:00:00,000|c1|" + thread + "|12|HTTP-In-Response|2024-05-01 10:00:00,000|handle||/api/orders\n"
+	}
+	var frames strings.Builder
+	for i := 0; i < maxWrappedLines+5; i++ {
+		fmt.Fprintf(&frames, "\tat Frame%d\n", i)
+	}
+	tests := []struct {
+		name            string
+		log             string
+		want            []string // Thread ID, query if any and continuation of every entry
+		wantDiagnostics []string
+	}{
+		{
+			name: "stack trace",
+			log:  entry("t1") + "java.lang.IllegalStateException: closed\n\tat Foo.bar(Foo.java:1)\n\n\tat Foo.main(Foo.java:9)\n" + entry("t2"),
+			want: []string{"t1: java.lang.IllegalStateException: closed\n\tat Foo.bar(Foo.java:1)\n\tat Foo.main(Foo.java:9)", "t2: "},
+		},
+		{
+			name: "continuation at the end of the file",
+			log:  entry("t1") + "\tat Foo.bar(Foo.java:1)",
+			want: []string{"t1: \tat Foo.bar(Foo.java:1)"},
+		},
+		{
+			name: "more lines than can be rejoined",
+			log:  entry("t1") + frames.String() + entry("t2"),
+			want: []string{"t1: " + strings.TrimSuffix(frames.String(), "\n"), "t2: "},
+		},
+		{
+			name: "record wrapped over several lines",
+			log: entry("t1") + "2024-05-01 10:00:01,000|c2|t2|7|DB|2024-05-01 10:00:01,000|query|SELECT *\n" +
+				"FROM orders\nWHERE id = 1|/api/orders\n" + entry("t3"),
+			want: []string{"t1: ", "t2 SELECT *\nFROM orders\nWHERE id = 1: ", "t3: "},
+		},
+		{
+			name:            "lines before the first entry",
+			log:             "starting up\n\tat Foo.bar(Foo.java:1)\n" + entry("t1"),
+			want:            []string{"t1: "},
+			wantDiagnostics: []string{"1: line matches no log format", "2: line matches no log format"},
+		},
+		{
+			name:            "record of another format",
+			log:             entry("t1") + "2024-05-01 10:00:01,000 INFO started\n" + `{"level":"info"}` + "\n\tat Foo.bar(Foo.java:1)\n" + entry("t2"),
+			want:            []string{"t1: \tat Foo.bar(Foo.java:1)", "t2: "},
+			wantDiagnostics: []string{"2: line matches no log format", "3: line matches no log format"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, diagnostics := parseTestLog(t, "pipe", test.log)
+			var got []string
+			for _, event := range events {
+				name := event.ThreadId
+				if event.RequestQuery != "" {
+					name += " " + event.RequestQuery
+				}
+				got = append(got, name+": "+event.Continuation)
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+				t.Errorf("entries = %q, want %q", got, test.want)
+			}
+			if got := diagnosticLines(diagnostics); fmt.Sprint(got) != fmt.Sprint(test.wantDiagnostics) {
+				t.Errorf("diagnostics = %v, want %v", got, test.wantDiagnostics)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CallKind classifies the call type of a log entry
+type CallKind int
+
+const (
+	CallUntyped      CallKind = iota // Entry saved before call types were classified at ingest
+	CallHTTPRequest                  // HTTP-In-Request
+	CallHTTPResponse                 // HTTP-In-Response
+	CallInternal                     // Every other call type, e.g. queries and outgoing calls
+)
+
+// callKindNames are the names used for call kinds in session files
+var callKindNames = map[CallKind]string{
+	CallHTTPRequest:  "httpRequest",
+	CallHTTPResponse: "httpResponse",
+	CallInternal:     "internal",
+}
+
+// LogEvent is a log entry with its fields parsed into typed values. It is produced once at ingest
+// and saved to the session file, so handlers never have to parse the original strings again.
+type LogEvent struct {
+	FileDetail
+	Time           time.Time `json:"time"`        // Zero if the timestamp could not be parsed
+	DurationMillis float64   `json:"durationMs"`  // Only meaningful if HasDuration is set
+	HasDuration    bool      `json:"hasDuration"` // The duration field held a valid number
+	Kind           CallKind  `json:"callKind"`
+	SampleScale    float64   `json:"sampleScale,omitempty"` // The upload was sampled, the entry stands for this many; 0 if it was not
+}
+
+// newLogEvent types the fields of a parsed entry. The timestamp is normalized by the caller,
+// which knows the layout and time zone of the file.
+func newLogEvent(fileDetail FileDetail) LogEvent {
+	event := LogEvent{FileDetail: fileDetail, Kind: classifyCallType(fileDetail.CallType)}
+	if duration, err := strconv.ParseFloat(fileDetail.TotalDurationForRequest, 64); err == nil {
+		event.DurationMillis = duration
+		event.HasDuration = true
+	}
+	return event
+}
+
+// classifyCallType maps a call type string onto its kind, ignoring case
+func classifyCallType(callType string) CallKind {
+	switch {
+	case strings.EqualFold(callType, "HTTP-In-Request"):
+		return CallHTTPRequest
+	case strings.EqualFold(callType, "HTTP-In-Response"):
+		return CallHTTPResponse
+	default:
+		return CallInternal
+	}
+}
+
+// Duration returns the duration of the entry
+func (e LogEvent) Duration() time.Duration {
+	return time.Duration(e.DurationMillis * float64(time.Millisecond))
+}
+
+// IsHTTP reports whether the entry is an HTTP-In-Request or HTTP-In-Response
+func (e LogEvent) IsHTTP() bool {
+	return e.Kind == CallHTTPRequest || e.Kind == CallHTTPResponse
+}
+
+// needsDuration reports whether the statistics use the duration of the entry: responses and
+// internal calls with a query
+func (e LogEvent) needsDuration() bool {
+	switch e.Kind {
+	case CallHTTPRequest:
+		return false
+	case CallHTTPResponse:
+		return true
+	default:
+		return strings.TrimSpace(e.RequestQuery) != ""
+	}
+}
+
+// ensureTyped fills in the typed fields of an entry read from a session file written
+// before entries were typed at ingest
+func (e *LogEvent) ensureTyped() {
+	if e.Kind != CallUntyped {
+		return
+	}
+	typed := newLogEvent(e.FileDetail)
+	typed.Time = e.Time
+	if typed.Time.IsZero() {
+		typed.Time, _ = parseTimestamp(typed.Timestamp)
+	}
+	*e = typed
+}
+
+// MarshalJSON writes the call kind by name
+func (k CallKind) MarshalJSON() ([]byte, error) {
+	name, ok := callKindNames[k]
+	if !ok {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(name)
+}
+
+// UnmarshalJSON reads a call kind written by MarshalJSON
+func (k *CallKind) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	if name == "" {
+		*k = CallUntyped
+		return nil
+	}
+	for kind, kindName := range callKindNames {
+		if kindName == name {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown call kind: %s", name)
+}
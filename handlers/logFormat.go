@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogFormat describes how a log line is split into the fields of a FileDetail.
+// A format either splits lines on a delimiter and picks fields by position,
+// matches a regular expression whose named capture groups are the field names,
+// or decodes each line as a JSON object and reads the fields from the configured keys.
+type LogFormat struct {
+	Name            string            `json:"name"`
+	Delimiter       string            `json:"delimiter,omitempty"`
+	Fields          map[string]int    `json:"fields,omitempty"`          // Field name -> zero based column for delimited formats
+	Pattern         string            `json:"pattern,omitempty"`         // Regular expression with named capture groups
+	JSONKeys        map[string]string `json:"jsonKeys,omitempty"`        // Field name -> JSON key, nested keys are separated by dots
+	TimestampLayout string            `json:"timestampLayout,omitempty"` // Go time layout of the timestamp field, or "epoch"; detected per file when empty
+
+	regex     *regexp.Regexp
+	minFields int
+}
+
+// logFormatConfig is the layout of the log format config file
+type logFormatConfig struct {
+	Formats []*LogFormat `json:"formats"`
+}
+
+// defaultLogFormat is the 9-field pipe layout used when no config file is present
+var defaultLogFormat = &LogFormat{
+	Name:      "pipe",
+	Delimiter: "|",
+	Fields: map[string]int{
+		"timestamp":               0,
+		"correlationId":           1,
+		"threadId":                2,
+		"totalDurationForRequest": 3,
+		"callType":                4,
+		"startTime":               5,
+		"methodName":              6,
+		"requestQuery":            7,
+		"requestPath":             8,
+	},
+}
+
+// logFormats holds the registered formats in the order they are tried when auto-detecting
+var logFormats = []*LogFormat{defaultLogFormat}
+
+// fileDetailSetters maps the field names used in format definitions onto FileDetail fields
+var fileDetailSetters = map[string]func(*FileDetail, string){
+	"timestamp":               func(f *FileDetail, v string) { f.Timestamp = v },
+	"correlationId":           func(f *FileDetail, v string) { f.CorrelationId = v },
+	"threadId":                func(f *FileDetail, v string) { f.ThreadId = v },
+	"totalDurationForRequest": func(f *FileDetail, v string) { f.TotalDurationForRequest = v },
+	"callType":                func(f *FileDetail, v string) { f.CallType = v },
+	"startTime":               func(f *FileDetail, v string) { f.StartTime = v },
+	"methodName":              func(f *FileDetail, v string) { f.MethodName = v },
+	"requestQuery":            func(f *FileDetail, v string) { f.RequestQuery = v },
+	"requestPath":             func(f *FileDetail, v string) { f.RequestPath = v },
+}
+
+func init() {
+	if err := defaultLogFormat.compile(); err != nil {
+		panic(err)
+	}
+}
+
+// LoadLogFormats replaces the registered formats with the ones defined in the given JSON config file.
+// The built-in pipe format stays registered unless the file defines a format with the same name.
+func LoadLogFormats(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var config logFormatConfig
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return fmt.Errorf("error decoding log formats from %s: %w", fileName, err)
+	}
+
+	formats := []*LogFormat{}
+	seen := map[string]bool{}
+	for _, format := range config.Formats {
+		if err := format.compile(); err != nil {
+			return fmt.Errorf("invalid log format in %s: %w", fileName, err)
+		}
+		if seen[format.Name] {
+			return fmt.Errorf("duplicate log format %q in %s", format.Name, fileName)
+		}
+		seen[format.Name] = true
+		formats = append(formats, format)
+	}
+	if !seen[defaultLogFormat.Name] {
+		formats = append(formats, defaultLogFormat)
+	}
+
+	logFormats = formats
+	return nil
+}
+
+// LogFormatNames returns the names of the registered formats
+func LogFormatNames() []string {
+	var names []string
+	for _, format := range logFormats {
+		names = append(names, format.Name)
+	}
+	return names
+}
+
+// findLogFormat returns the registered format with the given name
+func findLogFormat(name string) (*LogFormat, bool) {
+	for _, format := range logFormats {
+		if format.Name == name {
+			return format, true
+		}
+	}
+	return nil, false
+}
+
+// compile validates the format definition and prepares it for parsing
+func (f *LogFormat) compile() error {
+	if f.Name == "" {
+		return fmt.Errorf("log format without a name")
+	}
+	kinds := 0
+	for _, defined := range []bool{f.Delimiter != "", f.Pattern != "", len(f.JSONKeys) > 0} {
+		if defined {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("log format %q must define exactly one of a delimiter, a pattern or JSON keys", f.Name)
+	}
+
+	if len(f.JSONKeys) > 0 {
+		for name, key := range f.JSONKeys {
+			if _, known := fileDetailSetters[name]; !known {
+				return fmt.Errorf("log format %q: unknown field %q", f.Name, name)
+			}
+			if key == "" {
+				return fmt.Errorf("log format %q: empty JSON key for field %q", f.Name, name)
+			}
+		}
+		return nil
+	}
+
+	if f.Pattern != "" {
+		regex, err := regexp.Compile(f.Pattern)
+		if err != nil {
+			return fmt.Errorf("log format %q: %w", f.Name, err)
+		}
+		for _, group := range regex.SubexpNames() {
+			if _, known := fileDetailSetters[group]; group != "" && !known {
+				return fmt.Errorf("log format %q: unknown field %q in pattern", f.Name, group)
+			}
+		}
+		f.regex = regex
+		return nil
+	}
+
+	if len(f.Fields) == 0 {
+		return fmt.Errorf("log format %q does not map any fields", f.Name)
+	}
+	f.minFields = 0
+	for name, column := range f.Fields {
+		if _, known := fileDetailSetters[name]; !known {
+			return fmt.Errorf("log format %q: unknown field %q", f.Name, name)
+		}
+		if column < 0 {
+			return fmt.Errorf("log format %q: negative column for field %q", f.Name, name)
+		}
+		if column+1 > f.minFields {
+			f.minFields = column + 1
+		}
+	}
+	return nil
+}
+
+// parse fills a FileDetail from a line, returning false if the line does not match the format
+func (f *LogFormat) parse(line string) (FileDetail, bool) {
+	if len(f.JSONKeys) > 0 {
+		return f.parseJSON(line)
+	}
+
+	var fileDetail FileDetail
+	if f.regex != nil {
+		match := f.regex.FindStringSubmatch(line)
+		if match == nil {
+			return FileDetail{}, false
+		}
+		for i, group := range f.regex.SubexpNames() {
+			if group != "" {
+				fileDetailSetters[group](&fileDetail, strings.TrimSpace(match[i]))
+			}
+		}
+		return fileDetail, true
+	}
+
+	fields := strings.Split(line, f.Delimiter)
+	if len(fields) < f.minFields {
+		return FileDetail{}, false
+	}
+	for name, column := range f.Fields {
+		fileDetailSetters[name](&fileDetail, strings.TrimSpace(fields[column]))
+	}
+	return fileDetail, true
+}
+
+// parseJSON decodes an NDJSON line and copies the configured keys into a FileDetail.
+// Lines that are not JSON objects, or contain none of the keys, do not match.
+func (f *LogFormat) parseJSON(line string) (FileDetail, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		return FileDetail{}, false
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber() // Keep numbers exactly as they were written
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return FileDetail{}, false
+	}
+
+	var fileDetail FileDetail
+	found := false
+	for name, key := range f.JSONKeys {
+		value, ok := lookupJSONKey(object, key)
+		if !ok {
+			continue
+		}
+		found = true
+		fileDetailSetters[name](&fileDetail, strings.TrimSpace(jsonValueString(value)))
+	}
+	return fileDetail, found
+}
+
+// lookupJSONKey walks a dotted key such as "http.request.path" through nested JSON objects
+func lookupJSONKey(object map[string]interface{}, key string) (interface{}, bool) {
+	// A key that literally contains dots wins over a nested lookup
+	if value, ok := object[key]; ok {
+		return value, true
+	}
+
+	head, rest, nested := strings.Cut(key, ".")
+	if !nested {
+		return nil, false
+	}
+	child, ok := object[head].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookupJSONKey(child, rest)
+}
+
+// jsonValueString converts a decoded JSON value into the string stored in a FileDetail
+func jsonValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		// Objects and arrays are kept as compact JSON
+		data, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+}
+
+// lineParser parses lines with a fixed format, or with whichever registered format matches
+type lineParser struct {
+	formats  []*LogFormat
+	last     *LogFormat     // Format that matched the previous line, tried first when auto-detecting
+	location *time.Location // Zone of timestamps that do not carry an offset
+	encoding *textEncoding  // Encoding of files without a byte order mark, nil means UTF-8
+}
+
+// forFile returns a parser for a single file that detects formats on its own, so every file is
+// parsed the same whichever files were read before it
+func (p *lineParser) forFile() *lineParser {
+	parser := *p
+	parser.last = nil
+	return &parser
+}
+
+// newLineParser creates a parser for the named format. An empty name auto-detects the format per line.
+func newLineParser(formatName string, location *time.Location) (*lineParser, error) {
+	if formatName == "" {
+		return &lineParser{formats: logFormats, location: location}, nil
+	}
+	format, ok := findLogFormat(formatName)
+	if !ok {
+		return nil, fmt.Errorf("unknown log format: %s", formatName)
+	}
+	return &lineParser{formats: []*LogFormat{format}, location: location}, nil
+}
+
+// parse returns the FileDetail for the line together with the format that matched it
+func (p *lineParser) parse(line string) (FileDetail, *LogFormat, bool) {
+	if p.last != nil {
+		if fileDetail, ok := p.last.parse(line); ok {
+			return fileDetail, p.last, true
+		}
+	}
+	for _, format := range p.formats {
+		if format == p.last {
+			continue
+		}
+		if fileDetail, ok := format.parse(line); ok {
+			p.last = format
+			return fileDetail, format, true
+		}
+	}
+	return FileDetail{}, nil, false
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLogFormats registers formats for the duration of the test
+func useLogFormats(t *testing.T, formats ...*LogFormat) {
+	t.Helper()
+	for _, format := range formats {
+		if err := format.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := logFormats
+	logFormats = formats
+	t.Cleanup(func() { logFormats = previous })
+}
+
+func TestLogFormatParse(t *testing.T) {
+	csv := &LogFormat{Name: "csv", Delimiter: ",", Fields: map[string]int{"timestamp": 0, "correlationId": 1, "requestPath": 3}}
+	regex := &LogFormat{Name: "access", Pattern: `^(?P<timestamp>\S+ \S+) \[(?P<correlationId>[^\]]*)\] (?P<methodName>\w+) (?P<requestPath>\S+) (?P<totalDurationForRequest>\d+)ms$`}
+	for _, format := range []*LogFormat{csv, regex} {
+		if err := format.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		format *LogFormat
+		line   string
+		want   FileDetail
+		wantOK bool
+	}{
+		{
+			name:   "pipe",
+			format: defaultLogFormat,
+			line:   "2024-05-01 10:00:00,000|c1|t1|12|HTTP-In-Response|2024-05-01 09:59:59,988|handle|SELECT 1|/api/orders",
+			want: FileDetail{Timestamp: "2024-05-01 10:00:00,000", CorrelationId: "c1", ThreadId: "t1", TotalDurationForRequest: "12", CallType: "HTTP-In-Response",
+				StartTime: "2024-05-01 09:59:59,988", MethodName: "handle", RequestQuery: "SELECT 1", RequestPath: "/api/orders"},
+			wantOK: true,
+		},
+		{name: "pipe with too few fields", format: defaultLogFormat, line: "2024-05-01 10:00:00,000|c1|t1|12", wantOK: false},
+		{
+			name:   "delimited fields are trimmed and extra columns ignored",
+			format: csv,
+			line:   " 2024-05-01T10:00:00Z , c1 ,x, /api/a ,extra",
+			want:   FileDetail{Timestamp: "2024-05-01T10:00:00Z", CorrelationId: "c1", RequestPath: "/api/a"},
+			wantOK: true,
+		},
+		{name: "delimited with too few columns", format: csv, line: "2024-05-01T10:00:00Z,c1,x", wantOK: false},
+		{
+			name:   "pattern",
+			format: regex,
+			line:   "2024-05-01 10:00:00.000 [c1] GET /api/orders 15ms",
+			want:   FileDetail{Timestamp: "2024-05-01 10:00:00.000", CorrelationId: "c1", MethodName: "GET", RequestPath: "/api/orders", TotalDurationForRequest: "15"},
+			wantOK: true,
+		},
+		{name: "pattern without a match", format: regex, line: "2024-05-01 10:00:00.000 GET /api/orders", wantOK: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := test.format.parse(test.line)
+			if ok != test.wantOK || got != test.want {
+				t.Errorf("parse(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestLogFormatCompileErrors(t *testing.T) {
+	tests := []struct {
+		format LogFormat
+		want   string
+	}{
+		{LogFormat{Delimiter: "|", Fields: map[string]int{"timestamp": 0}}, "without a name"},
+		{LogFormat{Name: "none"}, "exactly one of"},
+		{LogFormat{Name: "both", Delimiter: "|", Pattern: "(?P<timestamp>.*)"}, "exactly one of"},
+		{LogFormat{Name: "no fields", Delimiter: "|"}, "does not map any fields"},
+		{LogFormat{Name: "unknown field", Delimiter: "|", Fields: map[string]int{"level": 0}}, `unknown field "level"`},
+		{LogFormat{Name: "negative", Delimiter: "|", Fields: map[string]int{"timestamp": -1}}, "negative column"},
+		{LogFormat{Name: "bad pattern", Pattern: "(?P<timestamp>"}, "bad pattern"},
+		{LogFormat{Name: "unknown group", Pattern: "(?P<level>.*)"}, `unknown field "level" in pattern`},
+	}
+	for _, test := range tests {
+		if err := test.format.compile(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("compile(%+v) = %v, want an error containing %q", test.format, err, test.want)
+		}
+	}
+}
+
+func TestLoadLogFormats(t *testing.T) {
+	useLogFormats(t, defaultLogFormat)
+	dir := t.TempDir()
+	writeConfig := func(config string) string {
+		name := filepath.Join(dir, fmt.Sprintf("formats-%d.json", len(config)))
+		if err := os.WriteFile(name, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	// The pipe format is kept after the configured formats
+	err := LoadLogFormats(writeConfig(`{"formats":[{"name":"csv","delimiter":",","fields":{"timestamp":0}},{"name":"access","pattern":"^(?P<timestamp>\\S+) (?P<requestPath>\\S+)$"}]}`))
+	if got := fmt.Sprint(LogFormatNames()); err != nil || got != "[csv access pipe]" {
+		t.Errorf("formats = %s, %v, want [csv access pipe]", got, err)
+	}
+
+	// A configured format named pipe replaces the built-in one
+	err = LoadLogFormats(writeConfig(`{"formats":[{"name":"pipe","delimiter":";","fields":{"timestamp":0,"correlationId":1}}]}`))
+	if format, ok := findLogFormat("pipe"); err != nil || !ok || format.Delimiter != ";" || len(logFormats) != 1 {
+		t.Errorf("pipe format = %+v, %v, want the configured one", format, err)
+	}
+
+	// Invalid configs leave the registered formats as they were
+	for _, config := range []string{
+		`{"formats":[{"name":"a","delimiter":",","fields":{"timestamp":0}},{"name":"a","pattern":"(?P<timestamp>.*)"}]}`,
+		`{"formats":[{"name":"a","delimiter":",","fields":{"level":0}}]}`,
+		`{"formats":`,
+	} {
+		if err := LoadLogFormats(writeConfig(config)); err == nil {
+			t.Errorf("LoadLogFormats(%s) succeeded, want an error", config)
+		}
+		if format, ok := findLogFormat("pipe"); !ok || format.Delimiter != ";" {
+			t.Errorf("pipe format after loading %s = %+v, want it unchanged", config, format)
+		}
+	}
+	if err := LoadLogFormats(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("LoadLogFormats of a missing file = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestLineParserDetectsFormats(t *testing.T) {
+	csv := &LogFormat{Name: "csv", Delimiter: ",", Fields: map[string]int{"timestamp": 0, "correlationId": 1, "requestPath": 3}}
+	useLogFormats(t, defaultLogFormat, csv)
+	pipeLine := "2024-05-01 10:00:00,000|c1|t1|12|HTTP-In-Response|2024-05-01 10:00:00,000|handle||/api/orders"
+	csvLine := "2024-05-01T10:00:00Z,c2,x,/api/a"
+
+	// Without a format name every line is parsed with whichever format matches it
+	parser, err := newLineParser("", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{pipeLine, csvLine, pipeLine} {
+		fileDetail, format, ok := parser.parse(line)
+		want := map[bool]string{true: "pipe", false: "csv"}[strings.Contains(line, "|")]
+		if !ok || format.Name != want || parser.last != format || fileDetail.Timestamp == "" {
+			t.Errorf("parse(%q) = %+v, %v, %v, want the %s format", line, fileDetail, format, ok, want)
+		}
+	}
+	if _, _, ok := parser.parse("a line of neither format"); ok {
+		t.Error("a line of neither format was parsed")
+	}
+
+	// A parser for another file starts without the format of the last line
+	if forFile := parser.forFile(); forFile.last != nil || len(forFile.formats) != 2 || parser.last == nil {
+		t.Errorf("parser for the next file starts with %v, want no format", forFile.last)
+	}
+
+	// A named format parses only its own lines
+	parser, err = newLineParser("pipe", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := parser.parse(csvLine); ok {
+		t.Error("the pipe format parsed a line of the csv format")
+	}
+	if _, err := newLineParser("syslog", time.UTC); err == nil {
+		t.Error("newLineParser of an unknown format succeeded")
+	}
+}
+
+func TestLogFormatParseJSON(t *testing.T) {
+	ndjson := &LogFormat{Name: "ndjson", JSONKeys: map[string]string{
+		"timestamp":               "@timestamp",
+		"correlationId":           "trace.id",
+		"totalDurationForRequest": "http.duration",
+		"requestPath":             "http.request.path",
+		"requestQuery":            "db.statement",
+		"methodName":              "method",
+	}}
+	if err := ndjson.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		line   string
+		want   FileDetail
+		wantOK bool
+	}{
+		{
+			name:   "nested keys",
+			line:   `{"@timestamp":"2024-05-01T10:00:00Z","trace":{"id":"c1"},"http":{"request":{"path":"/api/a"},"duration":12.50},"method":"GET"}`,
+			want:   FileDetail{Timestamp: "2024-05-01T10:00:00Z", CorrelationId: "c1", RequestPath: "/api/a", TotalDurationForRequest: "12.50", MethodName: "GET"},
+			wantOK: true,
+		},
+		{
+			name:   "key containing dots wins over nesting",
+			line:   `{"trace.id":"flat","trace":{"id":"nested"}}`,
+			want:   FileDetail{CorrelationId: "flat"},
+			wantOK: true,
+		},
+		{
+			name:   "values that are not strings",
+			line:   `  {"trace":{"id":42},"method":true,"db":{"statement":{"sql":"SELECT 1","args":[1,"a"]}},"http":{"request":{"path":null}}}  `,
+			want:   FileDetail{CorrelationId: "42", MethodName: "true", RequestQuery: `{"args":[1,"a"],"sql":"SELECT 1"}`},
+			wantOK: true,
+		},
+		{name: "none of the keys", line: `{"message":"started"}`},
+		{name: "nested key through a value", line: `{"trace":"c1"}`},
+		{name: "array", line: `[{"trace":{"id":"c1"}}]`},
+		{name: "malformed", line: `{"trace":{"id":"c1"}`},
+		{name: "plain text", line: "2024-05-01 10:00:00,000|c1|t1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := ndjson.parse(test.line)
+			if ok != test.wantOK || got != test.want {
+				t.Errorf("parse(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+
+	for _, format := range []LogFormat{
+		{Name: "unknown field", JSONKeys: map[string]string{"level": "level"}},
+		{Name: "empty key", JSONKeys: map[string]string{"timestamp": ""}},
+		{Name: "and a delimiter", JSONKeys: map[string]string{"timestamp": "ts"}, Delimiter: "|"},
+	} {
+		if err := format.compile(); err == nil {
+			t.Errorf("compile(%+v) succeeded, want an error", format)
+		}
+	}
+}
+
+func TestLineParserDetectsJSONLines(t *testing.T) {
+	ndjson := &LogFormat{Name: "ndjson", JSONKeys: map[string]string{"timestamp": "ts", "correlationId": "cid"}}
+	useLogFormats(t, ndjson, defaultLogFormat)
+	parser, err := newLineParser("", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ line, want string }{
+		{`{"ts":"2024-05-01T10:00:00Z","cid":"c1"}`, "ndjson"},
+		{"2024-05-01 10:00:00,000|c2|t1|12|HTTP-In-Response|2024-05-01 10:00:00,000|handle||/api/orders", "pipe"},
+		{`{"ts":"2024-05-01T10:00:01Z","cid":"c3"}`, "ndjson"},
+	} {
+		if _, format, ok := parser.parse(test.line); !ok || format.Name != test.want {
+			t.Errorf("parse(%q) = %v, %v, want the %s format", test.line, format, ok, test.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"time"
+)
+
+// spilledEntry is an entry of one source that waits in a temporary file until the sources are merged.
+// Problems with its line are recorded while parsing, so only the line number is kept.
+type spilledEntry struct {
+	Event    LogEvent  `json:"event"`
+	Line     int       `json:"line"`
+	SortTime time.Time `json:"sortTime"` // Time of the entry, or of the source's previous entry if its timestamp is invalid
+}
+
+// sourceSpill holds the entries of one file or archive member
+type sourceSpill struct {
+	index   int // Position of the source in the upload, orders entries with the same time
+	source  string
+	file    *os.File
+	buf     *bufio.Writer
+	encoder *json.Encoder
+	last    time.Time
+
+	// Set while merging
+	decoder *json.Decoder
+	head    spilledEntry
+}
+
+// sourceMerger collects the entries of every file of an upload and adds them to the analysis merged
+// by timestamp, so rotated files that are uploaded together end up in time order. Entries an earlier
+// upload to the session or another file of this upload already contained are dropped, since
+// rotated files may overlap. Repeated entries within a single file are kept. Copies within this
+// upload are recognised among the last maxMergeWindow merged entries, so even in files that are
+// slightly out of time order; only copies further apart than that are kept.
+type sourceMerger struct {
+	analysis   *logAnalysis
+	spills     []*sourceSpill
+	direct     bool // The upload is a single log file, whose entries are added as they are parsed
+	Duplicates int  // Entries dropped as duplicates
+}
+
+// newSourceMerger creates a merger that adds the merged entries to analysis
+func newSourceMerger(analysis *logAnalysis) *sourceMerger {
+	return &sourceMerger{analysis: analysis}
+}
+
+// processFile parses a file like processFile, but holds its entries back until merge is called.
+// Exported session files are read as they were saved instead of being parsed.
+func (m *sourceMerger) processFile(file io.Reader, source string, parser *lineParser) error {
+	// Entries count as accepted for the progress of the upload before they are sampled and
+	// duplicates are dropped. Entries left out of the sample are never spilled.
+	if m.direct {
+		return m.read(file, source, parser, func(event LogEvent, at lineRef) error {
+			m.analysis.progress.accept()
+			if !m.analysis.sampler.keep(event) {
+				return nil
+			}
+			if m.uploaded(entryKey(event.FileDetail)) {
+				m.Duplicates++
+				return nil
+			}
+			return m.analysis.add(event, at)
+		})
+	}
+
+	tmp, err := os.CreateTemp("uploads", "merge-*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating merge file: %w", err)
+	}
+	spill := &sourceSpill{index: len(m.spills), source: source, file: tmp, buf: bufio.NewWriter(tmp)}
+	spill.encoder = json.NewEncoder(spill.buf)
+	m.spills = append(m.spills, spill)
+
+	err = m.read(file, source, parser, func(event LogEvent, at lineRef) error {
+		m.analysis.progress.accept()
+		if !m.analysis.sampler.keep(event) {
+			return nil
+		}
+		return spill.write(event, at)
+	})
+	if err != nil {
+		return err
+	}
+	return spill.buf.Flush()
+}
+
+// read parses a file, or imports it if it is an exported session, and hands every entry to emit
+func (m *sourceMerger) read(file io.Reader, source string, parser *lineParser, emit func(LogEvent, lineRef) error) error {
+	reader := bufio.NewReaderSize(file, 64*1024)
+	start, _ := reader.Peek(sessionExportPeekBytes)
+	if isSessionExport(start) {
+		return importSessionEntries(reader, source, m.analysis, emit)
+	}
+	return readLogEntries(reader, source, parser, m.analysis, emit)
+}
+
+// uploaded reports whether an earlier upload to the session already contained the entry with key
+func (m *sourceMerger) uploaded(key uint64) bool {
+	return m.analysis.session != nil && m.analysis.session.Contains(key)
+}
+
+// write adds an entry to the spill
+func (s *sourceSpill) write(event LogEvent, at lineRef) error {
+	if !event.Time.IsZero() {
+		s.last = event.Time
+	}
+	return s.encoder.Encode(spilledEntry{Event: event, Line: at.number, SortTime: s.last})
+}
+
+// next reads the following entry of the spill into head
+func (s *sourceSpill) next() (bool, error) {
+	s.head = spilledEntry{}
+	if err := s.decoder.Decode(&s.head); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error reading merge file: %w", err)
+	}
+	return true, nil
+}
+
+// merge adds the entries of every source to the analysis in time order, dropping duplicates.
+// It stops with ctx.Err() once ctx is canceled.
+func (m *sourceMerger) merge(ctx context.Context) error {
+	heads := &spillHeap{}
+	for _, spill := range m.spills {
+		if _, err := spill.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		spill.decoder = json.NewDecoder(bufio.NewReader(spill.file))
+		ok, err := spill.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Push(heads, spill)
+		}
+	}
+
+	window := newMergeWindow()
+	for heads.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		spill := (*heads)[0]
+		entry := spill.head
+
+		key := entryKey(entry.Event.FileDetail)
+		first, seen := window.firstSource[key]
+		if m.uploaded(key) || (seen && first != spill.index) {
+			m.Duplicates++
+		} else {
+			if !seen {
+				window.remember(key, spill.index)
+			}
+			if err := m.analysis.add(entry.Event, lineRef{source: spill.source, number: entry.Line}); err != nil {
+				return err
+			}
+		}
+
+		ok, err := spill.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(heads, 0)
+		} else {
+			heap.Pop(heads)
+		}
+	}
+	return nil
+}
+
+// maxMergeWindow is how many of the most recently merged entries are remembered to recognise their
+// copies. Copies share their timestamp, so they are merged close to each other.
+const maxMergeWindow = 100000
+
+// mergeWindow remembers the source each of the most recently merged entries was first read from,
+// so repeats within that source are kept while copies from other sources are dropped
+type mergeWindow struct {
+	firstSource map[uint64]int
+	keys        []uint64 // Remembered keys, used as a ring once it holds maxMergeWindow of them
+	oldest      int      // Position of the oldest key in keys once the ring is full
+}
+
+func newMergeWindow() *mergeWindow {
+	return &mergeWindow{firstSource: map[uint64]int{}}
+}
+
+// remember adds the key of an entry seen for the first time, forgetting the oldest key once the window is full
+func (w *mergeWindow) remember(key uint64, source int) {
+	if len(w.keys) < maxMergeWindow {
+		w.keys = append(w.keys, key)
+	} else {
+		delete(w.firstSource, w.keys[w.oldest])
+		w.keys[w.oldest] = key
+		w.oldest = (w.oldest + 1) % maxMergeWindow
+	}
+	w.firstSource[key] = source
+}
+
+// close removes the temporary files
+func (m *sourceMerger) close() {
+	for _, spill := range m.spills {
+		spill.file.Close()
+		os.Remove(spill.file.Name())
+	}
+	m.spills = nil
+}
+
+// spillHeap orders spills by the time of their next entry
+type spillHeap []*sourceSpill
+
+func (h spillHeap) Len() int { return len(h) }
+func (h spillHeap) Less(i, j int) bool {
+	if !h[i].head.SortTime.Equal(h[j].head.SortTime) {
+		return h[i].head.SortTime.Before(h[j].head.SortTime)
+	}
+	return h[i].index < h[j].index
+}
+func (h spillHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spillHeap) Push(x interface{}) { *h = append(*h, x.(*sourceSpill)) }
+func (h *spillHeap) Pop() interface{} {
+	old := *h
+	spill := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return spill
+}
+
+// entryKey identifies an entry by its content, so the same line read from two files or uploaded
+// twice has the same key. The source is left out, since it differs between the copies.
+func entryKey(fileDetail FileDetail) uint64 {
+	hash := fnv.New64a()
+	for _, field := range []string{
+		fileDetail.Timestamp, fileDetail.CorrelationId, fileDetail.ThreadId, fileDetail.TotalDurationForRequest,
+		fileDetail.CallType, fileDetail.StartTime, fileDetail.MethodName, fileDetail.RequestQuery,
+		fileDetail.RequestPath, fileDetail.Continuation,
+	} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	return hash.Sum64()
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mergeTestLine returns the log line of a response at the given second of the test log. The thread
+// ID names the line, so copies of it are told apart from other lines by the thread ID alone.
+func mergeTestLine(second int, name string) string {
+	timestamp := fmt.Sprintf("2024-05-01 10:00:%02d,000", second)
+	return fmt.Sprintf("%s|c%d|%s|5|HTTP-In-Response|%s|handle||/api/a\n", timestamp, second, name, timestamp)
+}
+
+func TestSourceMergerDropsDuplicates(t *testing.T) {
+	useTestServerDir(t)
+	l1, l2, l3, l4, l5, l6 := mergeTestLine(1, "L1"), mergeTestLine(2, "L2"), mergeTestLine(3, "L3"), mergeTestLine(4, "L4"), mergeTestLine(5, "L5"), mergeTestLine(6, "L6")
+	tests := []struct {
+		name           string
+		earlier        []string // Lines of an earlier upload to the session
+		files          []string
+		direct         bool
+		want           []string // Thread IDs in the session after the upload
+		wantDuplicates int
+	}{
+		{
+			name:           "overlapping rotated files",
+			files:          []string{l3 + l4 + l5 + l6, l1 + l2 + l3 + l4},
+			want:           []string{"L1", "L2", "L3", "L4", "L5", "L6"},
+			wantDuplicates: 2,
+		},
+		{
+			name:           "repeats within a file are kept",
+			files:          []string{l1 + l1 + l2 + l2, l2 + l3},
+			want:           []string{"L1", "L1", "L2", "L2", "L3"},
+			wantDuplicates: 1,
+		},
+		{
+			name:           "files out of time order",
+			files:          []string{l1 + l3 + l2 + l5, l2 + l4 + l3},
+			want:           []string{"L1", "L2", "L3", "L4", "L5"},
+			wantDuplicates: 2,
+		},
+		{
+			name:           "entries of an earlier upload",
+			earlier:        []string{l1, l2},
+			files:          []string{l1 + l2 + l3, l2 + l4},
+			want:           []string{"L1", "L2", "L3", "L4"},
+			wantDuplicates: 3,
+		},
+		{
+			name:           "single file with entries of an earlier upload",
+			earlier:        []string{l1, l2},
+			files:          []string{l1 + l2 + l2 + l3},
+			direct:         true,
+			want:           []string{"L1", "L2", "L3"},
+			wantDuplicates: 3,
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := segmentedSessionStore{dir: "uploads"}
+			tab := fmt.Sprintf("merge-%d", i)
+			parser, err := newLineParser("pipe", time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			upload := func(files []string, direct bool) *sourceMerger {
+				w, err := store.OpenWriter(tab)
+				if err != nil {
+					t.Fatalf("OpenWriter: %v", err)
+				}
+				merger := newSourceMerger(newLogAnalysis(w, nil, nil))
+				merger.direct = direct
+				defer merger.close()
+				for j, file := range files {
+					if err := merger.processFile(strings.NewReader(file), fmt.Sprintf("app.log.%d", j), parser); err != nil {
+						t.Fatalf("processFile: %v", err)
+					}
+				}
+				if err := merger.merge(context.Background()); err != nil {
+					t.Fatalf("merge: %v", err)
+				}
+				if err := w.Commit(); err != nil {
+					t.Fatalf("Commit: %v", err)
+				}
+				return merger
+			}
+			if test.earlier != nil {
+				upload(test.earlier, false)
+			}
+			merger := upload(test.files, test.direct)
+
+			events, err := store.ByRequestPath(tab, "/api/a")
+			assertThreadIDs(t, "entries of the session", events, err, test.want...)
+			if merger.Duplicates != test.wantDuplicates {
+				t.Errorf("Duplicates = %d, want %d", merger.Duplicates, test.wantDuplicates)
+			}
+		})
+	}
+}
+
+func TestMergeWindowForgetsOldestKeys(t *testing.T) {
+	window := newMergeWindow()
+	for key := uint64(0); key < maxMergeWindow+10; key++ {
+		window.remember(key, int(key%3))
+	}
+	if len(window.firstSource) != maxMergeWindow {
+		t.Errorf("window remembers %d keys, want %d", len(window.firstSource), maxMergeWindow)
+	}
+	for _, key := range []uint64{0, 9} {
+		if _, seen := window.firstSource[key]; seen {
+			t.Errorf("key %d is still remembered", key)
+		}
+	}
+	for _, key := range []uint64{10, maxMergeWindow + 9} {
+		if source, seen := window.firstSource[key]; !seen || source != int(key%3) {
+			t.Errorf("source of key %d = %d, %v, want %d", key, source, seen, key%3)
+		}
+	}
+}
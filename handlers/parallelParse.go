@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// parseWorkers is how many files of an upload are parsed at the same time
+var parseWorkers = runtime.NumCPU()
+
+// SetParseWorkers sets how many files of an upload are parsed at the same time, at least one
+func SetParseWorkers(workers int) {
+	parseWorkers = max(workers, 1)
+}
+
+// parseJob parses one file, or every log file of an archive, into merger
+type parseJob func(merger *sourceMerger) error
+
+// parseFiles runs the jobs on up to parseWorkers goroutines. Every job parses into a merger of its
+// own, which are joined in the order of the jobs once all of them are done, so the entries,
+// diagnostics and exclusion counts are the same as if the files were parsed one after another.
+// The error of the first failed job is returned, jobs that did not start yet are skipped.
+// The single file of a direct merger is parsed straight into its analysis.
+func (m *sourceMerger) parseFiles(jobs []parseJob) error {
+	if m.direct && len(jobs) == 1 {
+		return jobs[0](m)
+	}
+
+	parts := make([]*sourceMerger, len(jobs))
+	errs := make([]error, len(jobs))
+	var failed atomic.Bool
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(parseWorkers, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if failed.Load() {
+					continue
+				}
+				parts[i], errs[i] = m.fork()
+				if errs[i] == nil {
+					errs[i] = jobs[i](parts[i])
+				}
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var err error
+	for i, part := range parts {
+		if err == nil {
+			err = errs[i]
+		}
+		if part == nil {
+			continue
+		}
+		if err != nil {
+			part.discard()
+			continue
+		}
+		err = m.join(part)
+	}
+	return err
+}
+
+// fork returns an empty merger for parsing a single file, with its own diagnostics and exclusion
+// counts. The sampler and the progress of the upload are shared.
+func (m *sourceMerger) fork() (*sourceMerger, error) {
+	var diagnostics *parseDiagnostics
+	if m.analysis.diagnostics != nil {
+		var err error
+		if diagnostics, err = newPartialDiagnostics(); err != nil {
+			return nil, err
+		}
+	}
+	analysis := newLogAnalysis(nil, diagnostics, m.analysis.filter.fork())
+	analysis.sampler = m.analysis.sampler
+	analysis.progress = m.analysis.progress
+	return newSourceMerger(analysis), nil
+}
+
+// join takes over the sources, diagnostics and exclusion counts of a forked merger
+func (m *sourceMerger) join(part *sourceMerger) error {
+	for _, spill := range part.spills {
+		spill.index = len(m.spills)
+		m.spills = append(m.spills, spill)
+	}
+	part.spills = nil
+	m.analysis.sources = append(m.analysis.sources, part.analysis.sources...)
+	m.analysis.filter.join(part.analysis.filter)
+	return m.analysis.diagnostics.join(part.analysis.diagnostics)
+}
+
+// discard removes the temporary files of a forked merger
+func (m *sourceMerger) discard() {
+	m.close()
+	if m.analysis.diagnostics != nil {
+		m.analysis.diagnostics.abort()
+	}
+}
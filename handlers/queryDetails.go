@@ -8,36 +8,30 @@ import (
 // QueryDetailsHandler fetches and displays queries for a specific correlation ID and query.
 func QueryDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	correlationId := r.URL.Query().Get("correlationId")
-	tabUUID := r.URL.Query().Get("tabUUID")
 	query := r.URL.Query().Get("query")
 
 	if correlationId == "" {
 		http.Error(w, "Correlation ID is required", http.StatusBadRequest)
 		return
 	}
-	if tabUUID == "" {
-		http.Error(w, "Tab UUID is required", http.StatusBadRequest)
-		return
-	}
 	if query == "" {
 		http.Error(w, "Query is required", http.StatusBadRequest)
 		return
 	}
-
-	relevantFile, err := getRelevantJSONFile("uploads/", tabUUID)
-	if err != nil {
-		http.Error(w, "Failed to find the relevant data file", http.StatusInternalServerError)
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
 		return
 	}
 
-	requestData, err := readRequestDataFromFile(relevantFile)
+	// Load the entries of the correlation ID from the session store
+	requestData, err := sessionStore.ByCorrelationIDs(tabUUID, []string{correlationId})
 	if err != nil {
-		http.Error(w, "Failed to load data from file", http.StatusInternalServerError)
+		writeSessionError(w, err)
 		return
 	}
 
 	// Collect only queries that match the correlation ID and the query
-	var queries []FileDetail
+	var queries []LogEvent
 	for _, details := range requestData {
 		if details.CorrelationId == correlationId && details.RequestQuery == query {
 			queries = append(queries, details)
@@ -53,7 +47,7 @@ func QueryDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		CorrelationId string
 		Query         string
-		Queries       []FileDetail
+		Queries       []LogEvent
 	}{
 		CorrelationId: correlationId,
 		Query:         query,
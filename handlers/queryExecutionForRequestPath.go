@@ -1,23 +1,17 @@
 package handlers
 
 import (
-	"encoding/json"
-	"fmt"
 	"html/template"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 )
 
 // QueryExecutionsForRequestHandler processes the query executions for a given request
 func QueryExecutionsForRequestHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract the query, tabUUID, and path parameters from the URL
-	tabUUID := r.URL.Query().Get("tabUUID")
-	if tabUUID == "" {
-		http.Error(w, "Tab UUID parameter is required", http.StatusBadRequest)
-		log.Println("Missing tabUUID parameter in request")
+	// Resolve the session of the tab and extract the query and path parameters from the URL
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
+		log.Println("Invalid or unknown tabUUID parameter in request")
 		return
 	}
 
@@ -37,30 +31,19 @@ func QueryExecutionsForRequestHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Received request with tabUUID: %s, path: %s", tabUUID, path)
 
-	// Locate the relevant JSON file
-	relevantFile, err := getRelevantJSONFile3("uploads/", tabUUID)
+	// Load the entries of the request path from the session store
+	pathEntries, err := sessionStore.ByRequestPath(tabUUID, path)
 	if err != nil {
-		http.Error(w, "Failed to find the relevant data file", http.StatusInternalServerError)
-		log.Println("Error locating relevant file:", err)
+		writeSessionError(w, err)
+		log.Println("Error reading data from the session store:", err)
 		return
 	}
-	log.Printf("Found relevant file: %s", relevantFile)
-
-	// Read the request data from the file
-	requestData, err := readRequestDataFromFile3(relevantFile)
-	if err != nil {
-		http.Error(w, "Failed to load data from file", http.StatusInternalServerError)
-		log.Println("Error reading data from file:", err)
-		return
-	}
-	log.Printf("Successfully loaded %d records from the file", len(requestData))
+	log.Printf("Successfully loaded %d records of the path", len(pathEntries))
 
 	// Find correlation IDs related to the provided path
-	var correlationIDs []string
-	for _, details := range requestData {
-		if details.RequestPath == path {
-			correlationIDs = append(correlationIDs, details.CorrelationId)
-		}
+	correlationIDs := make(map[string]bool)
+	for _, details := range pathEntries {
+		correlationIDs[details.CorrelationId] = true
 	}
 
 	if len(correlationIDs) == 0 {
@@ -70,11 +53,18 @@ func QueryExecutionsForRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Found %d correlation IDs", len(correlationIDs))
 
+	// Load the executions of the query from the session store
+	queryEntries, err := sessionStore.ByQuery(tabUUID, query)
+	if err != nil {
+		writeSessionError(w, err)
+		log.Println("Error reading data from the session store:", err)
+		return
+	}
+
 	// Filter the records matching the correlation IDs and exclude specific call types
-	var executions []FileDetail
-	for _, details := range requestData {
-		if contains(correlationIDs, details.CorrelationId) && details.RequestQuery == query &&
-			details.CallType != "HTTP-In-Response" && details.CallType != "HTTP-In-Request" {
+	var executions []LogEvent
+	for _, details := range queryEntries {
+		if correlationIDs[details.CorrelationId] && !details.IsHTTP() {
 			executions = append(executions, details)
 		}
 	}
@@ -99,7 +89,7 @@ func QueryExecutionsForRequestHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Query      string
 		Path       string
-		Executions []FileDetail
+		Executions []LogEvent
 	}{
 		Query:      query,
 		Path:       path,
@@ -116,58 +106,3 @@ func QueryExecutionsForRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("Template rendered successfully")
 }
-
-// getRelevantJSONFile3 locates the relevant JSON file based on tabUUID
-func getRelevantJSONFile3(directory, tabUUID string) (string, error) {
-	log.Printf("Looking for JSON file in directory: %s with tabUUID: %s", directory, tabUUID)
-	files, err := os.ReadDir(directory)
-	if err != nil {
-		log.Println("Error reading directory:", err)
-		return "", fmt.Errorf("error reading directory %s: %v", directory, err)
-	}
-
-	// Search for the file that contains the tabUUID in its name
-	for _, file := range files {
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
-
-		if strings.Contains(file.Name(), tabUUID) {
-			log.Printf("Found file: %s", file.Name())
-			return filepath.Join(directory, file.Name()), nil
-		}
-	}
-
-	log.Printf("No file found for tabUUID: %s", tabUUID)
-	return "", fmt.Errorf("no JSON file found for tab UUID: %s", tabUUID)
-}
-
-// readRequestDataFromFile3 reads and returns the data from the JSON file
-func readRequestDataFromFile3(filename string) ([]FileDetail, error) {
-	log.Printf("Opening file: %s", filename)
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Println("Error opening file:", err)
-		return nil, fmt.Errorf("error opening file %s: %v", filename, err)
-	}
-	defer file.Close()
-
-	var requestData []FileDetail
-	err = json.NewDecoder(file).Decode(&requestData)
-	if err != nil {
-		log.Println("Error decoding JSON from file:", err)
-		return nil, fmt.Errorf("error decoding JSON from file %s: %v", filename, err)
-	}
-	log.Printf("Successfully decoded %d records from file", len(requestData))
-	return requestData, nil
-}
-
-// contains checks if a slice contains a specific string
-func contains(slice []string, item string) bool {
-	for _, v := range slice {
-		if v == item {
-			return true
-		}
-	}
-	return false
-}
@@ -12,28 +12,22 @@ func QueryExecutionsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Query parameter is required", http.StatusBadRequest)
 		return
 	}
-	tabUUID := r.URL.Query().Get("tabUUID")
-	if tabUUID == "" {
-		http.Error(w, "Tab UUID parameter is required", http.StatusBadRequest)
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
 		return
 	}
 
-	relevantFile, err := getRelevantJSONFile("uploads/", tabUUID)
+	// Load the executions of the query from the session store
+	requestData, err := sessionStore.ByQuery(tabUUID, query)
 	if err != nil {
-		http.Error(w, "Failed to find the relevant data file", http.StatusInternalServerError)
-		return
-	}
-
-	requestData, err := readRequestDataFromFile(relevantFile)
-	if err != nil {
-		http.Error(w, "Failed to load data from file", http.StatusInternalServerError)
+		writeSessionError(w, err)
 		return
 	}
 
 	// Compute execution count per Correlation ID
 	executionCount := make(map[string]int)
 	for _, details := range requestData {
-		if details.RequestQuery == query && details.CallType != "HTTP-In-Response" && details.CallType != "HTTP-In-Request" {
+		if details.RequestQuery == query && !details.IsHTTP() {
 			executionCount[details.CorrelationId]++
 		}
 	}
@@ -1,14 +1,9 @@
 package handlers
 
 import (
-	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
 )
 
 // RequestQueryStats holds statistics for request queries
@@ -31,29 +26,23 @@ func RequestDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the relevant JSON file for this path
-	tabUUID := r.URL.Query().Get("tabUUID")
-	if tabUUID == "" {
-		http.Error(w, "Tab UUID query parameter is required", http.StatusBadRequest)
-		return
-	}
-	relevantFile, err := getRelevantJSONFile("uploads/", tabUUID)
-	if err != nil {
-		http.Error(w, "Failed to find the relevant data file", http.StatusInternalServerError)
+	// Resolve the session of the tab
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
 		return
 	}
 
-	// Read request data from the relevant JSON file
-	requestData, err := readRequestDataFromFile(relevantFile)
+	// Load the entries of the request path from the session store
+	pathEntries, err := sessionStore.ByRequestPath(tabUUID, path)
 	if err != nil {
-		http.Error(w, "Failed to load data from file", http.StatusInternalServerError)
+		writeSessionError(w, err)
 		return
 	}
 
-	// Filter request details that match the given path
-	var matchingDetails []FileDetail
-	for _, details := range requestData {
-		if details.RequestPath == path && details.CallType == "HTTP-In-Response" {
+	// Filter the responses of the request path
+	var matchingDetails []LogEvent
+	for _, details := range pathEntries {
+		if details.Kind == CallHTTPResponse {
 			matchingDetails = append(matchingDetails, details)
 		}
 	}
@@ -65,18 +54,19 @@ func RequestDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Extract correlation IDs
-	correlationIDs, err := extractCorrelationIDs(relevantFile, path)
+	correlationIDs, err := extractCorrelationIDs(pathEntries, path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	// Calculate request query statistics
-	statsMap, err := calculateRequestQueryStatsExcludingCallTypes(requestData, correlationIDs)
+	// Load every entry of these requests and calculate request query statistics
+	requestData, err := sessionStore.ByCorrelationIDs(tabUUID, correlationIDs)
 	if err != nil {
-		http.Error(w, "Failed to calculate query stats", http.StatusInternalServerError)
+		writeSessionError(w, err)
 		return
 	}
+	statsMap := calculateRequestQueryStatsExcludingCallTypes(requestData, correlationIDs)
 
 	// Convert map to slice for template rendering
 	var stats []RequestQueryStats
@@ -85,15 +75,11 @@ func RequestDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Calculate total in-response time, query execution time, and their difference for the request path
-	totalInResponseTime, totalQueryExecutionTime, timeDifference, err := calculateRequestTimes(requestData, path, statsMap)
-	if err != nil {
-		http.Error(w, "Failed to calculate request times", http.StatusInternalServerError)
-		return
-	}
+	totalInResponseTime, totalQueryExecutionTime, timeDifference := calculateRequestTimes(pathEntries, path, statsMap)
 
 	// Prepare data for rendering the template
 	data := struct {
-		RequestDetails          []FileDetail
+		RequestDetails          []LogEvent
 		QueryStats              []RequestQueryStats
 		TotalInResponseTime     float64
 		TotalQueryExecutionTime float64
@@ -125,46 +111,9 @@ func RequestDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// readRequestDataFromFile reads and parses JSON data from a file into a slice of FileDetail structs.
-func readRequestDataFromFile(filename string) ([]FileDetail, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var requestData []FileDetail
-	err = json.NewDecoder(file).Decode(&requestData)
-	if err != nil {
-		return nil, err
-	}
-	return requestData, nil
-}
-
-// getRelevantJSONFile searches for a JSON file in the specified directory that contains the given tabUUID in its name.
-func getRelevantJSONFile(directory, tabUUID string) (string, error) {
-	files, err := os.ReadDir(directory)
-	if err != nil {
-		return "", err
-	}
-
-	for _, file := range files {
-
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
-
-		if strings.Contains(file.Name(), tabUUID) {
-
-			return filepath.Join(directory, file.Name()), nil
-		}
-	}
-
-	return "", fmt.Errorf("no JSON file found for tab UUID: %s", tabUUID)
-}
-
-// calculateRequestQueryStatsExcludingCallTypes calculates the count and total duration for each request query, excluding "HTTP-In-Response" and "HTTP-In-Request" call types
-func calculateRequestQueryStatsExcludingCallTypes(requestData []FileDetail, correlationIDs []string) (map[string]RequestQueryStats, error) {
+// calculateRequestQueryStatsExcludingCallTypes calculates the count and total duration for each request query, excluding "HTTP-In-Response" and "HTTP-In-Request" call types.
+// Entries without a valid duration are skipped.
+func calculateRequestQueryStatsExcludingCallTypes(requestData []LogEvent, correlationIDs []string) map[string]RequestQueryStats {
 	// Create a map to store stats for each unique request query
 	queryStats := make(map[string]RequestQueryStats)
 
@@ -177,14 +126,9 @@ func calculateRequestQueryStatsExcludingCallTypes(requestData []FileDetail, corr
 	// Iterate over request data to gather statistics
 	for _, details := range requestData {
 		// Exclude "HTTP-In-Response" and "HTTP-In-Request" call types
-		if correlationIDSet[details.CorrelationId] && details.CallType != "HTTP-In-Response" && details.CallType != "HTTP-In-Request" {
+		if correlationIDSet[details.CorrelationId] && !details.IsHTTP() && details.HasDuration {
 			query := details.RequestQuery
-
-			// Convert total duration from string to float
-			duration, err := strconv.ParseFloat(details.TotalDurationForRequest, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse duration: %w", err)
-			}
+			duration := details.DurationMillis
 
 			// Update the statistics
 			stat, exists := queryStats[query]
@@ -218,16 +162,11 @@ func calculateRequestQueryStatsExcludingCallTypes(requestData []FileDetail, corr
 		}
 	}
 
-	return queryStats, nil
+	return queryStats
 }
 
-func extractCorrelationIDs(filename, requestPath string) ([]string, error) {
-	// Read the request data from the JSON file
-	requestData, err := readRequestDataFromFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read request data: %w", err)
-	}
-
+// extractCorrelationIDs returns the unique correlation IDs of the entries with the given request path
+func extractCorrelationIDs(requestData []LogEvent, requestPath string) ([]string, error) {
 	// Use a map to store unique Correlation IDs
 	correlationIDMap := make(map[string]struct{})
 	for _, details := range requestData {
@@ -250,7 +189,7 @@ func extractCorrelationIDs(filename, requestPath string) ([]string, error) {
 }
 
 // calculateRequestTimes calculates the Total In Response Time, Total Query Execution Time, and their difference for a particular request path
-func calculateRequestTimes(requestData []FileDetail, requestPath string, queryStats map[string]RequestQueryStats) (float64, float64, float64, error) {
+func calculateRequestTimes(requestData []LogEvent, requestPath string, queryStats map[string]RequestQueryStats) (float64, float64, float64) {
 	var totalInResponseTime, totalQueryExecutionTime float64
 
 	// Iterate over the request data to accumulate the response time
@@ -258,12 +197,8 @@ func calculateRequestTimes(requestData []FileDetail, requestPath string, querySt
 		// Filter by the given request path and check for "HTTP-In-Response" call type
 		if details.RequestPath == requestPath {
 			// For "HTTP-In-Response", accumulate the response time
-			if details.CallType == "HTTP-In-Response" {
-				inResponseTime, err := strconv.ParseFloat(details.TotalDurationForRequest, 64)
-				if err != nil {
-					return 0, 0, 0, fmt.Errorf("failed to parse In-Response time: %w", err)
-				}
-				totalInResponseTime += inResponseTime
+			if details.Kind == CallHTTPResponse && details.HasDuration {
+				totalInResponseTime += details.DurationMillis
 			}
 		}
 	}
@@ -278,5 +213,5 @@ func calculateRequestTimes(requestData []FileDetail, requestPath string, querySt
 	timeDifference := totalInResponseTime - totalQueryExecutionTime
 
 	// Return the results
-	return totalInResponseTime, totalQueryExecutionTime, timeDifference, nil
+	return totalInResponseTime, totalQueryExecutionTime, timeDifference
 }
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// correlationSampler keeps a sample of the requests of an upload. The decision is made per
+// correlation ID by its hash, so every entry of a sampled request is kept and its breakdown stays
+// complete, whichever file of the upload the entry is in. Entries without a correlation ID are
+// sampled one by one. The sampler holds no state, so files parsed concurrently share it. Since
+// the hash decides, "1 in N" keeps about, not exactly, every Nth correlation ID.
+type correlationSampler struct {
+	every   int     // Keep the correlation IDs whose hash is a multiple of N, 0 in percent mode
+	percent float64 // Keep the correlation IDs whose hash falls within this percentage
+}
+
+// newCorrelationSampler creates a sampler that keeps about 1 in N correlation IDs, or the given
+// percentage of them. Without either sampling is disabled and nil is returned.
+func newCorrelationSampler(every int, percent float64) (*correlationSampler, error) {
+	switch {
+	case every != 0 && percent != 0:
+		return nil, fmt.Errorf("sample either 1 in N correlation IDs or a percentage of them, not both")
+	case every < 0:
+		return nil, fmt.Errorf("sampling 1 in N correlation IDs needs N of at least 1, got %d", every)
+	case percent < 0 || percent > 100:
+		return nil, fmt.Errorf("percentage of correlation IDs must be above 0 and at most 100, got %g", percent)
+	case every > 0:
+		return &correlationSampler{every: every}, nil
+	case percent > 0:
+		return &correlationSampler{percent: percent}, nil
+	}
+	return nil, nil
+}
+
+// keep reports whether the entry is part of the sample. A nil sampler keeps every entry.
+func (s *correlationSampler) keep(event LogEvent) bool {
+	if s == nil {
+		return true
+	}
+	key := event.CorrelationId
+	if key == "" {
+		key = strconv.FormatUint(entryKey(event.FileDetail), 16)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	if s.percent > 0 {
+		return float64(hash.Sum32()%10000) < s.percent*100
+	}
+	return hash.Sum32()%uint32(s.every) == 0
+}
+
+// scale is the factor counts of the sample are multiplied with to estimate the counts of the whole upload
+func (s *correlationSampler) scale() float64 {
+	if s == nil {
+		return 1
+	}
+	if s.percent > 0 {
+		return 100 / s.percent
+	}
+	return float64(s.every)
+}
+
+// String describes the sample for the result page
+func (s *correlationSampler) String() string {
+	if s == nil {
+		return ""
+	}
+	if s.percent > 0 {
+		return fmt.Sprintf("%g%% of the correlation IDs", s.percent)
+	}
+	return fmt.Sprintf("about 1 in %d correlation IDs", s.every)
+}
+
+// scaleCount estimates the count of the whole upload from the count of the sample
+func scaleCount(count int, scale float64) int {
+	return int(math.Round(float64(count) * scale))
+}
+
+// sampleScale is the scale of the entries the analysis counts itself, 0 if they are not sampled
+func (a *logAnalysis) sampleScale() float64 {
+	if a.sampler != nil {
+		return a.sampler.scale()
+	}
+	return a.partScale
+}
+
+// applySampleScale scales the counts of a sampled analysis up to estimates for the whole upload and
+// marks them as estimates. Entries that were sampled at another scale, e.g. those of a sampled
+// session that is rebuilt or imported, are scaled on their own and added. Durations, averages and
+// percentiles are left as measured on the sample.
+func (a *logAnalysis) applySampleScale() {
+	if scale := a.sampleScale(); scale > 0 {
+		a.scaleCounts(scale)
+	}
+	for scale, part := range a.sampledParts {
+		part.computeStats()
+		if scale > 0 {
+			part.scaleCounts(scale)
+		}
+		a.mergeTotals(part)
+		a.estimated = a.estimated || part.estimated
+		mergePathStats(a.pathStats, part.pathStats)
+		mergeQueryMetrics(a.queryMetrics, part.queryMetrics)
+	}
+	a.sampledParts = nil
+}
+
+// scaleCounts multiplies the counts by scale and marks them as estimates
+func (a *logAnalysis) scaleCounts(scale float64) {
+	a.estimated = true
+	for _, stats := range a.pathStats {
+		stats.Count = scaleCount(stats.Count, scale)
+		stats.TotalTime *= scale
+		stats.Estimated = true
+	}
+	for _, metrics := range a.queryMetrics {
+		metrics.Count = scaleCount(metrics.Count, scale)
+		metrics.TotalTime *= scale
+		metrics.Estimated = true
+	}
+	for _, bucket := range a.timeBuckets {
+		bucket.RequestCount = scaleCount(bucket.RequestCount, scale)
+		bucket.ResponseCount = scaleCount(bucket.ResponseCount, scale)
+	}
+	a.totalHTTPRequests = scaleCount(a.totalHTTPRequests, scale)
+	a.totalHTTPResponses = scaleCount(a.totalHTTPResponses, scale)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCorrelationSamplerKeep(t *testing.T) {
+	tests := []struct {
+		every   int
+		percent float64
+		want    float64 // Fraction of correlation IDs kept
+	}{
+		{every: 1, want: 1},
+		{every: 10, want: 0.1},
+		{every: 3, want: 1.0 / 3},
+		{percent: 100, want: 1},
+		{percent: 25, want: 0.25},
+		{percent: 0.5, want: 0.005},
+	}
+	const ids = 100000
+	for _, test := range tests {
+		sampler, err := newCorrelationSampler(test.every, test.percent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := 0
+		for i := 0; i < ids; i++ {
+			request := testEvent(i, fmt.Sprintf("c%d", i), "/api/a", "")
+			response := request
+			response.Kind = CallHTTPResponse
+			keep := sampler.keep(request)
+			if sampler.keep(response) != keep {
+				t.Fatalf("%s: entries of correlation ID c%d are sampled apart", sampler, i)
+			}
+			if keep {
+				kept++
+			}
+		}
+		// The hash picks the correlation IDs, so the sample is only about the requested size
+		if got := float64(kept) / ids; math.Abs(got-test.want) > 0.01*test.want+0.002 {
+			t.Errorf("%s kept %.4f of the correlation IDs, want about %.4f", sampler, got, test.want)
+		}
+		if scale := sampler.scale(); math.Abs(scale-1/test.want) > 1e-9 {
+			t.Errorf("%s scale = %g, want %g", sampler, scale, 1/test.want)
+		}
+	}
+}
+
+func TestNewCorrelationSamplerInvalid(t *testing.T) {
+	tests := []struct {
+		every   int
+		percent float64
+	}{
+		{every: -1},
+		{percent: -5},
+		{percent: 101},
+		{every: 10, percent: 10},
+	}
+	for _, test := range tests {
+		if sampler, err := newCorrelationSampler(test.every, test.percent); err == nil {
+			t.Errorf("newCorrelationSampler(%d, %g) = %v, want an error", test.every, test.percent, sampler)
+		}
+	}
+	if sampler, err := newCorrelationSampler(0, 0); sampler != nil || err != nil {
+		t.Errorf("newCorrelationSampler(0, 0) = %v, %v, want sampling disabled", sampler, err)
+	}
+}
+
+func TestApplySampleScaleOfMixedEntries(t *testing.T) {
+	// Entries of an unsampled upload and of uploads sampled 1 in 4 and 1 in 10, as a rebuilt
+	// session holds them, are each scaled by their own sample
+	analysis := newLogAnalysis(nil, nil, nil)
+	for i, scale := range []float64{0, 4, 4, 10} {
+		event := testEvent(i, fmt.Sprintf("c%d", i), "/api/a", "")
+		event.SampleScale = scale
+		analysis.add(event, lineRef{})
+	}
+	analysis.computeStats()
+	analysis.applySampleScale()
+
+	stats := analysis.pathStats["/api/a"]
+	if stats == nil || stats.Count != 1+8+10 || stats.TotalTime != 12*19 || !stats.Estimated || stats.Percentile != 12 {
+		t.Errorf("stats of /api/a = %+v, want an estimate of 19 responses of 12 ms", stats)
+	}
+	if overall := analysis.overallStats(); overall.TotalHTTPResponses != 19 || !overall.Estimated || overall.Sample == "" {
+		t.Errorf("overall stats = %+v, want an estimate of 19 responses", overall)
+	}
+}
@@ -0,0 +1,591 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// segmentedSessionStore keeps every session in a directory <dir>/<tabUUID>.segments holding
+//
+//	000001.ndjson  entries as lines of JSON, only ever appended to
+//	000001.keys    the entryKey of every entry of the segment, 8 bytes big endian each
+//	manifest.json  the segments and how many of their entries and bytes are committed
+//
+// A writer appends to the last segment until it reaches maxSegmentBytes and then starts the next
+// one. The manifest is replaced by rename on commit, so readers never see a partial upload and
+// a crash only leaves an uncommitted tail, which the next writer cuts off.
+//
+// Sessions saved as a single JSON array, <dir>/<tabUUID>.json, are still read. The next writer
+// takes the file over as the first segment of the session.
+type segmentedSessionStore struct {
+	dir string
+}
+
+// maxSegmentBytes is the size after which a writer starts a new segment
+const maxSegmentBytes = 64 * 1024 * 1024
+
+const (
+	segmentManifestFile = "manifest.json"
+	legacySegmentName   = "legacy.json"
+)
+
+// sessionSegment is a segment of a session as recorded in the manifest
+type sessionSegment struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// segmentManifest lists the committed segments of a session
+type segmentManifest struct {
+	Segments []sessionSegment `json:"segments"`
+	Next     int              `json:"next"` // Number of the next segment that is started
+}
+
+// segmentKeysName returns the name of the file holding the entry keys of a segment
+func segmentKeysName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".keys"
+}
+
+// sessionDir returns the directory of the segments of tabUUID
+func (s segmentedSessionStore) sessionDir(tabUUID string) string {
+	return filepath.Join(s.dir, tabUUID+".segments")
+}
+
+// legacyFileName returns the path of a session saved as a single JSON array
+func (s segmentedSessionStore) legacyFileName(tabUUID string) string {
+	return filepath.Join(s.dir, tabUUID+".json")
+}
+
+// readSegmentManifest reads the committed segments of the session in dir
+func readSegmentManifest(dir string) (segmentManifest, error) {
+	var manifest segmentManifest
+	data, err := os.ReadFile(filepath.Join(dir, segmentManifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("error decoding session manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// segments returns the paths and committed lengths of the segments of a session. A session saved as
+// a single JSON array is returned as its only segment.
+func (s segmentedSessionStore) segments(tabUUID string) ([]string, []int64, error) {
+	dir := s.sessionDir(tabUUID)
+	for attempt := 0; ; attempt++ {
+		manifest, err := readSegmentManifest(dir)
+		if err == nil {
+			paths := make([]string, len(manifest.Segments))
+			sizes := make([]int64, len(manifest.Segments))
+			for i, segment := range manifest.Segments {
+				paths[i], sizes[i] = filepath.Join(dir, segment.Name), segment.Bytes
+			}
+			return paths, sizes, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+
+		info, err := os.Stat(s.legacyFileName(tabUUID))
+		if err == nil {
+			return []string{s.legacyFileName(tabUUID)}, []int64{info.Size()}, nil
+		}
+		// A writer removes the JSON array right after committing it as the first segment
+		if attempt > 0 || !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+}
+
+func (s segmentedSessionStore) OpenWriter(tabUUID string) (SessionWriter, error) {
+	w := &segmentWriter{dir: s.sessionDir(tabUUID), legacy: s.legacyFileName(tabUUID)}
+	if err := w.open(); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Export writes the entries of every segment as a single JSON array, in the format sessions were
+// saved in before they were split into segments
+func (s segmentedSessionStore) Export(tabUUID string, w io.Writer) error {
+	paths, sizes, err := s.segments(tabUUID)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(w)
+	count := 0
+	out.WriteString("[")
+	err = decodeSegments(paths, sizes, func(event LogEvent) error {
+		data, err := json.MarshalIndent(event, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding JSON data: %w", err)
+		}
+		if count > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n  ")
+		out.Write(data)
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	out.WriteString("\n]\n")
+	return out.Flush()
+}
+
+func (s segmentedSessionStore) ByCorrelationIDs(tabUUID string, ids []string) ([]LogEvent, error) {
+	set := stringSet(ids)
+	return s.scan(tabUUID, func(event *LogEvent) bool { return set[event.CorrelationId] })
+}
+
+func (s segmentedSessionStore) ByRequestPath(tabUUID, path string) ([]LogEvent, error) {
+	return s.scan(tabUUID, func(event *LogEvent) bool { return event.RequestPath == path })
+}
+
+func (s segmentedSessionStore) ByQuery(tabUUID, query string) ([]LogEvent, error) {
+	return s.scan(tabUUID, func(event *LogEvent) bool { return event.RequestQuery == query })
+}
+
+func (s segmentedSessionStore) Sessions() ([]string, error) {
+	names, err := sessionsWithSuffix(s.dir, ".segments", true)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := sessionsWithSuffix(s.dir, ".json", false)
+	if err != nil {
+		return nil, err
+	}
+	// A session that was taken over by a writer may briefly have both
+	seen := stringSet(names)
+	for _, name := range legacy {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s segmentedSessionStore) Exists(tabUUID string) (bool, error) {
+	_, _, err := s.segments(tabUUID)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s segmentedSessionStore) Stat(tabUUID string) (SessionStat, error) {
+	dir := s.sessionDir(tabUUID)
+	manifest, err := readSegmentManifest(dir)
+	if err == nil {
+		info, err := os.Stat(filepath.Join(dir, segmentManifestFile))
+		if err != nil {
+			return SessionStat{}, err
+		}
+		stat := SessionStat{Bytes: dirBytes(dir), Modified: info.ModTime()}
+		for _, segment := range manifest.Segments {
+			stat.Entries += segment.Entries
+		}
+		return stat, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return SessionStat{}, err
+	}
+
+	// Sessions saved as a single JSON array have to be read to count their entries
+	file, err := os.Open(s.legacyFileName(tabUUID))
+	if err != nil {
+		return SessionStat{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return SessionStat{}, err
+	}
+	stat := SessionStat{Bytes: info.Size(), Modified: info.ModTime()}
+	err = decodeSegment(file, func(LogEvent) error {
+		stat.Entries++
+		return nil
+	})
+	return stat, err
+}
+
+func (s segmentedSessionStore) Delete(tabUUID string) error {
+	if err := os.RemoveAll(s.sessionDir(tabUUID)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.legacyFileName(tabUUID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// scan decodes every segment one entry at a time and returns the entries that match
+func (s segmentedSessionStore) scan(tabUUID string, match func(*LogEvent) bool) ([]LogEvent, error) {
+	paths, sizes, err := s.segments(tabUUID)
+	if err != nil {
+		return nil, err
+	}
+	var matching []LogEvent
+	err = decodeSegments(paths, sizes, func(event LogEvent) error {
+		if match(&event) {
+			matching = append(matching, event)
+		}
+		return nil
+	})
+	return matching, err
+}
+
+// decodeSegments hands the committed entries of the segments to fn in order
+func decodeSegments(paths []string, sizes []int64, fn func(LogEvent) error) error {
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = decodeSegment(io.NewSectionReader(file, 0, sizes[i]), fn)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeSegment decodes a segment one entry at a time and hands every entry to fn. Segments are
+// lines of JSON, except for sessions saved before, which are a JSON array.
+func decodeSegment(file io.Reader, fn func(LogEvent) error) error {
+	reader := bufio.NewReaderSize(file, 64*1024)
+	start, _ := reader.Peek(64)
+	decoder := json.NewDecoder(reader)
+	isArray := bytes.HasPrefix(bytes.TrimLeft(start, " \t\r\n"), []byte("["))
+	if isArray {
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("error decoding JSON data: %w", err)
+		}
+	}
+	for {
+		if isArray && !decoder.More() {
+			return nil
+		}
+		var event LogEvent
+		if err := decoder.Decode(&event); err == io.EOF && !isArray {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error decoding JSON data: %w", err)
+		}
+		event.ensureTyped()
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+// segmentWriter appends entries to the last segment of a session, or to a new one once it is full
+type segmentWriter struct {
+	dir      string
+	legacy   string              // Session saved as a single JSON array, taken over as the first segment on commit
+	existing map[uint64]struct{} // Keys of the committed entries, read on the first Contains
+
+	manifest    segmentManifest // Committed segments when the writer was opened
+	hadManifest bool            // Whether the session had a manifest when the writer was opened
+	takeLegacy  bool            // Whether the JSON array is committed as the first segment
+	segment     sessionSegment  // Segment the entries are appended to, with the new entries counted
+	isNew       bool            // Whether the segment is started by this writer
+	data, keys  *os.File
+	dataBuf     *bufio.Writer
+	keysBuf     *bufio.Writer
+}
+
+// open reads the committed segments and positions the writer behind the last committed entry
+func (w *segmentWriter) open() error {
+	if err := os.MkdirAll(w.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating session directory: %w", err)
+	}
+	manifest, err := readSegmentManifest(w.dir)
+	if err == nil {
+		w.hadManifest = true
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	} else if err := w.openLegacy(&manifest); err != nil {
+		return err
+	}
+	w.manifest = manifest
+
+	// Entries of a commit that did not finish are cut off the last segment
+	if last := len(manifest.Segments) - 1; last >= 0 && manifest.Segments[last].Name != legacySegmentName && manifest.Segments[last].Bytes < maxSegmentBytes {
+		w.segment = manifest.Segments[last]
+	} else {
+		w.segment = sessionSegment{Name: fmt.Sprintf("%06d.ndjson", manifest.Next+1)}
+		w.isNew = true
+	}
+	if w.data, err = openSegmentFile(filepath.Join(w.dir, w.segment.Name), w.segment.Bytes); err != nil {
+		return err
+	}
+	if w.keys, err = openSegmentFile(filepath.Join(w.dir, segmentKeysName(w.segment.Name)), int64(w.segment.Entries)*8); err != nil {
+		return err
+	}
+	w.dataBuf = bufio.NewWriterSize(w.data, 64*1024)
+	w.keysBuf = bufio.NewWriter(w.keys)
+	return nil
+}
+
+// openLegacy adds a session saved as a single JSON array to manifest as its first segment. The keys
+// of its entries are written next to it, the array itself is only linked in on commit.
+func (w *segmentWriter) openLegacy(manifest *segmentManifest) error {
+	file, err := os.Open(w.legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening existing JSON file: %w", err)
+	}
+	defer file.Close()
+	w.takeLegacy = true
+
+	keys, err := os.Create(filepath.Join(w.dir, segmentKeysName(legacySegmentName)))
+	if err != nil {
+		return fmt.Errorf("error creating session keys: %w", err)
+	}
+	defer keys.Close()
+	out := bufio.NewWriter(keys)
+	segment := sessionSegment{Name: legacySegmentName}
+	err = decodeSegment(file, func(event LogEvent) error {
+		binary.Write(out, binary.BigEndian, entryKey(event.FileDetail))
+		segment.Entries++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading existing entries: %w", err)
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("error writing session keys: %w", err)
+	}
+	if segment.Bytes, err = file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	manifest.Segments = append(manifest.Segments, segment)
+	return nil
+}
+
+// openSegmentFile opens a segment or keys file for appending behind its committed length
+func openSegmentFile(path string, committed int64) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening session segment: %w", err)
+	}
+	if err := file.Truncate(committed); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error truncating session segment: %w", err)
+	}
+	if _, err := file.Seek(committed, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Write appends a single log event to the segment
+func (w *segmentWriter) Write(event LogEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error encoding JSON data: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := w.dataBuf.Write(data); err != nil {
+		return err
+	}
+	if err := binary.Write(w.keysBuf, binary.BigEndian, entryKey(event.FileDetail)); err != nil {
+		return err
+	}
+	w.segment.Bytes += int64(len(data))
+	w.segment.Entries++
+	return nil
+}
+
+func (w *segmentWriter) Contains(key uint64) bool {
+	if w.existing == nil {
+		if err := w.loadKeys(); err != nil {
+			log.Printf("Error reading the keys of %s, duplicates are kept: %v\n", w.dir, err)
+		}
+	}
+	_, exists := w.existing[key]
+	return exists
+}
+
+// loadKeys reads the keys of the committed entries. Only uploads that drop duplicates need them,
+// so they are read on the first Contains rather than whenever a writer is opened.
+func (w *segmentWriter) loadKeys() error {
+	w.existing = map[uint64]struct{}{}
+	for _, segment := range w.manifest.Segments {
+		keys, err := os.ReadFile(filepath.Join(w.dir, segmentKeysName(segment.Name)))
+		if err != nil {
+			return fmt.Errorf("error reading session keys: %w", err)
+		}
+		for i := 0; i < segment.Entries && (i+1)*8 <= len(keys); i++ {
+			w.existing[binary.BigEndian.Uint64(keys[i*8:])] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (w *segmentWriter) Count() int {
+	count := w.segment.Entries
+	for _, segment := range w.manifest.Segments {
+		if segment.Name != w.segment.Name {
+			count += segment.Entries
+		}
+	}
+	return count
+}
+
+func (w *segmentWriter) Name() string {
+	return w.dir
+}
+
+// Commit makes the appended entries visible by replacing the manifest
+func (w *segmentWriter) Commit() error {
+	defer w.closeFiles()
+	if err := w.commit(); err != nil {
+		w.Abort()
+		return err
+	}
+	if w.isNew && w.segment.Entries == 0 {
+		w.removeSegment()
+	}
+	if w.takeLegacy {
+		os.Remove(w.legacy)
+	}
+	fmt.Printf("Session successfully saved to: %s\n", w.dir)
+	return nil
+}
+
+func (w *segmentWriter) commit() error {
+	for _, file := range []struct {
+		buf  *bufio.Writer
+		file *os.File
+	}{{w.dataBuf, w.data}, {w.keysBuf, w.keys}} {
+		if err := file.buf.Flush(); err != nil {
+			return fmt.Errorf("error writing session segment: %w", err)
+		}
+		if err := file.file.Sync(); err != nil {
+			return fmt.Errorf("error writing session segment: %w", err)
+		}
+	}
+	if w.takeLegacy {
+		link := filepath.Join(w.dir, legacySegmentName)
+		os.Remove(link)
+		if err := os.Link(w.legacy, link); err != nil {
+			return fmt.Errorf("error adding existing JSON file to the session: %w", err)
+		}
+	}
+
+	next := segmentManifest{Segments: append([]sessionSegment{}, w.manifest.Segments...), Next: w.manifest.Next}
+	switch {
+	case !w.isNew:
+		next.Segments[len(next.Segments)-1] = w.segment
+	case w.segment.Entries > 0:
+		next.Segments = append(next.Segments, w.segment)
+		next.Next++
+	case w.hadManifest:
+		// Nothing was added, the manifest stays as it is
+		return nil
+	}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(w.dir, "manifest-*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing session manifest: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(w.dir, segmentManifestFile))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing session manifest: %w", err)
+	}
+
+	// The rename, and the directory of a new session, only last a crash once their directories are synced
+	if err := syncDir(w.dir); err != nil {
+		return fmt.Errorf("error writing session manifest: %w", err)
+	}
+	if !w.hadManifest {
+		if err := syncDir(filepath.Dir(w.dir)); err != nil {
+			return fmt.Errorf("error writing session manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// syncDir flushes the entries of a directory to disk
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Abort cuts the uncommitted entries off again and leaves the committed segments untouched
+func (w *segmentWriter) Abort() {
+	if w.isNew {
+		w.removeSegment()
+	} else if len(w.manifest.Segments) > 0 {
+		committed := w.manifest.Segments[len(w.manifest.Segments)-1]
+		if w.data != nil {
+			w.data.Truncate(committed.Bytes)
+		}
+		if w.keys != nil {
+			w.keys.Truncate(int64(committed.Entries) * 8)
+		}
+	}
+	if !w.hadManifest {
+		os.RemoveAll(w.dir)
+	}
+	w.closeFiles()
+}
+
+// removeSegment removes a segment started by this writer that holds no committed entries
+func (w *segmentWriter) removeSegment() {
+	w.closeFiles()
+	os.Remove(filepath.Join(w.dir, w.segment.Name))
+	os.Remove(filepath.Join(w.dir, segmentKeysName(w.segment.Name)))
+}
+
+// closeFiles closes the segment and its keys file
+func (w *segmentWriter) closeFiles() {
+	if w.data != nil {
+		w.data.Close()
+		w.data = nil
+	}
+	if w.keys != nil {
+		w.keys.Close()
+		w.keys = nil
+	}
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentedSessionStoreCommit(t *testing.T) {
+	store := segmentedSessionStore{dir: t.TempDir()}
+	writeSession(t, store,
+		testEvent(0, "c1", "/api/a", "select 1"),
+		testEvent(1, "c2", "/api/b", "select 2"),
+	)
+	writeSession(t, store, testEvent(2, "c1", "/api/b", "select 1"))
+
+	events, err := store.ByCorrelationIDs(testTab, []string{"c1"})
+	assertThreadIDs(t, "ByCorrelationIDs(c1)", events, err, "t0", "t2")
+	events, err = store.ByRequestPath(testTab, "/api/b")
+	assertThreadIDs(t, "ByRequestPath", events, err, "t1", "t2")
+	events, err = store.ByQuery(testTab, "select 1")
+	assertThreadIDs(t, "ByQuery", events, err, "t0", "t2")
+
+	stat, err := store.Stat(testTab)
+	if err != nil || stat.Entries != 3 || stat.Bytes == 0 {
+		t.Errorf("Stat = %+v, %v, want 3 entries", stat, err)
+	}
+	var exported bytes.Buffer
+	if err := store.Export(testTab, &exported); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	var all []LogEvent
+	if err := json.Unmarshal(exported.Bytes(), &all); err != nil {
+		t.Fatalf("Export is not a JSON array: %v\n%s", err, exported.String())
+	}
+	assertThreadIDs(t, "Export", all, nil, "t0", "t1", "t2")
+
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	defer w.Abort()
+	if !w.Contains(entryKey(all[1].FileDetail)) || w.Contains(entryKey(testEvent(3, "c3", "/", "").FileDetail)) {
+		t.Error("Contains does not report exactly the committed entries")
+	}
+	if w.Count() != 3 {
+		t.Errorf("Count = %d, want 3", w.Count())
+	}
+
+	// Entries written but not yet committed are not visible
+	w.Write(testEvent(3, "c1", "/api/a", ""))
+	events, err = store.ByCorrelationIDs(testTab, []string{"c1"})
+	assertThreadIDs(t, "ByCorrelationIDs before the commit", events, err, "t0", "t2")
+}
+
+func TestSegmentedSessionStoreAbort(t *testing.T) {
+	store := segmentedSessionStore{dir: t.TempDir()}
+
+	// A session whose first writer aborts is not stored
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	w.Write(testEvent(0, "c1", "/api/a", ""))
+	w.Abort()
+	if exists, err := store.Exists(testTab); exists || err != nil {
+		t.Errorf("Exists after aborting the first writer = %v, %v", exists, err)
+	}
+	if _, err := store.ByRequestPath(testTab, "/api/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ByRequestPath of a missing session: %v, want os.ErrNotExist", err)
+	}
+	if sessions, err := store.Sessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("Sessions after aborting the first writer = %v, %v", sessions, err)
+	}
+
+	// Entries of an aborted writer are cut off the segment again
+	writeSession(t, store, testEvent(0, "c1", "/api/a", ""))
+	w, err = store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	for i := 1; i <= 100; i++ {
+		w.Write(testEvent(i, "c1", "/api/a", ""))
+	}
+	w.Abort()
+	events, err := store.ByCorrelationIDs(testTab, []string{"c1"})
+	assertThreadIDs(t, "ByCorrelationIDs after abort", events, err, "t0")
+
+	writeSession(t, store, testEvent(1, "c2", "/api/a", ""))
+	events, err = store.ByRequestPath(testTab, "/api/a")
+	assertThreadIDs(t, "ByRequestPath after the next commit", events, err, "t0", "t1")
+	if stat, err := store.Stat(testTab); err != nil || stat.Entries != 2 {
+		t.Errorf("Stat after the next commit = %+v, %v, want 2 entries", stat, err)
+	}
+}
+
+func TestSegmentedSessionStoreCrashRecovery(t *testing.T) {
+	store := segmentedSessionStore{dir: t.TempDir()}
+	writeSession(t, store, testEvent(0, "c1", "/api/a", "select 1"))
+
+	// A writer that is never committed or aborted leaves its entries behind the committed ones
+	opened, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	crashed := opened.(*segmentWriter)
+	for i := 1; i <= 10; i++ {
+		crashed.Write(testEvent(i, "c1", "/api/a", "select 1"))
+	}
+	crashed.dataBuf.Flush()
+	crashed.keysBuf.Flush()
+	crashed.closeFiles()
+
+	events, err := store.ByQuery(testTab, "select 1")
+	assertThreadIDs(t, "ByQuery while an uncommitted tail is stored", events, err, "t0")
+
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter after the crash: %v", err)
+	}
+	if w.Count() != 1 {
+		t.Errorf("Count after the crash = %d, want 1", w.Count())
+	}
+	if w.Contains(entryKey(testEvent(1, "c1", "/api/a", "select 1").FileDetail)) {
+		t.Error("Contains reports an entry that was never committed")
+	}
+	w.Write(testEvent(1, "c2", "/api/b", "select 2"))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	events, err = store.ByCorrelationIDs(testTab, []string{"c1", "c2"})
+	assertThreadIDs(t, "ByCorrelationIDs after recovery", events, err, "t0", "t1")
+	if stat, err := store.Stat(testTab); err != nil || stat.Entries != 2 {
+		t.Errorf("Stat after recovery = %+v, %v, want 2 entries", stat, err)
+	}
+}
+
+func TestSegmentedSessionStoreLegacyTakeover(t *testing.T) {
+	store := segmentedSessionStore{dir: t.TempDir()}
+
+	// Sessions were saved as a JSON array of untyped entries before
+	var legacy []FileDetail
+	for i := 0; i < 3; i++ {
+		legacy = append(legacy, testEvent(i, fmt.Sprintf("c%d", i), "/api/a", "").FileDetail)
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.legacyFileName(testTab), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.ByRequestPath(testTab, "/api/a")
+	assertThreadIDs(t, "ByRequestPath of the JSON array", events, err, "t0", "t1", "t2")
+	if len(events) > 0 && (events[0].Kind != CallHTTPResponse || events[0].Time.IsZero()) {
+		t.Errorf("entry of the JSON array = %+v, want it typed", events[0])
+	}
+	if stat, err := store.Stat(testTab); err != nil || stat.Entries != 3 {
+		t.Errorf("Stat of the JSON array = %+v, %v, want 3 entries", stat, err)
+	}
+
+	// The next writer links the array in as the first segment and removes it on commit
+	w, err := store.OpenWriter(testTab)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	if w.Count() != 3 || !w.Contains(entryKey(legacy[1])) {
+		t.Errorf("writer on the JSON array: Count = %d, Contains of its entries = %v", w.Count(), w.Contains(entryKey(legacy[1])))
+	}
+	w.Write(testEvent(3, "c3", "/api/a", ""))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if _, err := os.Stat(store.legacyFileName(testTab)); !os.IsNotExist(err) {
+		t.Errorf("JSON array after the commit: %v, want it removed", err)
+	}
+	if _, err := os.Stat(filepath.Join(store.sessionDir(testTab), legacySegmentName)); err != nil {
+		t.Errorf("first segment: %v", err)
+	}
+	events, err = store.ByRequestPath(testTab, "/api/a")
+	assertThreadIDs(t, "ByRequestPath after the takeover", events, err, "t0", "t1", "t2", "t3")
+	if sessions, err := store.Sessions(); err != nil || fmt.Sprint(sessions) != fmt.Sprint([]string{testTab}) {
+		t.Errorf("Sessions = %v, %v, want only %s", sessions, err, testTab)
+	}
+
+	// A session whose JSON array could not be taken over keeps it
+	other := testTab[:len(testTab)-1] + "1"
+	if err := os.WriteFile(store.legacyFileName(other), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err = store.OpenWriter(other)
+	if err != nil {
+		t.Fatalf("OpenWriter: %v", err)
+	}
+	w.Write(testEvent(3, "c3", "/api/a", ""))
+	w.Abort()
+	events, err = store.ByRequestPath(other, "/api/a")
+	assertThreadIDs(t, "ByRequestPath after an aborted takeover", events, err, "t0", "t1", "t2")
+}
+
+func TestSegmentedSessionStoreDelete(t *testing.T) {
+	store := segmentedSessionStore{dir: t.TempDir()}
+	writeSession(t, store, testEvent(0, "c1", "/api/a", ""))
+
+	// A JSON array left behind next to the segments is deleted too
+	if err := os.WriteFile(store.legacyFileName(testTab), []byte("[]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(testTab); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if exists, err := store.Exists(testTab); exists || err != nil {
+		t.Errorf("Exists after Delete = %v, %v", exists, err)
+	}
+	if _, err := store.Stat(testTab); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete: %v, want os.ErrNotExist", err)
+	}
+	if sessions, err := store.Sessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("Sessions after Delete = %v, %v", sessions, err)
+	}
+	if err := store.Delete(testTab); err != nil {
+		t.Errorf("Delete of a missing session: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// sessionExportPeekBytes is how much of an uploaded file is looked at to recognise a session export
+const sessionExportPeekBytes = 4096
+
+// isSessionExport reports whether a file that starts with start is a session file, a JSON array of
+// entries, rather than a log file
+func isSessionExport(start []byte) bool {
+	start = bytes.TrimLeft(bytes.TrimPrefix(start, utf8BOM), " \t\r\n")
+	if !bytes.HasPrefix(start, []byte("[")) {
+		return false
+	}
+	first := bytes.TrimLeft(start[1:], " \t\r\n")
+	return bytes.HasPrefix(first, []byte("{")) && bytes.Contains(first, []byte(`"callType"`))
+}
+
+// importSessionEntries reads the entries of an exported session file and hands them to emit as they
+// were saved, so the statistics and drill-downs of the session are restored without the original
+// logs. Entries keep the source they were originally read from.
+func importSessionEntries(file io.Reader, source string, analysis *logAnalysis, emit func(LogEvent, lineRef) error) error {
+	analysis.sources = append(analysis.sources, source)
+
+	decoder := json.NewDecoder(file)
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("error decoding session file %s: %w", source, err)
+	}
+	for number := 1; decoder.More(); number++ {
+		var event LogEvent
+		if err := decoder.Decode(&event); err != nil {
+			return fmt.Errorf("error decoding entry %d of session file %s: %w", number, source, err)
+		}
+		event.ensureTyped()
+		if event.Source == "" {
+			event.Source = source
+		}
+		if err := emit(event, lineRef{source: source, number: number}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportSessionHandler serves the session of a tab as a JSON download, which can be uploaded into
+// another tab or on another server to restore the analysis
+func ExportSessionHandler(w http.ResponseWriter, r *http.Request) {
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
+		return
+	}
+
+	download := &exportWriter{w: w}
+	err := sessionStore.Export(tabUUID, download)
+	switch {
+	case err == nil:
+	case download.started:
+		// The response is already under way, so the download is only cut short
+		log.Printf("Error exporting session %s: %v\n", tabUUID, err)
+	default:
+		writeSessionError(w, err)
+	}
+}
+
+// exportWriter sets the download headers when the session store starts writing, so a session that
+// cannot be opened still gets a plain error response
+type exportWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		e.w.Header().Set("Content-Type", "application/json")
+		e.w.Header().Set("Content-Disposition", `attachment; filename="session.json"`)
+	}
+	return e.w.Write(p)
+}
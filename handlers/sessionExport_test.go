@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestIsSessionExport(t *testing.T) {
+	for start, want := range map[string]bool{
+		`[{"timestamp":"2024-05-01 10:00:00,000","callType":"DB"}]`:                  true,
+		"\xef\xbb\xbf \n[\n  {\n    \"correlationId\": \"c1\", \"callType\": \"DB\"": true,
+		`[]`: false,
+		`[{"timestamp":"2024-05-01 10:00:00,000"}]`:                   false,
+		`{"callType":"DB"}`:                                           false,
+		`2024-05-01 10:00:00,000|c1|t1|5|DB|2024-05-01|query||/api/a`: false,
+		`[1, {"callType":"DB"}]`:                                      false,
+	} {
+		if got := isSessionExport([]byte(start)); got != want {
+			t.Errorf("isSessionExport(%q) = %v, want %v", start, got, want)
+		}
+	}
+}
+
+// exportSession downloads the session of a tab
+func exportSession(tabUUID string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ExportSessionHandler(w, httptest.NewRequest(http.MethodGet, "/session/export?tabUUID="+tabUUID, nil))
+	return w
+}
+
+func TestSessionExportImport(t *testing.T) {
+	useTestServerDir(t)
+	tests := []struct {
+		name     string
+		from, to string
+		fields   map[string]string
+	}{
+		{"complete", "1f6c4a7e-9b0d-4c8e-8fb6-d7e8f90a1b8c", "2a7d5b8f-0c1e-4d9f-9ac7-e8f90a1b2c9d", nil},
+		{"sampled", "3b8e6c9a-1d2f-4eaa-8bd8-f90a1b2c3dae", "4c9f7dab-2e3a-4fbb-9ce9-0a1b2c3d4ebf", map[string]string{"sampling": "every", "sampleRate": "3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() { forgetTabStats(test.from, test.to) })
+			for upload := 0; upload < 2; upload++ {
+				if w := postUploadForm(test.from, "app.log", testUploadLog(upload, 30), test.fields); w.Code != http.StatusOK {
+					t.Fatalf("upload %d: %d %s", upload, w.Code, w.Body.String())
+				}
+			}
+			w := exportSession(test.from)
+			if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") == "" {
+				t.Fatalf("export: %d %v", w.Code, w.Header())
+			}
+			exported := w.Body.String()
+
+			// The export uploaded into another tab restores the entries and statistics of the session
+			if w := postUpload(test.to, "session.json", exported); w.Code != http.StatusOK {
+				t.Fatalf("import: %d %s", w.Code, w.Body.String())
+			}
+			var from, to []LogEvent
+			if err := json.Unmarshal([]byte(exported), &from); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(exportSession(test.to).Body.Bytes(), &to); err != nil {
+				t.Fatal(err)
+			}
+			if len(from) == 0 || !reflect.DeepEqual(to, from) {
+				t.Errorf("imported session holds %d entries, want the %d exported ones unchanged", len(to), len(from))
+			}
+			fromPaths, fromQueries := tabStats(test.from)
+			toPaths, toQueries := tabStats(test.to)
+			if !reflect.DeepEqual(toPaths, fromPaths) || !reflect.DeepEqual(toQueries, fromQueries) {
+				t.Errorf("stats of the imported session = %+v, want %+v", toPaths["/api/orders"], fromPaths["/api/orders"])
+			}
+			if stats := toPaths["/api/orders"]; stats == nil || stats.Estimated != (test.fields != nil) {
+				t.Errorf("stats of /api/orders = %+v, want them estimated only from a sample", stats)
+			}
+
+			// Importing the export again adds no entries
+			if w := postUpload(test.to, "session.json", exported); w.Code != http.StatusOK {
+				t.Fatalf("second import: %d %s", w.Code, w.Body.String())
+			}
+			if stat, err := sessionStore.Stat(test.to); err != nil || stat.Entries != len(from) {
+				t.Errorf("session after the second import = %+v, %v, want %d entries", stat, err, len(from))
+			}
+		})
+	}
+}
+
+func TestExportSessionErrors(t *testing.T) {
+	useTestServerDir(t)
+	for tabUUID, want := range map[string]int{
+		"":                                     http.StatusBadRequest,
+		"../uploads":                           http.StatusBadRequest,
+		"5dab8ebc-3f4b-4acc-8dfa-1b2c3d4e5fca": http.StatusNotFound,
+	} {
+		if w := exportSession(tabUUID); w.Code != want || w.Header().Get("Content-Disposition") != "" {
+			t.Errorf("export of %q: %d %v, want %d", tabUUID, w.Code, w.Header(), want)
+		}
+	}
+}
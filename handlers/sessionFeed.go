@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// maxFeedBatchLines caps the lines added to the session at once, so a feed that receives a lot
+// of lines at once, e.g. a large file followed from the start, shows progress
+const maxFeedBatchLines = 50000
+
+// feedCommitInterval is how long a batch collects lines before it is saved, so a trickle of lines
+// does not commit the session and append to the diagnostics report every time a few arrive
+const feedCommitInterval = 5 * time.Second
+
+// sessionFeed adds lines that arrive over time to a session in batches. Every batch is saved to
+// the session file and merged into the tab's statistics, while running totals over all batches
+// are kept for status requests.
+type sessionFeed struct {
+	tabUUID   string
+	filter    *ruleFilter
+	assembler *entryAssembler
+
+	// Only used by the goroutine feeding lines
+	batch        *logAnalysis
+	batchLines   int
+	batchStarted time.Time
+	batches      int
+
+	mu       sync.Mutex   // Guards the fields below, which are read by status requests
+	totals   *logAnalysis // Time buckets and overall counters of every batch
+	entries  int          // Entries in the session file, including earlier uploads
+	rejected int          // Lines rejected or only partially parsed
+}
+
+// newSessionFeed creates a feed for tabUUID whose lines come from source. Like an uploaded file,
+// the source detects its formats with a parser of its own.
+func newSessionFeed(tabUUID, source string, parser *lineParser, filter *ruleFilter) *sessionFeed {
+	return &sessionFeed{
+		tabUUID:   tabUUID,
+		filter:    filter,
+		assembler: &entryAssembler{parser: parser.forFile(), source: source, timestamps: newTimestampParser(parser.location)},
+		totals:    newLogAnalysis(nil, nil, nil),
+	}
+}
+
+// add assembles a line into the current batch, committing the batch once it is large
+func (s *sessionFeed) add(at lineRef) error {
+	if err := s.startBatch(); err != nil {
+		return err
+	}
+	s.batchLines++
+	if err := s.assembler.addLine(at); err != nil {
+		return err
+	}
+	if s.batchLines >= maxFeedBatchLines {
+		return s.commit()
+	}
+	return nil
+}
+
+// skip records a line that is too long to be read, like readLogEntries does for an uploaded file
+func (s *sessionFeed) skip(at lineRef) error {
+	if err := s.startBatch(); err != nil {
+		return err
+	}
+	s.batchLines++
+	s.batch.diagnostics.record(at, reasonLineTooLong)
+	if s.batchLines >= maxFeedBatchLines {
+		return s.commit()
+	}
+	return nil
+}
+
+// flush adds the lines held back for continuation lines, which is done once no more lines arrived for a while
+func (s *sessionFeed) flush() error {
+	if !s.assembler.holding() {
+		return nil
+	}
+	if err := s.startBatch(); err != nil {
+		return err
+	}
+	return s.assembler.flush()
+}
+
+// startBatch starts a batch for the following lines unless one is already started. Like an
+// upload, the first batch replaces the diagnostics report of earlier uploads.
+func (s *sessionFeed) startBatch() error {
+	if s.batch != nil {
+		return nil
+	}
+	batch, err := newSessionAnalysis(s.tabUUID, s.filter, s.batches > 0)
+	if err != nil {
+		return err
+	}
+	batch.sources = []string{s.assembler.source}
+	s.batch = batch
+	s.batchStarted = time.Now()
+	s.assembler.analysis = batch
+	s.assembler.emit = batch.add
+	return nil
+}
+
+// commitDue commits the current batch once it collected lines for feedCommitInterval
+func (s *sessionFeed) commitDue() error {
+	if s.batch == nil || time.Since(s.batchStarted) < feedCommitInterval {
+		return nil
+	}
+	return s.commit()
+}
+
+// commit saves the entries of the current batch to the session, which merges its statistics into the tab
+func (s *sessionFeed) commit() error {
+	if s.batch == nil {
+		return nil
+	}
+	batch := s.batch
+	s.batch = nil
+	s.batchLines = 0
+
+	batch.computeStats()
+	if err := batch.commit(); err != nil {
+		return err
+	}
+	s.batches++
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totals.mergeTotals(batch)
+	s.entries = batch.session.Count()
+	s.rejected += batch.diagnostics.Total
+	return nil
+}
+
+// abort discards the current batch
+func (s *sessionFeed) abort() {
+	if s.batch != nil {
+		s.batch.abort()
+		s.batch = nil
+		s.batchLines = 0
+	}
+}
+
+// timeBuckets returns a copy of the time buckets of every batch without their durations
+func (s *sessionFeed) timeBuckets() map[string]*TimeBucketStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets := map[string]*TimeBucketStats{}
+	for key, bucket := range s.totals.timeBuckets {
+		bucket := *bucket
+		bucket.durations = durationSketch{}
+		buckets[key] = &bucket
+	}
+	return buckets
+}
+
+// overallStats returns the overall statistics of every batch
+func (s *sessionFeed) overallStats() OverallStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totals.overallStats()
+}
+
+// counts returns the number of entries in the session and of lines rejected or only partially parsed
+func (s *sessionFeed) counts() (entries, rejected int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries, s.rejected
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+// sessionNamePattern limits session IDs to characters that are safe in a file name
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// maxSessionIDLength keeps the file names of a session within what file systems allow
+const maxSessionIDLength = 128
+
+var (
+	// errInvalidSessionID is returned for a session ID that is missing or cannot be used in a file name
+	errInvalidSessionID = fmt.Errorf("invalid session ID, use up to %d letters, digits, '.', '_' and '-'", maxSessionIDLength)
+
+	// errSessionNotFound is returned for a valid session ID that no session is stored under
+	errSessionNotFound = fmt.Errorf("session not found: %w", os.ErrNotExist)
+)
+
+// validateSessionID checks that tabUUID can name a session before any path is built from it
+func validateSessionID(tabUUID string) error {
+	if len(tabUUID) > maxSessionIDLength || !sessionNamePattern.MatchString(tabUUID) {
+		return errInvalidSessionID
+	}
+	return nil
+}
+
+// resolveSession checks that a session is stored under exactly tabUUID. It fails with
+// errInvalidSessionID or errSessionNotFound, any other error means the store could not be read.
+func resolveSession(tabUUID string) error {
+	if err := validateSessionID(tabUUID); err != nil {
+		return err
+	}
+	exists, err := sessionStore.Exists(tabUUID)
+	if err != nil {
+		return fmt.Errorf("error reading session %s: %w", tabUUID, err)
+	}
+	if !exists {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+// sessionParam resolves the session named by a query or form parameter. Errors are written to w.
+func sessionParam(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
+	tabUUID := r.FormValue(name)
+	if err := resolveSession(tabUUID); err != nil {
+		writeSessionError(w, err)
+		return "", false
+	}
+	return tabUUID, true
+}
+
+// writeSessionError answers a request whose session could not be resolved or read: 400 for an
+// invalid ID, 404 for a session that does not exist and 500 for a failure of the store
+func writeSessionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidSessionID):
+		http.Error(w, "Tab UUID parameter is missing or invalid", http.StatusBadRequest)
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "No session found for this tab", http.StatusNotFound)
+	default:
+		log.Printf("Error loading session: %v\n", err)
+		http.Error(w, "Failed to load the session", http.StatusInternalServerError)
+	}
+}
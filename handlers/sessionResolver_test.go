@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateSessionID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"5b0e8c1a-3d4f-4e2a-9b6c-7d8e9f0a1b2c":    true,
+		"syslog-web01.example.com":                true,
+		"A_1":                                     true,
+		strings.Repeat("a", maxSessionIDLength):   true,
+		strings.Repeat("a", maxSessionIDLength+1): false,
+		"":             false,
+		".hidden":      false,
+		"-flag":        false,
+		"../uploads":   false,
+		"a/b":          false,
+		`a\b`:          false,
+		"a b":          false,
+		"a\x00":        false,
+		"résumé":       false,
+		"session.json": true,
+	} {
+		err := validateSessionID(id)
+		if (err == nil) != want || (err != nil && !errors.Is(err, errInvalidSessionID)) {
+			t.Errorf("validateSessionID(%q) = %v, want valid %v", id, err, want)
+		}
+	}
+}
+
+// failingSessionStore is a store whose sessions cannot be read
+type failingSessionStore struct {
+	SessionStore
+}
+
+func (failingSessionStore) Exists(tabUUID string) (bool, error) {
+	return false, errors.New("disk on fire")
+}
+
+func TestResolveSession(t *testing.T) {
+	useTestServerDir(t)
+	tab := "2ebcaafd-0abc-4dde-9e6b-8c9daebfcadb"
+	t.Cleanup(func() { forgetTabStats(tab) })
+	if w := postUpload(tab, "app.log", testUploadLog(0, 5)); w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body.String())
+	}
+
+	// Only a session stored under exactly the ID resolves, not one whose name contains it
+	tests := []struct {
+		id   string
+		want error
+		code int
+	}{
+		{tab, nil, http.StatusOK},
+		{tab[:8], errSessionNotFound, http.StatusNotFound},
+		{tab[1:], errSessionNotFound, http.StatusNotFound},
+		{tab + "0", errSessionNotFound, http.StatusNotFound},
+		{strings.ToUpper(tab), errSessionNotFound, http.StatusNotFound},
+		{"", errInvalidSessionID, http.StatusBadRequest},
+		{"../" + tab, errInvalidSessionID, http.StatusBadRequest},
+		{tab + ".segments", errSessionNotFound, http.StatusNotFound},
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := sessionParam(w, r, "tabUUID"); ok {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	for _, test := range tests {
+		if err := resolveSession(test.id); err != test.want {
+			t.Errorf("resolveSession(%q) = %v, want %v", test.id, err, test.want)
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/?tabUUID="+test.id, nil))
+		if w.Code != test.code {
+			t.Errorf("request for %q: %d, want %d", test.id, w.Code, test.code)
+		}
+	}
+
+	// A store that cannot be read is neither a missing nor an invalid session
+	previous := sessionStore
+	sessionStore = failingSessionStore{previous}
+	t.Cleanup(func() { sessionStore = previous })
+	err := resolveSession(tab)
+	if err == nil || errors.Is(err, errSessionNotFound) || errors.Is(err, errInvalidSessionID) {
+		t.Errorf("resolveSession with a failing store = %v, want a read error", err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/?tabUUID="+tab, nil))
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "disk on fire") {
+		t.Errorf("request with a failing store: %d %q, want %d without the cause", w.Code, w.Body.String(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionStore saves the entries of every session and looks them up for the drill-down pages
+type SessionStore interface {
+	// OpenWriter starts adding entries to a session, which is created if it does not exist yet.
+	// The caller holds the session's lock from lockSession until the writer is committed or
+	// aborted, so no other writer of the session starts meanwhile.
+	OpenWriter(tabUUID string) (SessionWriter, error)
+
+	// Export writes every entry of a session as a JSON array, which can be uploaded again.
+	// Nothing is written if the session does not exist.
+	Export(tabUUID string, w io.Writer) error
+
+	// ByCorrelationIDs, ByRequestPath and ByQuery return the entries with one of the correlation IDs,
+	// the request path or the request query, in the order they were added. They fail with an error
+	// wrapping os.ErrNotExist if the session does not exist.
+	ByCorrelationIDs(tabUUID string, ids []string) ([]LogEvent, error)
+	ByRequestPath(tabUUID, path string) ([]LogEvent, error)
+	ByQuery(tabUUID, query string) ([]LogEvent, error)
+
+	// Exists reports whether a session is stored under exactly tabUUID
+	Exists(tabUUID string) (bool, error)
+
+	// Sessions returns the names of the stored sessions. Stat fails with an error wrapping
+	// os.ErrNotExist for a session whose first upload is not committed yet.
+	Sessions() ([]string, error)
+	Stat(tabUUID string) (SessionStat, error)
+
+	// Delete removes a session. The caller holds the session's lock, so no writer is open.
+	// Deleting a missing session is not an error.
+	Delete(tabUUID string) error
+}
+
+// SessionStat describes the stored entries of a session
+type SessionStat struct {
+	Entries  int
+	Bytes    int64     // Size of the session on disk
+	Modified time.Time // When entries were last committed
+}
+
+// SessionWriter adds entries to a session. Readers see none of them until Commit.
+type SessionWriter interface {
+	Write(event LogEvent) error
+	Contains(key uint64) bool // Whether the session held an entry with this entryKey before the writer was opened
+	Count() int               // Entries in the session, including the ones written before
+	Name() string             // Where the session is stored, for messages
+	Commit() error
+	Abort()
+}
+
+// sessionStore is the store every session is saved in, selected at startup with SetSessionStore
+var sessionStore SessionStore = segmentedSessionStore{dir: "uploads"}
+
+// SetSessionStore selects where sessions are saved: "json" keeps every session in append-only
+// segments of JSON lines, "indexed" in an embedded store indexed by correlation ID, request path and
+// query, which answers drill-downs without reading the whole session. Sessions of the other store are not visible.
+func SetSessionStore(name string) error {
+	switch name {
+	case "json":
+		sessionStore = segmentedSessionStore{dir: "uploads"}
+	case "indexed":
+		sessionStore = indexedSessionStore{dir: "uploads"}
+	default:
+		return fmt.Errorf("unknown session store %q, expected json or indexed", name)
+	}
+	return nil
+}
+
+// sessionLocks serializes the changes to each session: its writers, which hold the lock until the
+// metadata and the statistics of the tab are updated as well, and deleting it. A writer that started
+// before another one commits would not see its entries.
+var (
+	sessionLocksMu sync.Mutex
+	sessionLocks   = map[string]*sync.Mutex{}
+)
+
+// lockSession waits until no other change to tabUUID is under way and returns the held lock
+func lockSession(tabUUID string) *sync.Mutex {
+	sessionLocksMu.Lock()
+	lock, exists := sessionLocks[tabUUID]
+	if !exists {
+		lock = &sync.Mutex{}
+		sessionLocks[tabUUID] = lock
+	}
+	sessionLocksMu.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+// dirBytes returns the size of the files in dir
+func dirBytes(dir string) int64 {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, file := range files {
+		if info, err := file.Info(); err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// sessionsWithSuffix returns the session names of the entries of dir that end in suffix
+func sessionsWithSuffix(dir, suffix string, wantDir bool) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() != wantDir || filepath.Ext(name) != suffix {
+			continue
+		}
+		if name = name[:len(name)-len(suffix)]; validateSessionID(name) == nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// stringSet returns the set of the given strings
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// sortUint64s sorts a slice of sequence numbers in ascending order
+func sortUint64s(values []uint64) {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+}
@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// sessionMetaDir holds what is known about every session besides its entries, one JSON file per session
+const sessionMetaDir = "uploads/sessions"
+
+// maxSessionNameLength caps the length of the name a session can be given
+const maxSessionNameLength = 100
+
+// sessionJanitorInterval is how often the janitor looks for expired sessions, unless the TTL is shorter
+const sessionJanitorInterval = 10 * time.Minute
+
+// sessionMeta is what is known about a session besides its entries
+type sessionMeta struct {
+	Name       string    `json:"name,omitempty"`
+	Created    time.Time `json:"created"`
+	LastUpload time.Time `json:"lastUpload"`
+	Sources    []string  `json:"sources,omitempty"` // Files and archive members of every upload, without repeats
+}
+
+// sessionMetaMu serializes changes to the metadata files
+var sessionMetaMu sync.Mutex
+
+// SessionInfo describes a stored session on the sessions page and in the sessions API
+type SessionInfo struct {
+	ID         string
+	Name       string
+	Entries    int
+	Bytes      int64
+	Sources    []string
+	Created    time.Time
+	LastUpload time.Time
+	Following  bool // A file is followed into the session, so it is never expired
+}
+
+// sessionMetaFileName returns the path of the metadata file of a session
+func sessionMetaFileName(tabUUID string) string {
+	return filepath.Join(sessionMetaDir, tabUUID+".json")
+}
+
+// loadSessionMeta reads the metadata of a session. Sessions saved before metadata was kept have none.
+func loadSessionMeta(tabUUID string) (sessionMeta, error) {
+	var meta sessionMeta
+	data, err := os.ReadFile(sessionMetaFileName(tabUUID))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("error decoding session metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// updateSessionMeta changes the metadata of a session with update and saves it by rename
+func updateSessionMeta(tabUUID string, update func(*sessionMeta)) error {
+	sessionMetaMu.Lock()
+	defer sessionMetaMu.Unlock()
+
+	meta, err := loadSessionMeta(tabUUID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	update(&meta)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(sessionMetaDir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(sessionMetaDir, tabUUID+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sessionMetaFileName(tabUUID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// recordSessionUpload notes the time and sources of an upload that was committed to a session.
+// Failures are only logged, since the entries themselves are already saved.
+func recordSessionUpload(tabUUID string, sources []string) {
+	if tabUUID == "" {
+		return
+	}
+	err := updateSessionMeta(tabUUID, func(meta *sessionMeta) {
+		meta.LastUpload = time.Now()
+		if meta.Created.IsZero() {
+			meta.Created = meta.LastUpload
+		}
+		known := stringSet(meta.Sources)
+		for _, source := range sources {
+			if !known[source] {
+				known[source] = true
+				meta.Sources = append(meta.Sources, source)
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("Error saving metadata of session %s: %v\n", tabUUID, err)
+	}
+}
+
+// sessionInfo describes a stored session. It fails with an error wrapping os.ErrNotExist if the
+// session does not exist.
+func sessionInfo(tabUUID string) (SessionInfo, error) {
+	stat, err := sessionStore.Stat(tabUUID)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	meta, err := loadSessionMeta(tabUUID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error reading metadata of session %s: %v\n", tabUUID, err)
+	}
+
+	info := SessionInfo{
+		ID:         tabUUID,
+		Name:       meta.Name,
+		Entries:    stat.Entries,
+		Bytes:      stat.Bytes,
+		Sources:    meta.Sources,
+		Created:    meta.Created,
+		LastUpload: meta.LastUpload,
+		Following:  isFollowing(tabUUID),
+	}
+	if diagnostics, err := os.Stat(diagnosticsFileName(tabUUID)); err == nil {
+		info.Bytes += diagnostics.Size()
+	}
+	if info.LastUpload.IsZero() {
+		info.LastUpload = stat.Modified
+	}
+	if info.Created.IsZero() {
+		info.Created = info.LastUpload
+	}
+	return info, nil
+}
+
+// listSessions describes every stored session, the most recently uploaded to first
+func listSessions() ([]SessionInfo, error) {
+	ids, err := sessionStore.Sessions()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []SessionInfo
+	for _, id := range ids {
+		info, err := sessionInfo(id)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error reading session %s: %v\n", id, err)
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUpload.After(sessions[j].LastUpload) })
+	return sessions, nil
+}
+
+// isFollowing reports whether a file is currently followed into the session
+func isFollowing(tabUUID string) bool {
+	followersMu.Lock()
+	f := followers[tabUUID]
+	followersMu.Unlock()
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status.Following
+}
+
+// deleteSession stops following a file into the session and removes its entries, diagnostics
+// report, metadata and the statistics of the tab. An upload that is under way finishes first.
+func deleteSession(tabUUID string) error {
+	stopFollowing(tabUUID)
+	lock := lockSession(tabUUID)
+	defer lock.Unlock()
+	return removeSession(tabUUID)
+}
+
+// deleteExpiredSession deletes the session if nothing was uploaded to it for ttl. The age is checked
+// again under the session's lock, so an upload that committed since the session was listed keeps it.
+func deleteExpiredSession(tabUUID string, ttl time.Duration) error {
+	lock := lockSession(tabUUID)
+	defer lock.Unlock()
+	session, err := sessionInfo(tabUUID)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if session.Following || time.Since(session.LastUpload) <= ttl {
+		return nil
+	}
+	log.Printf("Removing session %s, last upload %s\n", session.ID, session.LastUpload.Format(time.RFC3339))
+	return removeSession(tabUUID)
+}
+
+// stopFollowing stops following a file into the session, if one is followed
+func stopFollowing(tabUUID string) {
+	followersMu.Lock()
+	f := followers[tabUUID]
+	delete(followers, tabUUID)
+	followersMu.Unlock()
+	if f != nil {
+		f.halt()
+	}
+}
+
+// removeSession removes the entries, diagnostics report, metadata and tab statistics of a session.
+// The caller holds the session's lock.
+func removeSession(tabUUID string) error {
+	if err := sessionStore.Delete(tabUUID); err != nil {
+		return err
+	}
+	if err := os.Remove(diagnosticsFileName(tabUUID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sessionMetaMu.Lock()
+	err := os.Remove(sessionMetaFileName(tabUUID))
+	sessionMetaMu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tabStatsMu.Lock()
+	defer tabStatsMu.Unlock()
+	delete(requestPathStats, tabUUID)
+	delete(queryMetricsMap, tabUUID)
+	return nil
+}
+
+// StartSessionJanitor deletes sessions in the background once nothing was uploaded to them for ttl.
+// Sessions a file is followed into are kept. A ttl of 0 keeps every session.
+func StartSessionJanitor(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	interval := sessionJanitorInterval
+	if ttl < interval {
+		interval = ttl
+	}
+	go func() {
+		for {
+			removeExpiredSessions(ttl)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// removeExpiredSessions deletes the sessions nothing was uploaded to for ttl. The list is only a
+// first pick, every session is checked again before it is deleted.
+func removeExpiredSessions(ttl time.Duration) {
+	sessions, err := listSessions()
+	if err != nil {
+		log.Printf("Error listing sessions: %v\n", err)
+		return
+	}
+	for _, session := range sessions {
+		if session.Following || time.Since(session.LastUpload) <= ttl {
+			continue
+		}
+		if err := deleteExpiredSession(session.ID, ttl); err != nil {
+			log.Printf("Error removing session %s: %v\n", session.ID, err)
+		}
+	}
+}
+
+// SessionsHandler serves the page that lists the stored sessions
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := listSessions()
+	if err != nil {
+		log.Printf("Error listing sessions: %v\n", err)
+		http.Error(w, "Failed to list the sessions", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("sessions.html").Funcs(template.FuncMap{"formatBytes": formatBytes}).ParseFiles("template/sessions.html")
+	if err != nil {
+		http.Error(w, "Error loading template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := tmpl.Execute(w, struct{ Sessions []SessionInfo }{sessions}); err != nil {
+		log.Printf("Error rendering template: %v\n", err)
+	}
+}
+
+// SessionsAPIHandler returns the stored sessions as JSON
+func SessionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := listSessions()
+	if err != nil {
+		log.Printf("Error listing sessions: %v\n", err)
+		http.Error(w, "Failed to list the sessions", http.StatusInternalServerError)
+		return
+	}
+	if sessions == nil {
+		sessions = []SessionInfo{}
+	}
+	writeSessionsResponse(w, sessions)
+}
+
+// SessionRenameHandler gives the session tabUUID the human readable name from the form. An empty
+// name removes the name again.
+func SessionRenameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if utf8.RuneCountInString(name) > maxSessionNameLength {
+		http.Error(w, fmt.Sprintf("The name can be at most %d characters long", maxSessionNameLength), http.StatusBadRequest)
+		return
+	}
+
+	if err := updateSessionMeta(tabUUID, func(meta *sessionMeta) { meta.Name = name }); err != nil {
+		log.Printf("Error renaming session %s: %v\n", tabUUID, err)
+		http.Error(w, "Failed to rename the session", http.StatusInternalServerError)
+		return
+	}
+	info, err := sessionInfo(tabUUID)
+	if err != nil {
+		log.Printf("Error reading session %s: %v\n", tabUUID, err)
+		http.Error(w, "Failed to read the session", http.StatusInternalServerError)
+		return
+	}
+	writeSessionsResponse(w, info)
+}
+
+// SessionDeleteHandler deletes the session tabUUID with its diagnostics report and statistics
+func SessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	tabUUID, ok := sessionParam(w, r, "tabUUID")
+	if !ok {
+		return
+	}
+	if err := deleteSession(tabUUID); err != nil {
+		log.Printf("Error deleting session %s: %v\n", tabUUID, err)
+		http.Error(w, "Failed to delete the session", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Deleted session %s\n", tabUUID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeSessionsResponse writes sessions as JSON
+func writeSessionsResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error writing sessions response: %v\n", err)
+	}
+}
+
+// formatBytes formats a size for the sessions page
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	size, prefix := float64(bytes)/unit, 0
+	for size >= unit && prefix < 3 {
+		size /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", size, "KMGT"[prefix])
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveExpiredSessions(t *testing.T) {
+	useTestServerDir(t)
+	store := sessionStore.(segmentedSessionStore)
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name        string
+		tab         string
+		prepare     func(tab string) // Ages the session after its upload
+		wantRemoved bool
+	}{
+		{"recent upload", "6ebc9fcd-4a5c-4bdd-9e0b-2c3d4e5f6adb", func(string) {}, false},
+		{
+			"old upload", "7fcdaade-5b6d-4cee-8f1c-3d4e5f6a7bec",
+			func(tab string) { updateSessionMeta(tab, func(meta *sessionMeta) { meta.LastUpload = old }) },
+			true,
+		},
+		{
+			"old upload of a followed file", "8adebbef-6c7e-4dff-9a2d-4e5f6a7b8cfd",
+			func(tab string) {
+				updateSessionMeta(tab, func(meta *sessionMeta) { meta.LastUpload = old })
+				followersMu.Lock()
+				followers[tab] = &follower{tabUUID: tab, status: FollowStatus{Following: true}}
+				followersMu.Unlock()
+			},
+			false,
+		},
+		{
+			"old session without metadata", "9befccfa-7d8f-4aab-8b3e-5f6a7b8c9dae",
+			func(tab string) {
+				os.Remove(sessionMetaFileName(tab))
+				os.Chtimes(filepath.Join(store.sessionDir(tab), segmentManifestFile), old, old)
+			},
+			true,
+		},
+		{"recent session without metadata", "0cfaddab-8e9a-4bbc-9c4f-6a7b8c9daebf", func(tab string) { os.Remove(sessionMetaFileName(tab)) }, false},
+	}
+	for i, test := range tests {
+		t.Cleanup(func() { forgetTabStats(test.tab) })
+		if w := postUpload(test.tab, "app.log", testUploadLog(i, 5)+"not a log line\n"); w.Code != http.StatusOK {
+			t.Fatalf("upload to %s: %d %s", test.tab, w.Code, w.Body.String())
+		}
+		test.prepare(test.tab)
+	}
+	t.Cleanup(func() {
+		followersMu.Lock()
+		delete(followers, tests[2].tab)
+		followersMu.Unlock()
+	})
+
+	removeExpiredSessions(time.Hour)
+
+	for _, test := range tests {
+		exists, err := sessionStore.Exists(test.tab)
+		if err != nil || exists == test.wantRemoved {
+			t.Errorf("%s: session exists = %v, %v, want removed %v", test.name, exists, err, test.wantRemoved)
+		}
+		_, diagnosticsErr := os.Stat(diagnosticsFileName(test.tab))
+		if os.IsNotExist(diagnosticsErr) != test.wantRemoved {
+			t.Errorf("%s: diagnostics report: %v, want removed %v", test.name, diagnosticsErr, test.wantRemoved)
+		}
+		tabStatsMu.RLock()
+		_, hasStats := requestPathStats[test.tab]
+		tabStatsMu.RUnlock()
+		if hasStats == test.wantRemoved {
+			t.Errorf("%s: tab stats kept = %v, want removed %v", test.name, hasStats, test.wantRemoved)
+		}
+		if test.wantRemoved {
+			if _, err := os.Stat(sessionMetaFileName(test.tab)); !os.IsNotExist(err) {
+				t.Errorf("%s: metadata: %v, want it removed", test.name, err)
+			}
+		}
+	}
+}
+
+func TestDeleteExpiredSessionChecksAgain(t *testing.T) {
+	useTestServerDir(t)
+	tab := "1dabeebc-9fab-4ccd-8d5a-7b8c9daebfca"
+	t.Cleanup(func() { forgetTabStats(tab) })
+	if w := postUpload(tab, "app.log", testUploadLog(0, 5)); w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body.String())
+	}
+
+	// A session listed as expired that was uploaded to since is kept
+	if err := deleteExpiredSession(tab, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := sessionStore.Exists(tab); !exists || err != nil {
+		t.Errorf("session with a recent upload exists = %v, %v, want it kept", exists, err)
+	}
+	if err := deleteExpiredSession(tab, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := sessionStore.Exists(tab); exists || err != nil {
+		t.Errorf("expired session exists = %v, %v, want it removed", exists, err)
+	}
+
+	// A session that is already gone is no error
+	if err := deleteExpiredSession(tab, -time.Second); err != nil {
+		t.Errorf("deleteExpiredSession of a removed session: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSyslogMessageBytes caps the size of a single syslog message
+const maxSyslogMessageBytes = 64 * 1024
+
+// syslogSource is the source shown for entries received over syslog
+const syslogSource = "syslog"
+
+// syslogSessionPrefix starts the name of every syslog session, so that senders cannot add to the
+// sessions of tabs or uploads
+const syslogSessionPrefix = "syslog-"
+
+// errSyslogFrameTooLong is returned for a message over maxSyslogMessageBytes, which is skipped
+var errSyslogFrameTooLong = fmt.Errorf("syslog message longer than %d bytes skipped", maxSyslogMessageBytes)
+
+// invalidSessionChars are replaced when a hostname or app-name is used as a session name
+var invalidSessionChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// SyslogOptions configures the syslog receiver
+type SyslogOptions struct {
+	Port      int    // Listened on with both TCP and UDP
+	RouteBy   string // "hostname" or "app-name", names the session a message is added to
+	LogFormat string // Format of the message bodies, empty auto-detects it
+	TimeZone  string // Zone of timestamps without an offset, empty means UTC
+}
+
+// syslogMessage holds the fields of a syslog message the receiver uses
+type syslogMessage struct {
+	hostname string
+	appName  string
+	body     string
+}
+
+// syslogReceiver accepts syslog messages and feeds their bodies to one session per hostname or app-name
+type syslogReceiver struct {
+	options  SyslogOptions
+	location *time.Location
+	messages chan syslogMessage
+	feeds    map[string]*syslogFeed // Only used by the dispatch goroutine
+}
+
+// syslogFeed is the feed of one session together with the state of its lines
+type syslogFeed struct {
+	feed       *sessionFeed
+	lineNumber int
+	received   bool // Lines arrived since the last flush
+}
+
+// StartSyslog listens for syslog messages over TCP and UDP in the background. Messages are sent in
+// RFC 5424 or RFC 3164 format, over TCP either one per line or with octet counting (RFC 6587).
+func StartSyslog(options SyslogOptions) error {
+	if options.RouteBy != "hostname" && options.RouteBy != "app-name" {
+		return fmt.Errorf("unknown syslog routing %q, expected hostname or app-name", options.RouteBy)
+	}
+	location, err := time.LoadLocation(options.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone: %w", err)
+	}
+	if _, err := newLineParser(options.LogFormat, location); err != nil {
+		return err
+	}
+
+	address := fmt.Sprintf(":%d", options.Port)
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		tcp.Close()
+		return err
+	}
+
+	receiver := &syslogReceiver{
+		options:  options,
+		location: location,
+		messages: make(chan syslogMessage, 10000),
+		feeds:    map[string]*syslogFeed{},
+	}
+	go receiver.serveTCP(tcp)
+	go receiver.serveUDP(udp)
+	go receiver.dispatch()
+	return nil
+}
+
+// serveUDP reads one message per datagram
+func (r *syslogReceiver) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, maxSyslogMessageBytes)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Syslog UDP receiver stopped: %v\n", err)
+			return
+		}
+		r.messages <- parseSyslog(string(buf[:n]))
+	}
+}
+
+// serveTCP accepts connections of syslog senders
+func (r *syslogReceiver) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Syslog TCP receiver stopped: %v\n", err)
+			return
+		}
+		go r.readTCP(conn)
+	}
+}
+
+// readTCP reads the messages of a single connection
+func (r *syslogReceiver) readTCP(conn net.Conn) {
+	defer conn.Close()
+	// The line break of a message of the maximum size still fits into the buffer
+	reader := bufio.NewReaderSize(conn, maxSyslogMessageBytes+1)
+	for {
+		message, err := readSyslogFrame(reader)
+		if strings.TrimSpace(message) != "" {
+			r.messages <- parseSyslog(message)
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading syslog from %s: %v\n", conn.RemoteAddr(), err)
+			if err != errSyslogFrameTooLong {
+				return
+			}
+		}
+	}
+}
+
+// readSyslogFrame reads a message that is either prefixed with its length or ends with a line break.
+// Messages are read no further than the buffer of reader; a line that does not fit into it is
+// discarded up to its line break and errSyslogFrameTooLong returned.
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] < '0' || first[0] > '9' {
+		line, err := reader.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+		for err == bufio.ErrBufferFull {
+			_, err = reader.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errSyslogFrameTooLong
+	}
+
+	count, err := reader.ReadSlice(' ')
+	if err != nil {
+		return "", fmt.Errorf("invalid octet count: %w", err)
+	}
+	length, err := strconv.Atoi(strings.TrimSuffix(string(count), " "))
+	if err != nil || length < 0 || length > maxSyslogMessageBytes {
+		return "", fmt.Errorf("invalid octet count %q", count)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+// parseSyslog extracts the hostname, app-name and body of a message. Messages that are in neither
+// format are kept whole as the body.
+func parseSyslog(message string) syslogMessage {
+	message = strings.TrimRight(message, "\r\n\x00")
+	rest, ok := cutPriority(message)
+	if !ok {
+		return syslogMessage{body: message}
+	}
+	if parsed, ok := parseRFC5424(rest); ok {
+		return parsed
+	}
+	return parseRFC3164(rest)
+}
+
+// cutPriority removes the "<PRI>" header of a message
+func cutPriority(message string) (string, bool) {
+	if !strings.HasPrefix(message, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(message, '>')
+	if end < 2 || end > 4 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(message[1:end]); err != nil {
+		return "", false
+	}
+	return message[end+1:], true
+}
+
+// parseRFC5424 reads "VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]"
+func parseRFC5424(rest string) (syslogMessage, bool) {
+	fields := strings.SplitN(rest, " ", 7)
+	if len(fields) < 7 || fields[0] != "1" {
+		return syslogMessage{}, false
+	}
+	parsed := syslogMessage{hostname: nilValue(fields[2]), appName: nilValue(fields[3])}
+
+	body, ok := skipStructuredData(fields[6])
+	if !ok {
+		return syslogMessage{}, false
+	}
+	parsed.body = strings.TrimPrefix(strings.TrimPrefix(body, " "), "\ufeff")
+	return parsed, true
+}
+
+// skipStructuredData returns what follows the structured data, which is "-" or one or more
+// "[id name="value"]" elements whose values may contain escaped quotes and brackets
+func skipStructuredData(data string) (string, bool) {
+	if strings.HasPrefix(data, "-") {
+		return data[1:], true
+	}
+	for strings.HasPrefix(data, "[") {
+		inQuotes := false
+		end := -1
+		for i := 1; i < len(data) && end < 0; i++ {
+			switch {
+			case data[i] == '\\' && inQuotes:
+				i++
+			case data[i] == '"':
+				inQuotes = !inQuotes
+			case data[i] == ']' && !inQuotes:
+				end = i
+			}
+		}
+		if end < 0 {
+			return "", false
+		}
+		data = data[end+1:]
+	}
+	return data, true
+}
+
+// parseRFC3164 reads "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG". Without the timestamp the
+// message has no header and is kept whole as the body.
+func parseRFC3164(rest string) syslogMessage {
+	if len(rest) < 16 || rest[15] != ' ' {
+		return syslogMessage{body: rest}
+	}
+	if _, err := time.Parse(time.Stamp, rest[:15]); err != nil {
+		return syslogMessage{body: rest}
+	}
+
+	hostname, content, _ := strings.Cut(rest[16:], " ")
+	parsed := syslogMessage{hostname: hostname, body: content}
+	if end := strings.IndexAny(content, "[: "); end > 0 {
+		tag := content[:end]
+		remainder := content[end:]
+		if strings.HasPrefix(remainder, "[") {
+			if pidEnd := strings.IndexByte(remainder, ']'); pidEnd > 0 {
+				remainder = remainder[pidEnd+1:]
+			}
+		}
+		if strings.HasPrefix(remainder, ":") {
+			parsed.appName = tag
+			parsed.body = strings.TrimPrefix(remainder[1:], " ")
+		}
+	}
+	return parsed
+}
+
+// nilValue returns the value of a header field, which is "-" if the field is empty
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// session returns the name of the session a message is added to, "syslog-" followed by the
+// message's hostname or app-name
+func (r *syslogReceiver) session(message syslogMessage) string {
+	name := message.hostname
+	if r.options.RouteBy == "app-name" {
+		name = message.appName
+	}
+	name = invalidSessionChars.ReplaceAllString(name, "-")
+	if len(name) > maxSessionIDLength-len(syslogSessionPrefix) {
+		name = name[:maxSessionIDLength-len(syslogSessionPrefix)]
+	}
+	name = strings.Trim(name, "-._")
+	if name == "" {
+		return syslogSource
+	}
+	return syslogSessionPrefix + name
+}
+
+// dispatch adds the received messages to their sessions. Lines held back for continuation lines
+// are added once no message arrived for a session for a poll interval, and a batch is saved once
+// it collected messages for feedCommitInterval.
+func (r *syslogReceiver) dispatch() {
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-r.messages:
+			r.add(message)
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// add feeds every line of a message body to the message's session
+func (r *syslogReceiver) add(message syslogMessage) {
+	session := r.session(message)
+	feed, exists := r.feeds[session]
+	if !exists {
+		// The format was checked when the receiver started
+		parser, _ := newLineParser(r.options.LogFormat, r.location)
+		feed = &syslogFeed{feed: newSessionFeed(session, syslogSource, parser, newRuleFilter(filterRules))}
+		r.feeds[session] = feed
+		log.Printf("Receiving syslog messages into session %s\n", session)
+	}
+
+	feed.received = true
+	for _, line := range strings.Split(message.body, "\n") {
+		feed.lineNumber++
+		at := lineRef{source: syslogSource, number: feed.lineNumber, raw: strings.TrimRight(line, "\r")}
+		if err := feed.feed.add(at); err != nil {
+			log.Printf("Error adding syslog message to session %s: %v\n", session, err)
+			feed.feed.abort()
+			return
+		}
+	}
+}
+
+// flush saves the batch of every session that is due
+func (r *syslogReceiver) flush() {
+	for session, feed := range r.feeds {
+		var err error
+		if !feed.received {
+			err = feed.feed.flush()
+		}
+		if err == nil {
+			err = feed.feed.commitDue()
+		}
+		if err != nil {
+			log.Printf("Error saving syslog messages of session %s: %v\n", session, err)
+			feed.feed.abort()
+		}
+		feed.received = false
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadSyslogFrame(t *testing.T) {
+	long := strings.Repeat("x", maxSyslogMessageBytes)
+	stream := "first\n" +
+		"11 octet\ncount" +
+		long + "\n" + // The longest message that fits
+		long + "y\n" + // One byte too many, skipped up to its line break
+		"after the long one\n" +
+		"last without a line break"
+	reader := bufio.NewReaderSize(strings.NewReader(stream), maxSyslogMessageBytes+1)
+
+	want := []struct {
+		message string
+		err     error
+	}{
+		{"first\n", nil},
+		{"octet\ncount", nil},
+		{long + "\n", nil},
+		{"", errSyslogFrameTooLong},
+		{"after the long one\n", nil},
+		{"last without a line break", io.EOF},
+		{"", io.EOF},
+	}
+	for i, frame := range want {
+		message, err := readSyslogFrame(reader)
+		if message != frame.message || err != frame.err {
+			t.Errorf("frame %d = %.20q (%d bytes), %v, want %.20q, %v", i, message, len(message), err, frame.message, frame.err)
+		}
+	}
+}
+
+func TestReadSyslogFrameInvalidOctetCount(t *testing.T) {
+	tests := []string{
+		"12x message",
+		fmt.Sprintf("%d message", maxSyslogMessageBytes+1),
+		strings.Repeat("1", maxSyslogMessageBytes+2),
+	}
+	for _, stream := range tests {
+		reader := bufio.NewReaderSize(strings.NewReader(stream), maxSyslogMessageBytes+1)
+		if message, err := readSyslogFrame(reader); err == nil {
+			t.Errorf("readSyslogFrame(%.20q) = %.20q, want an error", stream, message)
+		}
+	}
+}
+
+func TestSyslogSession(t *testing.T) {
+	tests := []struct {
+		routeBy string
+		message syslogMessage
+		want    string
+	}{
+		{"hostname", syslogMessage{hostname: "web-1", appName: "api"}, "syslog-web-1"},
+		{"app-name", syslogMessage{hostname: "web-1", appName: "api"}, "syslog-api"},
+		{"hostname", syslogMessage{hostname: "5b0e8c1a-3d4f-4e2a-9b6c-7d8e9f0a1b2c"}, "syslog-5b0e8c1a-3d4f-4e2a-9b6c-7d8e9f0a1b2c"},
+		{"hostname", syslogMessage{hostname: "../uploads/x y"}, "syslog-uploads-x-y"},
+		{"hostname", syslogMessage{}, "syslog"},
+		{"hostname", syslogMessage{hostname: strings.Repeat("h", 200)}, "syslog-" + strings.Repeat("h", maxSessionIDLength-len("syslog-"))},
+	}
+	for _, test := range tests {
+		r := syslogReceiver{options: SyslogOptions{RouteBy: test.routeBy}}
+		got := r.session(test.message)
+		if got != test.want {
+			t.Errorf("session of %+v by %s = %q, want %q", test.message, test.routeBy, got, test.want)
+		}
+		if err := validateSessionID(got); err != nil {
+			t.Errorf("session %q: %v", got, err)
+		}
+	}
+}
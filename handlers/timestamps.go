@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// epochLayout is the pseudo layout for Unix timestamps in seconds, milliseconds, microseconds or nanoseconds
+const epochLayout = "epoch"
+
+// timestampLayouts are tried in order to detect the timestamp layout of a file
+// whose log format does not declare one
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05,000",
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000",
+	"2006-01-02T15:04:05",
+	"02/Jan/2006:15:04:05 -0700",
+	"Jan _2 15:04:05.000",
+	epochLayout,
+}
+
+// timestampParser normalizes the timestamps of one file to time.Time in the upload's time zone.
+// The layout is detected from the first timestamp that parses and reused for the following lines.
+type timestampParser struct {
+	location *time.Location // Zone of timestamps that do not carry an offset
+	detected string
+}
+
+// newTimestampParser creates a parser for timestamps written in the given zone
+func newTimestampParser(location *time.Location) *timestampParser {
+	if location == nil {
+		location = time.UTC
+	}
+	return &timestampParser{location: location}
+}
+
+// parse converts a timestamp using the format's layout, or the detected layout when the format has none
+func (p *timestampParser) parse(value, layout string) (time.Time, bool) {
+	if layout != "" {
+		return parseTimestampLayout(value, layout, p.location)
+	}
+	if p.detected != "" {
+		if t, ok := parseTimestampLayout(value, p.detected, p.location); ok {
+			return t, true
+		}
+	}
+
+	// Detect the layout, or detect it again if the file switched layouts
+	for _, candidate := range timestampLayouts {
+		if t, ok := parseTimestampLayout(value, candidate, p.location); ok {
+			p.detected = candidate
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseTimestampLayout parses value with a single layout. Timestamps without an offset are read in location,
+// and every result is expressed in location so that all entries of an upload share one zone.
+func parseTimestampLayout(value, layout string, location *time.Location) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if layout == epochLayout {
+		t, err := parseEpoch(value)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t.In(location), true
+	}
+
+	t, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// Layouts without a year, as used by syslog, default to year 0
+	if t.Year() == 0 {
+		t = t.AddDate(time.Now().In(location).Year(), 0, 0)
+	}
+	return t.In(location), true
+}
+
+// startsWithTimestamp reports whether the line begins with a timestamp in one of the known layouts.
+// Unix timestamps are left out, since many lines that are not records start with a number.
+func startsWithTimestamp(line string) bool {
+	for _, layout := range timestampLayouts {
+		switch layout {
+		case epochLayout:
+			continue
+		case time.RFC3339Nano:
+			// The fraction and offset make the length vary, so the first field is parsed
+			if field, _, _ := strings.Cut(line, " "); strings.Contains(field, "T") {
+				field, _, _ = strings.Cut(field, "|")
+				if _, ok := parseTimestampLayout(field, layout, time.UTC); ok {
+					return true
+				}
+			}
+		default:
+			if len(line) >= len(layout) {
+				if _, ok := parseTimestampLayout(line[:len(layout)], layout, time.UTC); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// parseEpoch reads a Unix timestamp, deciding the unit from the number of integer digits. The
+// digits are read as integers, as a float64 cannot hold a nanosecond timestamp exactly.
+func parseEpoch(value string) (time.Time, error) {
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" || strings.Trim(whole, "0123456789") != "" || strings.Trim(fraction, "0123456789") != "" {
+		return time.Time{}, fmt.Errorf("not a Unix timestamp: %s", value)
+	}
+	number, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var perSecond int64 // Units of the integer digits per second
+	switch {
+	case len(whole) <= 10:
+		perSecond = 1
+	case len(whole) <= 13:
+		perSecond = 1e3
+	case len(whole) <= 16:
+		perSecond = 1e6
+	default:
+		perSecond = 1e9
+	}
+
+	// The fraction is a part of the unit, of which nanoseconds are kept
+	nanosPerUnit := int64(time.Second) / perSecond
+	var nanos int64
+	for digits, unit := fraction, nanosPerUnit/10; unit > 0 && digits != ""; digits, unit = digits[1:], unit/10 {
+		nanos += int64(digits[0]-'0') * unit
+	}
+	return time.Unix(number/perSecond, number%perSecond*nanosPerUnit+nanos), nil
+}
+
+// parseTimestamp parses a stored timestamp by trying every known layout. It is used for
+// entries saved before timestamps were normalized at ingest.
+func parseTimestamp(value string) (time.Time, bool) {
+	return newTimestampParser(time.UTC).parse(value, "")
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampParserLayouts(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone database not available:", err)
+	}
+	year := time.Now().In(berlin).Year()
+	tests := []struct {
+		value    string
+		layout   string // Layout of the log format, empty to detect it
+		location *time.Location
+		want     time.Time
+	}{
+		{"2024-05-01 10:00:00,123", "", time.UTC, time.Date(2024, 5, 1, 10, 0, 0, 123e6, time.UTC)},
+		{"2024-05-01 10:00:00.123", "", time.UTC, time.Date(2024, 5, 1, 10, 0, 0, 123e6, time.UTC)},
+		{" 2024-05-01 10:00:00 ", "", time.UTC, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-05-01T10:00:00.123456Z", "", time.UTC, time.Date(2024, 5, 1, 10, 0, 0, 123456e3, time.UTC)},
+		{"2024-05-01T10:00:00.123", "", time.UTC, time.Date(2024, 5, 1, 10, 0, 0, 123e6, time.UTC)},
+		{"2024-05-01T10:00:00", "", time.UTC, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"01/May/2024:10:00:00 +0000", "", time.UTC, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"May  1 10:00:00.000", "", time.UTC, time.Date(year, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"15/05/2024 10:00", "02/01/2006 15:04", time.UTC, time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)},
+
+		// Timestamps without an offset are read in the upload's zone, others are converted to it
+		{"2024-05-01 10:00:00,000", "", berlin, time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)},
+		{"2024-01-15 10:00:00,000", "", berlin, time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)},
+		{"2024-05-01T10:00:00+02:00", "", time.UTC, time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)},
+		{"2024-05-01T10:00:00Z", "", berlin, time.Date(2024, 5, 1, 12, 0, 0, 0, berlin)},
+		{"01/May/2024:10:00:00 -0500", "", berlin, time.Date(2024, 5, 1, 15, 0, 0, 0, time.UTC)},
+		{"1714557600", "", berlin, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, ok := newTimestampParser(test.location).parse(test.value, test.layout)
+		if !ok || !got.Equal(test.want) || got.Location() != test.location {
+			t.Errorf("parse(%q, %q) in %s = %v, %v, want %v", test.value, test.layout, test.location, got, ok, test.want.In(test.location))
+		}
+	}
+
+	for _, value := range []string{"", "   ", "yesterday", "2024-13-01 10:00:00", "2024-05-01"} {
+		if got, ok := newTimestampParser(time.UTC).parse(value, ""); ok {
+			t.Errorf("parse(%q) = %v, want no timestamp", value, got)
+		}
+	}
+	if got, ok := newTimestampParser(time.UTC).parse("2024-05-01 10:00:00,000", "02/01/2006 15:04"); ok {
+		t.Errorf("parse with a layout that does not match = %v, want no timestamp", got)
+	}
+}
+
+func TestTimestampParserDetectsLayoutAgain(t *testing.T) {
+	parser := newTimestampParser(nil)
+	for _, value := range []string{"2024-05-01 10:00:00,000", "2024-05-01 10:00:01,000", "2024-05-01T10:00:02Z", "2024-05-01T10:00:03Z"} {
+		if _, ok := parser.parse(value, ""); !ok {
+			t.Errorf("parse(%q) failed", value)
+		}
+	}
+	if parser.detected != time.RFC3339Nano {
+		t.Errorf("detected layout = %q, want the layout of the last timestamps", parser.detected)
+	}
+}
+
+func TestParseEpoch(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"1714557600", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"1714557600.5", time.Date(2024, 5, 1, 10, 0, 0, 500e6, time.UTC)},
+		{"1714557600.123", time.Date(2024, 5, 1, 10, 0, 0, 123e6, time.UTC)},
+		{"1714557600123", time.Date(2024, 5, 1, 10, 0, 0, 123e6, time.UTC)},
+		{"1714557600123.456", time.Date(2024, 5, 1, 10, 0, 0, 123456e3, time.UTC)},
+		{"1714557600123456", time.Date(2024, 5, 1, 10, 0, 0, 123456e3, time.UTC)},
+		{"1714557600123456789", time.Date(2024, 5, 1, 10, 0, 0, 123456789, time.UTC)},
+		{"1714557600.123456789123", time.Date(2024, 5, 1, 10, 0, 0, 123456789, time.UTC)},
+		{"1714557600123456.7", time.Date(2024, 5, 1, 10, 0, 0, 123456700, time.UTC)},
+		{"0", time.Unix(0, 0)},
+	}
+	for _, test := range tests {
+		if got, err := parseEpoch(test.value); err != nil || !got.Equal(test.want) {
+			t.Errorf("parseEpoch(%q) = %v, %v, want %v", test.value, got.UTC(), err, test.want)
+		}
+	}
+	for _, value := range []string{"", "-1714557600", ".5", "99999999999999999999", "1e9", "17145576OO", "1714557600.12.3", "0x10"} {
+		if got, err := parseEpoch(value); err == nil {
+			t.Errorf("parseEpoch(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestStartsWithTimestamp(t *testing.T) {
+	for line, want := range map[string]bool{
+		"2024-05-01 10:00:00,000 INFO started":         true,
+		"2024-05-01T10:00:00.5+02:00|c1|t1":            true,
+		"2024-05-01T10:00:00Z started":                 true,
+		"01/May/2024:10:00:00 +0000 GET /":             true,
+		"May  1 10:00:00.000 host app: started":        true,
+		"\tat Foo.bar(Foo.java:1)":                     false,
+		"1714557600 looks like a number":               false,
+		"Caused by: java.io.IOException: 2024-05-01 x": false,
+		"2024-05-01": false,
+	} {
+		if got := startsWithTimestamp(line); got != want {
+			t.Errorf("startsWithTimestamp(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
@@ -1,16 +1,19 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,19 +28,19 @@ type FileDetail struct {
 	MethodName              string `json:"methodName"`
 	RequestQuery            string `json:"requestQuery"`
 	RequestPath             string `json:"requestPath"`
+	Source                  string `json:"source,omitempty"`       // Uploaded file or archive member the entry came from
+	Continuation            string `json:"continuation,omitempty"` // Following lines that belong to this entry, e.g. stack traces or wrapped SQL
 }
 
 type TimeBucketStats struct {
 	RequestCount  int
 	ResponseCount int
-	Durations     []float64
+	durations     durationSketch // Response durations, for the average and percentile
 	AvgDuration   float64
 	Percentile95  float64
 }
 
-var uploadedFiles []FileDetail                                   // uploadedFiles stores the content of all uploaded files
 var requestPathStats = map[string]map[string]*RequestPathStats{} // The first key is tabUUID, and the second is RequestPath
-// var httpResponses []FileDetail
 
 // TemplateData holds data passed to the HTML template
 type TemplateData struct {
@@ -46,9 +49,17 @@ type TemplateData struct {
 	FileDetails         []FileDetail                 //A slice of FileDetail representing the processed file uploads.
 	FileName            string
 	FileNames           []string //A slice of strings that could list all file names available or processed.
-	HttpResponses       []FileDetail
+	SourceFiles         []string //Files and archive members the entries were read from
+	HttpResponses       []LogEvent
 	OverallRequestStats OverallStats
 	TimeBuckets         map[string]*TimeBucketStats
+	LogFormats          []string //Names of the log formats that can be selected for an upload
+	Encodings           []string //Names of the encodings that can be selected for an upload
+	Diagnostics         *parseDiagnostics
+	FilterRules         string          //Include/exclude rules used for the upload, one per line
+	RuleExclusions      []RuleExclusion //Number of entries each exclude rule removed
+	TimeZone            string          //Zone the timestamps of the upload were read in
+	DuplicatesDropped   int             //Entries already uploaded to the session or contained in another uploaded file
 }
 
 type OverallStats struct {
@@ -57,6 +68,8 @@ type OverallStats struct {
 	TotalHTTPRequests  int // New field for tracking HTTP-IN-Requests
 	TotalHTTPResponses int // New field for tracking HTTP-IN-Responses
 	CompletionMessage  string
+	Estimated          bool   // Counts are scaled up from a sample of the requests
+	Sample             string // Describes the sample the counts were estimated from
 }
 
 // Holds the following fields to track performance metrics:
@@ -66,8 +79,9 @@ type RequestPathStats struct {
 	AverageTime float64
 	MaxTime     float64
 	MinTime     float64
-	Durations   []float64
+	durations   durationSketch // Response durations, for the percentile
 	Percentile  float64
+	Estimated   bool // Count and TotalTime include an upload that was sampled
 }
 
 // QueryMetrics holds statistics for request queries
@@ -77,13 +91,18 @@ type QueryMetrics struct {
 	AverageTime float64
 	MaxTime     float64
 	MinTime     float64
-	Durations   []float64
+	durations   durationSketch // Execution durations, for the percentile
 	Percentile  float64
+	Estimated   bool // Count and TotalTime include an upload that was sampled
 }
 
 // Stores statistics for request queries per tab
 var queryMetricsMap = map[string]map[string]*QueryMetrics{}
 
+// tabStatsMu guards requestPathStats and queryMetricsMap, which concurrent uploads update and
+// followed files and syslog messages update in the background
+var tabStatsMu sync.RWMutex
+
 // UploadHandler handles both the GET and POST requests
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Received request:", r.Method)
@@ -107,136 +126,34 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var fileNames []string
+		//Get the unique tab identifier
+		tabUUID := r.FormValue("uniqueID")
+
+		var uploads []uploadedFile
 		for _, fileHeader := range files {
-			fileNames = append(fileNames, fileHeader.Filename)
+			uploads = append(uploads, uploadedFile{name: fileHeader.Filename, size: fileHeader.Size, open: fileHeader.Open})
 		}
 
-		// Loop through each uploaded file
-		for _, fileHeader := range files {
-			file, err := fileHeader.Open()
-			if err != nil {
-				log.Printf("Error opening file %s: %v\n", fileHeader.Filename, err)
-				http.Error(w, "Error opening the file", http.StatusInternalServerError)
+		// With async set the files are analyzed by a background job, whose status is returned
+		if r.FormValue("async") != "" {
+			upload, ok := uploadRequest(w, r, tabUUID, uploads)
+			if !ok {
 				return
 			}
-
-			//Process each file
-			if err := processFile(file); err != nil {
-				file.Close()
-				log.Printf("Error processing file %s: %v\n", fileHeader.Filename, err)
-				http.Error(w, "Error processing the file", http.StatusInternalServerError)
+			dir, err := spoolUploadedFiles(upload)
+			if err != nil {
+				log.Printf("Error saving uploaded files: %v\n", err)
+				http.Error(w, "Error saving the uploaded files", http.StatusInternalServerError)
 				return
 			}
-			file.Close()
-		}
-
-		//Get the unique tab identifier
-		tabUUID := r.FormValue("uniqueID")
-
-		//Initialize stats maps for this tab if not already present
-		if _, exists := requestPathStats[tabUUID]; !exists {
-			requestPathStats[tabUUID] = map[string]*RequestPathStats{}
-		}
-		if _, exists := queryMetricsMap[tabUUID]; !exists {
-			queryMetricsMap[tabUUID] = map[string]*QueryMetrics{}
-		}
-
-		//Run computations
-		calculateRequestPathStats(tabUUID, false)
-		extractRequestQueries(tabUUID)
-		calculateQueryMetrics(tabUUID)
-
-		//Extract HTTPresponses from processed files
-		httpResponses := extractHTTPResponses(uploadedFiles)
-
-		//Variables for computing overall stats
-		var (
-			totalCount         int
-			totalDuration      float64
-			allDurations       []float64
-			totalHTTPRequests  int
-			totalHTTPResponses int
-		)
-
-		//Compute request/reponse statistics and durations
-		for _, fileDetail := range uploadedFiles {
-			switch strings.ToUpper(fileDetail.CallType) {
-			case "HTTP-IN-REQUEST":
-				totalHTTPRequests++
-			case "HTTP-IN-RESPONSE":
-				totalHTTPResponses++
-				duration, err := strconv.ParseFloat(fileDetail.TotalDurationForRequest, 64)
-				if err != nil {
-					continue
-				}
-				totalCount++
-				totalDuration += duration
-				allDurations = append(allDurations, duration)
-			}
-		}
-
-		//Calculate overall average and 95th percentile
-		var overallAvg, overallPercentile float64
-		if totalCount > 0 {
-			overallAvg = totalDuration / float64(totalCount)
-			sort.Float64s(allDurations)
-			index := int(0.95 * float64(totalCount-1))
-			overallPercentile = allDurations[index]
-		}
-
-		//Generate a completion message based on request-reponse count
-		completionMessage := ""
-		if totalHTTPRequests == totalHTTPResponses {
-			completionMessage = "✅ All requests are completed in this file."
-		} else {
-			completionMessage = "⚠️ Not all requests are completed in this file. Some responses might be in another file."
-		}
-
-		//Prepare the overall stats
-		overallStats := OverallStats{
-
-			Average:            overallAvg,
-			Percentile:         overallPercentile,
-			TotalHTTPRequests:  totalHTTPRequests,
-			TotalHTTPResponses: totalHTTPResponses,
-			CompletionMessage:  completionMessage,
-		}
-
-		// Aggregate by time buckets (e.g., 1-minute buckets)
-		timeBuckets := aggregateByTime(uploadedFiles, 1*time.Minute)
-
-		//Log the bucket stats
-		log.Println("---- Time Buckets ----")
-		for bucketTime, stats := range timeBuckets {
-			log.Printf("Time Bucket: %s | Request Count: %d | Average Duration: %.2f ms | 95th Percentile: %.2f ms\n | Response Count: %d |",
-				bucketTime, stats.RequestCount, stats.AvgDuration, stats.Percentile95, stats.ResponseCount)
+			startAnalysisJob(w, upload, func(error) { os.RemoveAll(dir) })
+			return
 		}
-		log.Println("---- End of Time Buckets ----")
-
-		//Save uploaded file details to a JSON file
-		saveFilesAsJSON(uploadedFiles, tabUUID)
 
-		//Render the HTML template with the data
-		tmpl := template.Must(template.New("index.html").Funcs(template.FuncMap{
-			"marshal": marshal}).ParseFiles("template/index.html"))
-		err = tmpl.Execute(w, TemplateData{
-			RequestPathStats:    requestPathStats[tabUUID],
-			QueryMetrics:        queryMetricsMap[tabUUID],
-			FileDetails:         uploadedFiles,
-			FileNames:           fileNames,
-			HttpResponses:       httpResponses,
-			OverallRequestStats: overallStats,
-			TimeBuckets:         timeBuckets,
-		})
-		if err != nil {
-			log.Printf("Error rendering template: %v\n", err)
-			http.Error(w, "Error rendering template", http.StatusInternalServerError)
+		if !analyzeUpload(w, r, tabUUID, uploads) {
 			return
 		}
 
-		//Clear the uploaded files after rendering
-		uploadedFiles = nil
 		log.Println("POST request completed successfully")
 
 	} else if r.Method == http.MethodGet {
@@ -244,64 +161,17 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 
 		tabUUID := r.URL.Query().Get("uniqueID")
 
-		//Initialize maps if not present
-		if _, exists := requestPathStats[tabUUID]; !exists {
-			requestPathStats[tabUUID] = map[string]*RequestPathStats{}
-		}
-		if _, exists := queryMetricsMap[tabUUID]; !exists {
-			queryMetricsMap[tabUUID] = map[string]*QueryMetrics{}
-		}
-
-		//Variables for overall stats
-		var (
-			totalCount         int
-			totalDuration      float64
-			allDurations       []float64
-			totalHTTPRequests  int
-			totalHTTPResponses int
-		)
-
-		//Calculate request/response counts and durations
-		for _, fd := range uploadedFiles {
-			switch strings.ToUpper(fd.CallType) {
-			case "HTTP-IN-REQUEST":
-				totalHTTPRequests++
-			case "HTTP-IN-RESPONSE":
-				totalHTTPResponses++
-				duration, err := strconv.ParseFloat(fd.TotalDurationForRequest, 64)
-				if err != nil {
-					continue
-				}
-				totalCount++
-				totalDuration += duration
-				allDurations = append(allDurations, duration)
-			}
-		}
-
-		var overallAvg, overallPercentile float64
-		if totalCount > 0 {
-			overallAvg = totalDuration / float64(totalCount)
-			sort.Float64s(allDurations)
-			index := int(0.95 * float64(totalCount-1))
-			overallPercentile = allDurations[index]
-		}
-
-		overallStats := OverallStats{
-
-			Average:            overallAvg,
-			Percentile:         overallPercentile,
-			TotalHTTPRequests:  totalHTTPRequests,
-			TotalHTTPResponses: totalHTTPResponses,
-		}
-
 		// Render the results using the HTML template
+		pathStats, queryMetrics := tabStats(tabUUID)
 		tmpl := template.Must(template.New("index.html").Funcs(template.FuncMap{
 			"marshal": marshal}).ParseFiles("template/index.html"))
 		err := tmpl.Execute(w, TemplateData{
-			RequestPathStats:    requestPathStats[tabUUID],
-			QueryMetrics:        queryMetricsMap[tabUUID],
-			HttpResponses:       extractHTTPResponses(uploadedFiles),
-			OverallRequestStats: overallStats,
+			RequestPathStats: pathStats,
+			QueryMetrics:     queryMetrics,
+			LogFormats:       LogFormatNames(),
+			Encodings:        TextEncodingNames(),
+			FilterRules:      formatFilterRules(filterRules),
+			TimeZone:         "UTC",
 		})
 		if err != nil {
 			log.Printf("Error rendering template: %v\n", err)
@@ -317,374 +187,337 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// marshal is a helper function used to convert Go data structures to JSON  so that they can be safely embedded into HTML templates
-func marshal(v interface{}) template.JS {
-	a, err := json.Marshal(v)
+// uploadedFile is a file of an upload, either a file of the multipart form or a completed chunked upload
+type uploadedFile struct {
+	name string
+	size int64
+	open func() (multipart.File, error)
+}
+
+// isSingleLogFile reports whether the file is a single log file rather than an archive of several.
+// A file that cannot be opened counts as an archive, the error is reported once it is parsed.
+func (f uploadedFile) isSingleLogFile() bool {
+	file, err := f.open()
 	if err != nil {
-		return template.JS("null")
+		return false
 	}
-	// Return the JSON result as a template.JS type
-	return template.JS(a)
+	defer file.Close()
+	return isSingleLogFile(file, f.size)
 }
 
-// aggregateByTime groups the uploaded log file entries into time buckets and calculates average duration and 95th percentile of HTTP response durations within each bucket
-func aggregateByTime(uploadedFiles []FileDetail, bucketDuration time.Duration) map[string]*TimeBucketStats {
-	// Define the layout of the timestamp in the logs
-	const customLayout = "2006-01-02 15:04:05,000"
-
-	// Create a map to hold time buckets
-	buckets := make(map[string]*TimeBucketStats)
-
-	for _, f := range uploadedFiles {
-
-		// Parse the timestamp string to Go's time.Time format
-		t, err := time.Parse(customLayout, f.Timestamp)
-		if err != nil {
-			log.Printf("Invalid timestamp: %s\n", f.Timestamp)
-			continue
-		}
-
-		bucketTime := t.Truncate(bucketDuration).Format("15:04:05")
-
-		// Initialize a new bucket if one doesn't already exist for this time
-		if _, exists := buckets[bucketTime]; !exists {
-			buckets[bucketTime] = &TimeBucketStats{Durations: []float64{}}
-		}
-		bucket := buckets[bucketTime]
-
-		switch f.CallType {
-		case "HTTP-In-Request":
-			bucket.RequestCount++
-
-		case "HTTP-In-Response":
-			bucket.ResponseCount++
-
-			duration, err := strconv.ParseFloat(f.TotalDurationForRequest, 64)
-			if err != nil {
-				log.Printf("Invalid duration: %s\n", f.TotalDurationForRequest)
-				continue
-			}
-
-			// Add duration to the bucket's list for stats calculation
-			bucket.Durations = append(bucket.Durations, duration)
-		}
+// analyzeUpload parses the files of an upload into the tab's session with the settings of the upload
+// form and renders the results. It reports whether the upload succeeded, errors are already written to w.
+func analyzeUpload(w http.ResponseWriter, r *http.Request, tabUUID string, files []uploadedFile) bool {
+	upload, ok := uploadRequest(w, r, tabUUID, files)
+	if !ok {
+		return false
 	}
-
-	// Compute stats for responses
-	for _, bucket := range buckets {
-		if len(bucket.Durations) == 0 {
-			continue
-		}
-		total := 0.0
-		sort.Float64s(bucket.Durations)
-		for _, d := range bucket.Durations {
-			total += d
-		}
-		bucket.AvgDuration = total / float64(len(bucket.Durations))
-		idx := int(0.95 * float64(len(bucket.Durations)-1))
-		bucket.Percentile95 = bucket.Durations[idx]
+	// The analysis is finished even if the client stops waiting for it
+	data, err := upload.run(context.Background(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
 	}
-
-	return buckets
+	// The session is saved even if the results could not be rendered
+	renderUploadResults(w, data)
+	return true
 }
 
-func extractHTTPResponses(uploadedFiles []FileDetail) []FileDetail {
-	var httpResponses []FileDetail
+// analysisRequest is an upload together with the settings selected in its form
+type analysisRequest struct {
+	tabUUID string
+	files   []uploadedFile
+	parser  *lineParser
+	rules   []*FilterRule
+	sampler *correlationSampler
+}
 
-	for _, fileDetail := range uploadedFiles {
-		if strings.EqualFold(fileDetail.CallType, "HTTP-IN-Response") {
-			httpResponses = append(httpResponses, fileDetail)
-		}
+// uploadRequest reads the settings of the upload form for the files of an upload to tabUUID.
+// Errors are written to w.
+func uploadRequest(w http.ResponseWriter, r *http.Request, tabUUID string, files []uploadedFile) (*analysisRequest, bool) {
+	if err := validateSessionID(tabUUID); err != nil {
+		writeSessionError(w, err)
+		return nil, false
 	}
 
-	return httpResponses
-}
-
-// processFile processes the uploaded file and extracts the details
-func processFile(file io.Reader) error {
-	content, err := io.ReadAll(file)
+	// Log format, time zone and filter rules selected for this upload
+	parser, rules, err := uploadSettings(r)
 	if err != nil {
-		return err
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
 	}
-
-	extractFileDetails(string(content))
-	return nil
-}
-
-// extractFileDetails parses the content and extracts structured fields for each line
-func extractFileDetails(content string) {
-	lines := strings.Split(content, "\n")
-	for _, line := range lines {
-		fields := strings.Split(line, "|")
-		if len(fields) >= 9 {
-			requestPath := strings.TrimSpace(fields[8])
-
-			// Check if RequestPath ends with any excluded extensions
-			excludedExtensions := []string{".js", ".js(1)", ".ttf", ".css", ".gif", ".ico", ".png", ".jsf", ".woff", ".woff2", ".jpg", ".map"}
-			exclude := false
-			for _, ext := range excludedExtensions {
-				if strings.HasSuffix(requestPath, ext) {
-					exclude = true
-					break
-				}
-			}
-
-			// Only append if the RequestPath does not match excluded extensions
-			if !exclude {
-				fileDetail := FileDetail{
-					Timestamp:               strings.TrimSpace(fields[0]),
-					CorrelationId:           strings.TrimSpace(fields[1]),
-					ThreadId:                strings.TrimSpace(fields[2]),
-					TotalDurationForRequest: strings.TrimSpace(fields[3]),
-					CallType:                strings.TrimSpace(fields[4]),
-					StartTime:               strings.TrimSpace(fields[5]),
-					MethodName:              strings.TrimSpace(fields[6]),
-					RequestQuery:            strings.TrimSpace(fields[7]),
-					RequestPath:             requestPath,
-				}
-				uploadedFiles = append(uploadedFiles, fileDetail)
-			}
-		}
+	sampler, err := uploadSampler(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
 	}
+	return &analysisRequest{tabUUID: tabUUID, files: files, parser: parser, rules: rules, sampler: sampler}, true
 }
 
-// calculateRequestPathStats computes detailed statistics for each request path
-// from the uploaded files, including count, min/max/avg duration, and 95th percentile.
-// It also provides global stats and checks if all requests have matching responses.
-func calculateRequestPathStats(tabUUID string, resetStats bool) {
-
-	// If reset is requested, clear the existing stats for this tab
-	if resetStats {
-		requestPathStats[tabUUID] = map[string]*RequestPathStats{}
+// run parses the files into the tab's session and returns the results to render, reporting its
+// progress to progress, which may be nil. Once ctx is canceled the files are no longer read and
+// the session is left as it was, unless it is already being saved. Other errors are logged, the
+// returned error can be shown to the user.
+func (u *analysisRequest) run(ctx context.Context, progress *analysisProgress) (*TemplateData, error) {
+	var fileNames []string
+	for _, upload := range u.files {
+		fileNames = append(fileNames, upload.name)
 	}
+	filter := newRuleFilter(u.rules)
 
-	// Global counters and duration collectors
-	var totalHTTPRequests int
-	var totalHTTPResponses int
-	var totalHTTPDuration float64
-	var allDurations []float64
-
-	// Maps to track unique correlation IDs of requests and responses
-	requestCorrelationIDs := make(map[string]struct{})
-	responseCorrelationIDs := make(map[string]struct{})
-
-	// Loop over each uploaded file log entry
-	for _, fileDetail := range uploadedFiles {
-		// If this is an HTTP-IN-Request, track it
-		if strings.EqualFold(fileDetail.CallType, "HTTP-IN-Request") {
-			totalHTTPRequests++
-			requestCorrelationIDs[fileDetail.CorrelationId] = struct{}{}
-		}
-
-		// If this is an HTTP-IN-Response, process its duration
-		if strings.EqualFold(fileDetail.CallType, "HTTP-IN-Response") {
-			duration, err := strconv.ParseFloat(fileDetail.TotalDurationForRequest, 64)
+	// Parsed entries are streamed straight into the session's JSON file
+	analysis, err := newSessionAnalysis(u.tabUUID, filter, false)
+	if err != nil {
+		log.Printf("Error opening session file for %s: %v\n", u.tabUUID, err)
+		return nil, errors.New("Error saving the file details")
+	}
+	analysis.sampler = u.sampler
+	analysis.progress = progress
+
+	// Entries of all files are merged by timestamp once every file is parsed, a single log file needs no merging
+	merger := newSourceMerger(analysis)
+	merger.direct = len(u.files) == 1 && u.files[0].isSingleLogFile()
+	defer merger.close()
+
+	//Process the files concurrently, every log file inside an archive is read by the file's worker
+	progress.setPhase(phaseParsing)
+	var jobs []parseJob
+	for _, upload := range u.files {
+		jobs = append(jobs, func(merger *sourceMerger) error {
+			file, err := upload.open()
 			if err != nil {
-				continue // Skip invalid durations
-			}
-
-			// Update global counters
-			totalHTTPResponses++
-			totalHTTPDuration += duration
-			allDurations = append(allDurations, duration)
-			responseCorrelationIDs[fileDetail.CorrelationId] = struct{}{}
-
-			// Initialize stats for this request path if not already
-			if _, exists := requestPathStats[tabUUID][fileDetail.RequestPath]; !exists {
-				requestPathStats[tabUUID][fileDetail.RequestPath] = &RequestPathStats{
-					MaxTime:   duration,
-					MinTime:   duration,
-					Durations: []float64{},
-				}
+				return fmt.Errorf("error opening file %s: %w", upload.name, err)
 			}
-
-			// Update request path-specific statistics
-			stats := requestPathStats[tabUUID][fileDetail.RequestPath]
-			stats.Count++
-			stats.TotalTime += duration
-			stats.Durations = append(stats.Durations, duration)
-			stats.AverageTime = stats.TotalTime / float64(stats.Count)
-
-			if duration > stats.MaxTime {
-				stats.MaxTime = duration
-			}
-			if stats.Count > 1 && duration < stats.MinTime {
-				stats.MinTime = duration
+			defer file.Close()
+			err = forEachLogFile(upload.name, progressReader{file, ctx, progress}, upload.size, func(source string, r io.Reader) error {
+				return merger.processFile(r, source, u.parser)
+			})
+			if err != nil {
+				return fmt.Errorf("error processing file %s: %w", upload.name, err)
 			}
+			return nil
+		})
+	}
+	if err := merger.parseFiles(jobs); err != nil {
+		analysis.abort()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		log.Println(err)
+		return nil, errors.New("Error processing the file")
 	}
 
-	// Calculate 95th percentile for each request path
-	for _, stats := range requestPathStats[tabUUID] {
-		if len(stats.Durations) > 0 {
-			sort.Float64s(stats.Durations)
-			index := int(0.95 * float64(len(stats.Durations)-1))
-			stats.Percentile = stats.Durations[index]
+	progress.setPhase(phaseMerging)
+	if err := merger.merge(ctx); err != nil {
+		analysis.abort()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		log.Printf("Error merging files for %s: %v\n", u.tabUUID, err)
+		return nil, errors.New("Error processing the file")
 	}
+	log.Printf("%d duplicate entries dropped\n", merger.Duplicates)
 
-	// Print global stats
-	if totalHTTPResponses > 0 {
-		sort.Float64s(allDurations)
-		globalAverage := totalHTTPDuration / float64(totalHTTPResponses)
-		globalPercentile := allDurations[int(0.95*float64(len(allDurations)-1))]
+	//Run computations
+	progress.setPhase(phaseSaving)
+	analysis.finish()
 
-		fmt.Printf("Total HTTP-IN-Requests: %d\n", totalHTTPRequests)
-		fmt.Printf("Total HTTP-IN-Responses: %d\n", totalHTTPResponses)
-		fmt.Printf("Overall Average Duration: %.2f ms\n", globalAverage)
-		fmt.Printf("Overall 95th Percentile Duration: %.2f ms\n", globalPercentile)
+	//Save uploaded file details to a JSON file
+	if err := analysis.commit(); err != nil {
+		log.Printf("Error saving JSON file for %s: %v\n", u.tabUUID, err)
+		return nil, errors.New("Error saving the file details")
 	}
+	log.Printf("%d lines rejected or partially parsed\n", analysis.diagnostics.Total)
 
-	// Check if all request correlation IDs have matching response correlation IDs
-	allMatched := true
-	for id := range requestCorrelationIDs {
-		if _, found := responseCorrelationIDs[id]; !found {
-			allMatched = false
-			break
-		}
+	//Log the bucket stats
+	log.Println("---- Time Buckets ----")
+	for bucketTime, stats := range analysis.timeBuckets {
+		log.Printf("Time Bucket: %s | Request Count: %d | Average Duration: %.2f ms | 95th Percentile: %.2f ms\n | Response Count: %d |",
+			bucketTime, stats.RequestCount, stats.AvgDuration, stats.Percentile95, stats.ResponseCount)
 	}
+	log.Println("---- End of Time Buckets ----")
+
+	pathStats, queryMetrics := tabStats(u.tabUUID)
+	return &TemplateData{
+		RequestPathStats:    pathStats,
+		QueryMetrics:        queryMetrics,
+		FileNames:           fileNames,
+		SourceFiles:         analysis.sources,
+		HttpResponses:       analysis.httpResponses.sorted(),
+		OverallRequestStats: analysis.overallStats(),
+		TimeBuckets:         analysis.timeBuckets,
+		LogFormats:          LogFormatNames(),
+		Encodings:           TextEncodingNames(),
+		Diagnostics:         analysis.diagnostics,
+		FilterRules:         formatFilterRules(u.rules),
+		TimeZone:            u.parser.location.String(),
+		RuleExclusions:      filter.exclusions(),
+		DuplicatesDropped:   merger.Duplicates,
+	}, nil
+}
 
-	if allMatched {
-		fmt.Println("✅ All requests have matching responses in this file.")
-	} else {
-		fmt.Println("⚠️  Not all requests have matching responses. Some responses might be in another file.")
+// renderUploadResults renders the HTML template with the results of an upload
+func renderUploadResults(w http.ResponseWriter, data *TemplateData) {
+	tmpl := template.Must(template.New("index.html").Funcs(template.FuncMap{
+		"marshal": marshal}).ParseFiles("template/index.html"))
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error rendering template: %v\n", err)
+		http.Error(w, "Error rendering template", http.StatusInternalServerError)
 	}
 }
 
-func saveFilesAsJSON(uploadedFiles []FileDetail, tabUUID string) {
-	// Use the tabUUID to generate a unique file name
-	fileName := fmt.Sprintf("uploads/%s.json", tabUUID)
+// uploadSettings reads the log format, time zone, encoding and filter rules selected in the upload form.
+// The error describes the invalid setting and can be shown to the user.
+func uploadSettings(r *http.Request) (*lineParser, []*FilterRule, error) {
+	// Timestamps without an offset are read in the selected zone
+	location, err := time.LoadLocation(r.FormValue("timeZone"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unknown time zone: %w", err)
+	}
 
-	// Check if the file exists
-	var existingFiles []FileDetail // Replace 'YourFileType' with the actual struct type of uploadedFiles
+	// An empty format name auto-detects the format of every line
+	parser, err := newLineParser(r.FormValue("logFormat"), location)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unknown log format: %w", err)
+	}
 
-	if _, err := os.Stat(fileName); err == nil {
-		// File exists, read existing content
-		existingFile, err := os.Open(fileName)
-		if err != nil {
-			fmt.Println("Error opening existing JSON file:", err)
-			return
-		}
-		defer existingFile.Close()
+	// Files without a byte order mark are read in the selected encoding, UTF-8 if none is selected
+	if parser.encoding, err = findTextEncoding(r.FormValue("encoding")); err != nil {
+		return nil, nil, fmt.Errorf("Unknown encoding: %w", err)
+	}
 
-		// Decode existing JSON data
-		decoder := json.NewDecoder(existingFile)
-		err = decoder.Decode(&existingFiles)
+	// Rules entered in the form replace the configured ones for this upload
+	rules := filterRules
+	if text := r.FormValue("filterRules"); strings.TrimSpace(text) != "" {
+		rules, err = parseFilterRules(text)
 		if err != nil {
-			fmt.Println("Error decoding existing JSON data:", err)
-			return
+			return nil, nil, fmt.Errorf("Invalid filter rules: %w", err)
 		}
-	} else if !os.IsNotExist(err) {
-		fmt.Println("Error checking if file exists:", err)
-		return
 	}
+	return parser, rules, nil
+}
 
-	// Append new uploadedFiles to existing data
-	combinedFiles := append(existingFiles, uploadedFiles...)
-
-	// Create or overwrite the file with updated data
-	file, err := os.Create(fileName)
+// uploadSampler reads the sampling selected in the upload form: about 1 in N correlation IDs or a
+// percentage of them, with N or the percentage given as the sample rate
+func uploadSampler(r *http.Request) (*correlationSampler, error) {
+	rate := strings.TrimSpace(r.FormValue("sampleRate"))
+	var every int
+	var percent float64
+	var err error
+	mode := r.FormValue("sampling")
+	if mode == "" {
+		return nil, nil
+	}
+	if rate == "" {
+		return nil, fmt.Errorf("Invalid sampling: the sample rate is required")
+	}
+	switch mode {
+	case "every":
+		every, err = strconv.Atoi(rate)
+	case "percent":
+		percent, err = strconv.ParseFloat(strings.TrimSuffix(rate, "%"), 64)
+	default:
+		err = fmt.Errorf("unknown sampling mode %q", mode)
+	}
 	if err != nil {
-		fmt.Println("Error creating JSON file:", err)
-		return
+		return nil, fmt.Errorf("Invalid sampling: %w", err)
 	}
-	defer file.Close()
-
-	// Write the combined data to the file
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(combinedFiles)
+	sampler, err := newCorrelationSampler(every, percent)
 	if err != nil {
-		fmt.Println("Error encoding JSON data:", err)
-		return
+		return nil, fmt.Errorf("Invalid sampling: %w", err)
 	}
-
-	fmt.Printf("File successfully saved to: %s\n", fileName)
+	if sampler == nil {
+		return nil, fmt.Errorf("Invalid sampling: the sample rate must be above 0")
+	}
+	return sampler, nil
 }
 
-func extractRequestQueries(tabUUID string) {
-	// Ensure the tabUUID exists in queryMetricsMap, if not, initialize it
-	if _, exists := queryMetricsMap[tabUUID]; !exists {
-		queryMetricsMap[tabUUID] = map[string]*QueryMetrics{}
+// tabStats returns a copy of the request path and query statistics of a tab, so they can be
+// rendered while a followed file keeps updating them. Statistics that are not in memory are
+// rebuilt from the tab's session first.
+func tabStats(tabUUID string) (map[string]*RequestPathStats, map[string]*QueryMetrics) {
+	if err := loadTabStats(tabUUID); err != nil {
+		log.Printf("Error rebuilding statistics of %s: %v\n", tabUUID, err)
 	}
 
-	for _, fileDetail := range uploadedFiles {
-		// Skip if CallType is "HTTP-IN-Request" or "HTTP-IN-Response"
-		if strings.EqualFold(fileDetail.CallType, "HTTP-IN-Request") || strings.EqualFold(fileDetail.CallType, "HTTP-IN-Response") {
-			continue
-		}
-
-		query := strings.TrimSpace(fileDetail.RequestQuery)
-		if query == "" {
-			continue // Skip empty queries
-		}
+	tabStatsMu.RLock()
+	defer tabStatsMu.RUnlock()
 
-		// Initialize metrics for a new request query if it doesn't exist
-		if _, exists := queryMetricsMap[tabUUID][query]; !exists {
-			queryMetricsMap[tabUUID][query] = &QueryMetrics{
-				MaxTime: 0,   // Initialize MaxTime to 0
-				MinTime: 1e9, // Start MinTime with a very large number (1 billion)
-			}
-		}
+	pathStats := map[string]*RequestPathStats{}
+	for path, stats := range requestPathStats[tabUUID] {
+		stats := *stats
+		stats.durations = durationSketch{}
+		pathStats[path] = &stats
 	}
+	queryMetrics := map[string]*QueryMetrics{}
+	for query, metrics := range queryMetricsMap[tabUUID] {
+		metrics := *metrics
+		metrics.durations = durationSketch{}
+		queryMetrics[query] = &metrics
+	}
+	return pathStats, queryMetrics
 }
 
-func calculateQueryMetrics(tabUUID string) {
-	for _, fileDetail := range uploadedFiles {
-		// Skip if CallType is "HTTP-IN-Request" or "HTTP-IN-Response"
-		if strings.EqualFold(fileDetail.CallType, "HTTP-IN-Request") || strings.EqualFold(fileDetail.CallType, "HTTP-IN-Response") {
-			continue
-		}
-
-		query := strings.TrimSpace(fileDetail.RequestQuery)
-		if query == "" {
-			continue // Skip empty queries
-		}
-
-		duration, err := strconv.ParseFloat(fileDetail.TotalDurationForRequest, 64)
-		if err != nil {
-			continue // Skip invalid durations
-		}
-
-		// Ensure the query exists in the map
-		if _, exists := queryMetricsMap[tabUUID][query]; !exists {
-			if queryMetricsMap[tabUUID] == nil {
-				queryMetricsMap[tabUUID] = make(map[string]*QueryMetrics)
-			}
-			queryMetricsMap[tabUUID][query] = &QueryMetrics{
-				MaxTime:   0,
-				MinTime:   1e9, // Set a high initial MinTime
-				Durations: []float64{},
-			}
-		}
+// tabStatsLoaded reports whether the statistics of a tab are in memory
+func tabStatsLoaded(tabUUID string) bool {
+	tabStatsMu.RLock()
+	defer tabStatsMu.RUnlock()
+	_, loaded := requestPathStats[tabUUID]
+	return loaded
+}
 
-		metrics := queryMetricsMap[tabUUID][query]
-		metrics.Count++
-		metrics.TotalTime += duration
-		metrics.AverageTime = metrics.TotalTime / float64(metrics.Count)
-		metrics.Durations = append(metrics.Durations, duration)
+// loadTabStats rebuilds the statistics of a tab from its stored session unless they are in memory,
+// as they are not for sessions ingested by the CLI or saved before a restart
+func loadTabStats(tabUUID string) error {
+	if validateSessionID(tabUUID) != nil || tabStatsLoaded(tabUUID) {
+		return nil
+	}
+	lock := lockSession(tabUUID)
+	defer lock.Unlock()
+	if tabStatsLoaded(tabUUID) {
+		return nil
+	}
+	return rebuildTabStats(tabUUID)
+}
 
-		// Update MaxTime if the current duration is greater
-		if duration > metrics.MaxTime {
-			metrics.MaxTime = duration
-		}
+// rebuildTabStats replaces the statistics of a tab with those of every entry in its session.
+// The caller holds the session's lock, so no upload is merged into the tab meanwhile. A tab
+// without a session is left without statistics.
+func rebuildTabStats(tabUUID string) error {
+	exists, err := sessionStore.Exists(tabUUID)
+	if err != nil || !exists {
+		return err
+	}
 
-		// Update MinTime
-		if duration < metrics.MinTime {
-			metrics.MinTime = duration
-		}
+	analysis := newLogAnalysis(nil, nil, nil)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(sessionStore.Export(tabUUID, writer))
+	}()
+	err = importSessionEntries(reader, tabUUID, analysis, analysis.add)
+	reader.CloseWithError(err) // Stops the export if the entries could not be read
+	if err != nil {
+		return err
 	}
+	analysis.computeStats()
+	analysis.applySampleScale()
+
+	tabStatsMu.Lock()
+	delete(requestPathStats, tabUUID)
+	delete(queryMetricsMap, tabUUID)
+	tabStatsMu.Unlock()
+	analysis.mergeIntoTab(tabUUID)
+	return nil
+}
 
-	//Calculate the 95th percentile for each query
-	for _, queryMetrics := range queryMetricsMap[tabUUID] {
-		sort.Float64s(queryMetrics.Durations)
-		n := len(queryMetrics.Durations)
-		if n > 0 {
-			index := int(float64(n)*0.95+0.5) - 1
-			if index >= n {
-				index = n - 1
-			}
-			queryMetrics.Percentile = queryMetrics.Durations[index]
-		}
+// marshal is a helper function used to convert Go data structures to JSON  so that they can be safely embedded into HTML templates
+func marshal(v interface{}) template.JS {
+	a, err := json.Marshal(v)
+	if err != nil {
+		return template.JS("null")
 	}
+	// Return the JSON result as a template.JS type
+	return template.JS(a)
 }
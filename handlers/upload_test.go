@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useTestServerDir runs the test in a temporary directory laid out like the server's, with the
+// templates of the repository and an empty uploads directory
+func useTestServerDir(t *testing.T) {
+	t.Helper()
+	templates, err := filepath.Abs("../template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(templates, filepath.Join(dir, "template")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "uploads"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// testUploadLog returns a log of requests to /api/orders, each answered after 10 to 14 ms. The
+// correlation IDs and times differ between uploads, so none of the entries are duplicates.
+func testUploadLog(upload, requests int) string {
+	var log strings.Builder
+	for i := 0; i < requests; i++ {
+		timestamp := fmt.Sprintf("2024-05-01 10:%02d:%02d,000", upload, i)
+		correlationID := fmt.Sprintf("c%d-%d", upload, i)
+		fmt.Fprintf(&log, "%s|%s|t1|0|HTTP-In-Request|%s|handle||/api/orders\n", timestamp, correlationID, timestamp)
+		fmt.Fprintf(&log, "%s|%s|t1|5|DB|%s|query|SELECT * FROM orders|/api/orders\n", timestamp, correlationID, timestamp)
+		fmt.Fprintf(&log, "%s|%s|t1|%d|HTTP-In-Response|%s|handle||/api/orders\n", timestamp, correlationID, 10+i%5, timestamp)
+	}
+	return log.String()
+}
+
+// postUpload sends a file to UploadHandler like the upload form does
+func postUpload(tabUUID, fileName, content string) *httptest.ResponseRecorder {
+	return postUploadForm(tabUUID, fileName, content, nil)
+}
+
+// postUploadForm sends a file to UploadHandler together with further form fields
+func postUploadForm(tabUUID, fileName, content string, fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("uniqueID", tabUUID)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	file, _ := form.CreateFormFile("uploadedFile", fileName)
+	file.Write([]byte(content))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+	return w
+}
+
+// forgetTabStats removes the statistics of tabs from memory, as a restart does
+func forgetTabStats(tabs ...string) {
+	tabStatsMu.Lock()
+	defer tabStatsMu.Unlock()
+	for _, tab := range tabs {
+		delete(requestPathStats, tab)
+		delete(queryMetricsMap, tab)
+	}
+}
+
+func TestUploadHandlerConcurrentUploads(t *testing.T) {
+	useTestServerDir(t)
+	tabs := []string{"5b0e8c1a-3d4f-4e2a-9b6c-7d8e9f0a1b2c", "6c1f9d2b-4e5a-4f3b-8c7d-8e9f0a1b2c3d"}
+	const uploadsPerTab, requestsPerUpload = 4, 20
+	t.Cleanup(func() { forgetTabStats(tabs...) })
+
+	// Uploads to the same tab and to different tabs run at the same time
+	var wg sync.WaitGroup
+	for upload := 0; upload < uploadsPerTab*len(tabs); upload++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tab := tabs[upload%len(tabs)]
+			w := postUpload(tab, fmt.Sprintf("app-%d.log", upload), testUploadLog(upload, requestsPerUpload))
+			if w.Code != http.StatusOK {
+				t.Errorf("upload %d to %s: %d %s", upload, tab, w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, tab := range tabs {
+		r := httptest.NewRequest(http.MethodGet, "/upload?uniqueID="+tab, nil)
+		w := httptest.NewRecorder()
+		UploadHandler(w, r)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `data-path="/api/orders"`) {
+			t.Errorf("GET stats of %s: %d, /api/orders not listed", tab, w.Code)
+		}
+
+		want := uploadsPerTab * requestsPerUpload
+		pathStats, queryMetrics := tabStats(tab)
+		if stats := pathStats["/api/orders"]; stats == nil || stats.Count != want || stats.MinTime != 10 || stats.MaxTime != 14 {
+			t.Errorf("stats of /api/orders in %s = %+v, want %d responses of 10 to 14 ms", tab, stats, want)
+		}
+		if metrics := queryMetrics["SELECT * FROM orders"]; metrics == nil || metrics.Count != want {
+			t.Errorf("metrics of the query in %s = %+v, want %d executions", tab, metrics, want)
+		}
+		if stat, err := sessionStore.Stat(tab); err != nil || stat.Entries != 3*want {
+			t.Errorf("session of %s = %+v, %v, want %d entries", tab, stat, err, 3*want)
+		}
+	}
+}
+
+func TestTabStatsRebuild(t *testing.T) {
+	useTestServerDir(t)
+	tests := []struct {
+		name   string
+		tab    string
+		fields map[string]string
+	}{
+		{"complete", "7d2a0e3c-5f6b-4a4c-9d8e-9f0a1b2c3d4e", nil},
+		{"sampled", "8e3b1f4d-6a7c-4b5d-8e9f-0a1b2c3d4e5f", map[string]string{"sampling": "every", "sampleRate": "4"}},
+		{"sampled in percent", "9f4c2a5e-7b8d-4c6e-9fa0-1b2c3d4e5f60", map[string]string{"sampling": "percent", "sampleRate": "50"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() { forgetTabStats(test.tab) })
+			for upload := 0; upload < 2; upload++ {
+				w := postUploadForm(test.tab, fmt.Sprintf("app-%d.log", upload), testUploadLog(upload, 40), test.fields)
+				if w.Code != http.StatusOK {
+					t.Fatalf("upload %d: %d %s", upload, w.Code, w.Body.String())
+				}
+			}
+			pathStats, queryMetrics := tabStats(test.tab)
+			if stats := pathStats["/api/orders"]; stats == nil || stats.Estimated != (test.fields != nil) {
+				t.Fatalf("stats of /api/orders = %+v, want them estimated only from a sample", stats)
+			}
+
+			// Statistics rebuilt from the stored session, e.g. after a restart, are the same
+			forgetTabStats(test.tab)
+			rebuiltPaths, rebuiltQueries := tabStats(test.tab)
+			if !reflect.DeepEqual(rebuiltPaths, pathStats) {
+				t.Errorf("rebuilt path stats = %+v, want %+v", rebuiltPaths["/api/orders"], pathStats["/api/orders"])
+			}
+			if !reflect.DeepEqual(rebuiltQueries, queryMetrics) {
+				t.Errorf("rebuilt query metrics = %+v, want %+v", rebuiltQueries["SELECT * FROM orders"], queryMetrics["SELECT * FROM orders"])
+			}
+		})
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"Log_Anallyzer/handlers"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"runtime"
+	"strings"
+	_ "time/tzdata" // Time zones selectable at upload must not depend on the host's zoneinfo
 )
 
 func main() {
@@ -12,6 +16,60 @@ func main() {
 		os.Mkdir("uploads", os.ModePerm)
 	}
 
+	// Load the log format definitions, falling back to the built-in pipe format
+	if err := handlers.LoadLogFormats("config/logFormats.json"); err != nil {
+		fmt.Println("Using built-in log format:", err)
+	}
+
+	// Load the include/exclude rules, falling back to excluding static assets
+	if err := handlers.LoadFilterRules("config/filterRules.json"); err != nil {
+		fmt.Println("Using built-in filter rules:", err)
+	}
+
+	// "ingest" parses log files on this machine into a session instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "ingest" {
+		os.Exit(runIngest(os.Args[2:]))
+	}
+
+	// Files can only be followed inside the directories given with -follow-dirs
+	followDirs := flag.String("follow-dirs", "", "comma-separated directories whose log files can be followed from the web UI")
+
+	// Syslog senders are accepted on -syslog-port, every hostname or app-name gets its own
+	// session named syslog-<name>
+	var syslog handlers.SyslogOptions
+	flag.IntVar(&syslog.Port, "syslog-port", 0, "port to receive syslog messages on over TCP and UDP, 0 disables the receiver")
+	flag.StringVar(&syslog.RouteBy, "syslog-route", "hostname", "syslog field that names the session of a message: hostname or app-name")
+	flag.StringVar(&syslog.LogFormat, "syslog-format", "pipe", "log format of the syslog message bodies, auto-detected if empty")
+	flag.StringVar(&syslog.TimeZone, "syslog-timezone", "UTC", "time zone of syslog message timestamps without an offset")
+
+	// The files of an upload are parsed by up to -parse-workers goroutines
+	parseWorkers := flag.Int("parse-workers", runtime.NumCPU(), "number of files of an upload parsed at the same time")
+
+	// Sessions are kept in append-only JSON segments, or in an embedded store indexed for the drill-downs
+	sessionStore := flag.String("session-store", "json", "where sessions are saved: json or indexed")
+
+	// Sessions nothing was uploaded to for -session-ttl are deleted in the background
+	sessionTTL := flag.Duration("session-ttl", 0, "delete sessions nothing was uploaded to for this long, e.g. 168h, 0 keeps them")
+	flag.Parse()
+
+	handlers.SetParseWorkers(*parseWorkers)
+	if err := handlers.SetSessionStore(*sessionStore); err != nil {
+		fmt.Println("Server not started:", err)
+		os.Exit(2)
+	}
+	handlers.StartSessionJanitor(*sessionTTL)
+
+	if err := handlers.SetFollowDirs(strings.Split(*followDirs, ",")); err != nil {
+		fmt.Println("Following files is disabled:", err)
+	}
+	if syslog.Port != 0 {
+		if err := handlers.StartSyslog(syslog); err != nil {
+			fmt.Println("Syslog receiver not started:", err)
+		} else {
+			fmt.Printf("Receiving syslog messages on port %d\n", syslog.Port)
+		}
+	}
+
 	// Redirect root to /upload
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Redirecting from / to /upload")
@@ -19,12 +77,64 @@ func main() {
 	})
 
 	http.HandleFunc("/upload", handlers.UploadHandler)
+	http.HandleFunc("/upload/chunked/init", handlers.ChunkedUploadInitHandler)
+	http.HandleFunc("/upload/chunked", handlers.ChunkedUploadHandler)
+	http.HandleFunc("/upload/chunked/complete", handlers.ChunkedUploadCompleteHandler)
+	http.HandleFunc("/upload/job", handlers.AnalysisJobStatusHandler)
+	http.HandleFunc("/upload/job/cancel", handlers.AnalysisJobCancelHandler)
+	http.HandleFunc("/upload/job/result", handlers.AnalysisJobResultHandler)
 	http.HandleFunc("/request-details", handlers.RequestDetailsHandler)
 	http.HandleFunc("/queryExecutions", handlers.QueryExecutionsHandler)
 	http.HandleFunc("/correlationDetails", handlers.CorrelationDetailsHandler)
 	http.HandleFunc("/queryExecutionsForRequestPath", handlers.QueryExecutionsForRequestHandler)
 	http.HandleFunc("/queryDetails", handlers.QueryDetailsHandler)
+	http.HandleFunc("/diagnostics", handlers.DiagnosticsHandler)
+	http.HandleFunc("/session/export", handlers.ExportSessionHandler)
+	http.HandleFunc("/sessions", handlers.SessionsHandler)
+	http.HandleFunc("/api/sessions", handlers.SessionsAPIHandler)
+	http.HandleFunc("/api/sessions/rename", handlers.SessionRenameHandler)
+	http.HandleFunc("/api/sessions/delete", handlers.SessionDeleteHandler)
+	http.HandleFunc("/follow", handlers.FollowHandler)
+	http.HandleFunc("/follow/status", handlers.FollowStatusHandler)
+	http.HandleFunc("/follow/stop", handlers.FollowStopHandler)
+	http.HandleFunc("/api/ingest", handlers.IngestAPIHandler)
 
 	fmt.Println("Server started on http://localhost:8080/upload")
 	http.ListenAndServe(":8080", nil)
 }
+
+// runIngest implements "loganalyzer ingest --session NAME [flags] paths...". The session can be
+// opened in the web UI afterwards under the same name.
+func runIngest(args []string) int {
+	var options handlers.IngestOptions
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	flags.StringVar(&options.Session, "session", "", "name of the session to write to in the session store (required)")
+	flags.StringVar(&options.LogFormat, "format", "", "log format name, auto-detected per line if empty")
+	flags.StringVar(&options.TimeZone, "timezone", "UTC", "time zone of timestamps without an offset")
+	flags.StringVar(&options.Encoding, "encoding", "", "encoding of files without a byte order mark, e.g. UTF-16LE or Windows-1252, UTF-8 if empty")
+	flags.StringVar(&options.RulesFile, "rules", "", "file with filter rules, one \"<action> <match> <value>\" per line")
+	flags.IntVar(&options.SampleEvery, "sample-every", 0, "analyze only about 1 in N correlation IDs, chosen by hash, and estimate the counts")
+	flags.Float64Var(&options.SamplePercent, "sample-percent", 0, "analyze only this percentage of the correlation IDs, chosen by hash, and estimate the counts")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of files parsed at the same time")
+	store := flags.String("store", "json", "session store to write to, json or indexed, as selected for the server with -session-store")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: loganalyzer ingest --session NAME [flags] files, directories or globs...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if options.Session == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	handlers.SetParseWorkers(*workers)
+	if err := handlers.SetSessionStore(*store); err != nil {
+		fmt.Fprintln(os.Stderr, "Ingest failed:", err)
+		return 2
+	}
+	if err := handlers.IngestFiles(options, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "Ingest failed:", err)
+		return 1
+	}
+	return 0
+}